@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"shared/authz"
+)
+
+const headerAdminToken = "X-Admin-Token"
+
+// adminToken, when set, grants access to the admin endpoints through the
+// X-Admin-Token header in addition to admin-role JWTs.
+var adminToken string
+
+// requireAdmin lets a request through if it carries the admin token or a
+// valid JWT with the admin role.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get(headerAdminToken); adminToken != "" && token != "" {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+				next(w, r)
+				return
+			}
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+
+		claims, err := authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !slices.Contains(claims.Roles, authz.RoleAdmin) {
+			writeJSONError(w, http.StatusForbidden, "admin role required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RouteStats is the admin view of a route's upstream pool.
+type RouteStats struct {
+	Name     string         `json:"name"`
+	Prefix   string         `json:"prefix"`
+	Service  string         `json:"service,omitempty"`
+	Strategy string         `json:"strategy"`
+	Source   string         `json:"source"`
+	Backends []BackendStats `json:"backends"`
+}
+
+// upstreamsHandler reports per-instance load balancing stats of every route.
+func upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	routes := []RouteStats{}
+	for _, rt := range routeTable.Load().routes {
+		stats := RouteStats{
+			Name:     rt.Name,
+			Prefix:   rt.Prefix,
+			Service:  rt.Service,
+			Strategy: rt.Strategy,
+			Source:   "static",
+			Backends: []BackendStats{},
+		}
+		pool, fromRegistry := rt.pool()
+		if fromRegistry {
+			stats.Source = "registry"
+		}
+		for _, b := range pool {
+			stats.Backends = append(stats.Backends, b.stats())
+		}
+		routes = append(routes, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"routes": routes})
+}
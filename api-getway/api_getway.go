@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -11,53 +14,20 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"shared/config"
+	"shared/graceful"
+	"shared/logging"
+	"shared/metrics"
+	"shared/tracing"
 )
 
-type ServiceRegistry struct {
-	UserService    *url.URL
-	ProductService *url.URL
-	OrderService   *url.URL
-}
-
-var registry ServiceRegistry
-
-func initServiceRegistry() {
-	var err error
-
-	registry.UserService, err = url.Parse("http://user-service:8001")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	registry.ProductService, err = url.Parse("http://product-service:8002")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	registry.OrderService, err = url.Parse("http://order-service:8003")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Println("Service registry initialized")
-}
-
-// Logging middleware
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("[%s] %s %s", r.Method, r.RequestURI, r.RemoteAddr)
-		next.ServeHTTP(w, r)
-		log.Printf("Completed in %v", time.Since(start))
-	})
-}
-
 // CORS middleware
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-API-Key, X-Request-ID, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", "RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Circuit-Breaker, X-Request-ID, API-Version, Deprecation, Sunset, Link")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -68,138 +38,173 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// Rate limiting middleware (simple in-memory implementation)
-var requestCounts = make(map[string]int)
-var lastReset = time.Now()
-
-func rateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Reset counts every minute
-		if time.Since(lastReset) > time.Minute {
-			requestCounts = make(map[string]int)
-			lastReset = time.Now()
-		}
-
-		clientIP := r.RemoteAddr
-		requestCounts[clientIP]++
-
-		// Allow 100 requests per minute per IP
-		if requestCounts[clientIP] > 100 {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
+// upstreamTransport is shared by all upstream proxies. The short dial timeout
+// makes an unreachable instance fail fast instead of holding the request
+// until the route timeout.
+var upstreamTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 3 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   20,
+	IdleConnTimeout:       90 * time.Second,
+	ExpectContinueTimeout: time.Second,
 }
 
-// Health check aggregator
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	services := map[string]string{
-		"user-service":    "http://localhost:8001/health",
-		"product-service": "http://localhost:8002/health",
-		"order-service":   "http://localhost:8003/health",
-	}
+// Create reverse proxy for a single upstream
+func createReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = tracing.Transport(upstreamTransport)
 
-	results := make(map[string]string)
-	allHealthy := true
-
-	for name, endpoint := range services {
-		resp, err := http.Get(endpoint)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			results[name] = "unhealthy"
-			allHealthy = false
-		} else {
-			results[name] = "healthy"
-			resp.Body.Close()
+	// Retryable statuses are turned into errors while another attempt may follow
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if _, pending := pendingAttempt(resp.Request); pending && retryableStatus(resp.StatusCode) {
+			return &upstreamStatusError{StatusCode: resp.StatusCode}
 		}
+		return nil
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if !allHealthy {
-		w.WriteHeader(http.StatusServiceUnavailable)
-	}
-
-	fmt.Fprintf(w, `{"gateway": "healthy", "services": %v}`, results)
-}
-
-// Create reverse proxy handler
-func createReverseProxy(target *url.URL) http.HandlerFunc {
-	proxy := httputil.NewSingleHostReverseProxy(target)
-
 	// Custom error handler
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Proxy error: %v", err)
+		recordUpstreamError(r, err)
+		if a, pending := pendingAttempt(r); pending {
+			a.err = err
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "Proxy error", "upstream", target.String(), "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			fmt.Fprintf(w, `{"error": "Upstream timeout"}`)
+			return
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		fmt.Fprintf(w, `{"error": "Service unavailable"}`)
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		proxy.ServeHTTP(w, r)
-	}
+	return proxy
 }
 
-// Route requests to appropriate service
+// Route requests to the matching entry of the route table. Routes are
+// matched without the API version, which is put back when forwarding.
 func routeHandler(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-
-	// Route to User Service
-	if strings.HasPrefix(path, "/api/users") {
-		createReverseProxy(registry.UserService)(w, r)
-		return
-	}
+	version, inPath := negotiateVersion(r)
+	w.Header().Add("Vary", "Accept")
 
-	// Route to Product Service
-	if strings.HasPrefix(path, "/api/products") {
-		createReverseProxy(registry.ProductService)(w, r)
+	rt, methodMismatch := routeTable.Load().Match(r)
+	if rt == nil {
+		if methodMismatch {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
-
-	// Route to Order Service
-	if strings.HasPrefix(path, "/api/orders") {
-		createReverseProxy(registry.OrderService)(w, r)
+	if version != "" && !rt.supportsVersion(version) {
+		status := http.StatusNotAcceptable
+		if inPath {
+			status = http.StatusNotFound
+		}
+		writeJSONError(w, status, fmt.Sprintf("API version %s is not supported", version))
 		return
 	}
 
-	http.Error(w, "Not Found", http.StatusNotFound)
-}
-
-// Service discovery endpoint
-func servicesHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{
-		"services": {
-			"user-service": "http://localhost:8001",
-			"product-service": "http://localhost:8002",
-			"order-service": "http://localhost:8003"
-		}
-	}`)
+	rt.ServeHTTP(w, withVersion(r, version))
 }
 
 func main() {
-	initServiceRegistry()
+	conf, err := config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+	logging.Setup(conf, "api-gateway")
+	server := conf.Server(8000)
+	routesFile := conf.String("ROUTES_FILE", "routes.yaml")
+	initAuth(conf)
+	initRateLimits(conf)
+	shutdownTracing := tracing.Setup(conf, "api-gateway")
+	registryAddr := initRegistry(conf)
+	adminToken = conf.String("ADMIN_TOKEN", "")
+	ejectionThreshold = conf.Int("EJECTION_CONSECUTIVE_FAILURES", ejectionThreshold)
+	ejectionBaseTime = conf.Duration("EJECTION_BASE_TIME", ejectionBaseTime)
+	ejectionMaxTime = conf.Duration("EJECTION_MAX_TIME", ejectionMaxTime)
+	breakerFailureThreshold = conf.Int("BREAKER_FAILURE_THRESHOLD", breakerFailureThreshold)
+	breakerOpenTimeout = conf.Duration("BREAKER_OPEN_TIMEOUT", breakerOpenTimeout)
+	breakerHalfOpenRequests = conf.Int("BREAKER_HALF_OPEN_REQUESTS", breakerHalfOpenRequests)
+	retryMax = conf.Int("RETRY_MAX", retryMax)
+	retryBaseDelay = conf.Duration("RETRY_BASE_DELAY", retryBaseDelay)
+	retryMaxDelay = conf.Duration("RETRY_MAX_DELAY", retryMaxDelay)
+	healthCheckInterval = conf.Duration("HEALTH_CHECK_INTERVAL", healthCheckInterval)
+	healthCheckTimeout = conf.Duration("HEALTH_CHECK_TIMEOUT", healthCheckTimeout)
+	healthCheckPath = conf.String("HEALTH_CHECK_PATH", healthCheckPath)
+	healthCheckUnhealthyThreshold = conf.Int("HEALTH_CHECK_UNHEALTHY_THRESHOLD", healthCheckUnhealthyThreshold)
+	healthCheckHealthyThreshold = conf.Int("HEALTH_CHECK_HEALTHY_THRESHOLD", healthCheckHealthyThreshold)
+	revocationListURL = conf.String("REVOCATION_LIST_URL", revocationListURL)
+	revocationSyncInterval = conf.Duration("REVOCATION_SYNC_INTERVAL", revocationSyncInterval)
+	if err := conf.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	table, err := loadRouteTable(routesFile, conf)
+	if err != nil {
+		logging.Fatal("Failed to load routes", "file", routesFile, "error", err)
+	}
+	routeTable.Store(table)
+	watchRouteReloads(routesFile, conf)
+
+	go registry.runEviction()
+	go runHealthChecks()
+	go runJWKSRefresh()
+	if revocationListURL != "" {
+		go runRevocationSync()
+	} else {
+		slog.Warn("REVOCATION_LIST_URL is not set, revoked tokens are accepted until they expire")
+	}
 
 	r := mux.NewRouter()
 
 	// Gateway-specific endpoints
 	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
 	r.HandleFunc("/services", servicesHandler).Methods("GET")
+	r.HandleFunc("/admin/upstreams", requireAdmin(upstreamsHandler)).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
+	r.Use(routeNameMiddleware)
 
 	// Proxy all API requests
 	r.PathPrefix("/api/").HandlerFunc(routeHandler)
 
 	// Apply middleware
-	handler := loggingMiddleware(corsMiddleware(rateLimitMiddleware(r)))
-
-	fmt.Println("API Gateway running on :8000")
-	fmt.Println("-----------------------------------")
-	fmt.Println("Routes:")
-	fmt.Println("  GET  /health           - Health check")
-	fmt.Println("  GET  /services         - Service registry")
-	fmt.Println("  *    /api/users/*      -> User Service (8001)")
-	fmt.Println("  *    /api/products/*   -> Product Service (8002)")
-	fmt.Println("  *    /api/orders/*     -> Order Service (8003)")
-	fmt.Println("-----------------------------------")
-
-	log.Fatal(http.ListenAndServe(":8000", handler))
+	handler := tracing.Middleware(metrics.Middleware(logging.Middleware(stripIdentity(corsMiddleware(rateLimitMiddleware(r))))))
+
+	for _, rt := range table.routes {
+		methods := "*"
+		if len(rt.Methods) > 0 {
+			methods = strings.Join(rt.Methods, ",")
+		}
+		slog.Info("Route", "name", rt.Name, "prefix", rt.Prefix, "methods", methods,
+			"targets", rt.Targets, "strategy", rt.Strategy)
+	}
+
+	// Registration is served on its own listener, which is only reachable on
+	// the service network
+	registryServer := server
+	registryServer.Addr = registryAddr
+	registrySrv := registryServer.HTTPServer(tracing.Middleware(logging.Middleware(registry.Handler())))
+	go func() {
+		if err := registrySrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Registry listener failed", "addr", registryAddr, "error", err)
+		}
+	}()
+	slog.Info("API Gateway running", "addr", server.Addr, "registry_addr", registryAddr)
+
+	ctx, stop := graceful.SignalContext()
+	defer stop()
+	err = graceful.Run(ctx, server, handler,
+		graceful.Cleanup{Name: "registry listener", Fn: registrySrv.Shutdown},
+		graceful.Cleanup{Name: "tracing", Fn: shutdownTracing},
+	)
+	if err != nil {
+		logging.Fatal("Server failed to start", "error", err)
+	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"shared/authz"
+	"shared/config"
+	"shared/jwks"
+)
+
+// Headers carrying the verified identity to upstream services. Any client
+// supplied values are removed before the request is proxied.
+const (
+	headerUserID      = authz.HeaderUserID
+	headerUserEmail   = authz.HeaderUserEmail
+	headerRoles       = authz.HeaderRoles
+	headerPermissions = authz.HeaderPermissions
+)
+
+// identityHeaders also lists the header services use to call each other on
+// their own behalf and the service token, which clients must not be able to
+// send either.
+var identityHeaders = []string{headerUserID, headerUserEmail, headerRoles, headerPermissions, authz.HeaderService, authz.HeaderToken}
+
+// Claims mirrors the token payload issued by user-service.
+type Claims struct {
+	UserID      int      `json:"user_id"`
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// can reports whether the token grants permission.
+func (c *Claims) can(permission string) bool {
+	return slices.Contains(c.Permissions, permission)
+}
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid or expired token")
+	errRevokedToken = errors.New("token has been revoked")
+)
+
+func initAuth(conf *config.Loader) {
+	authz.Setup(conf)
+	jwksURL = conf.URL("JWKS_URL", jwksURL)
+	jwksRefreshInterval = conf.Duration("JWKS_REFRESH_INTERVAL", jwksRefreshInterval)
+}
+
+// authenticate validates the bearer token on the request and returns its claims.
+func authenticate(r *http.Request) (*Claims, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, errMissingToken
+	}
+
+	scheme, tokenString, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || tokenString == "" {
+		return nil, errInvalidToken
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := verificationKeys.lookup(r.Context(), kid)
+		if !ok || k.alg != t.Method.Alg() {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return k.key, nil
+	}, jwt.WithValidMethods([]string{jwks.EdDSA, jwks.RS256}), jwt.WithExpirationRequired())
+	if err != nil || claims.UserID == 0 {
+		return nil, errInvalidToken
+	}
+	if isRevoked(claims.ID) {
+		return nil, errRevokedToken
+	}
+
+	return claims, nil
+}
+
+// stripIdentity drops identity headers sent by the client. Only authorize sets
+// them, once the caller's token is verified, so they can be trusted by the
+// services and the access log.
+func stripIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range identityHeaders {
+			r.Header.Del(h)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize resolves the caller identity for a matched route and checks the
+// permission the route requires for the request, if any. On success the
+// request carries trusted identity headers; otherwise a JSON 401 or 403 is
+// written and false is returned.
+func authorize(rt *route, w http.ResponseWriter, r *http.Request) bool {
+	for _, h := range identityHeaders {
+		r.Header.Del(h)
+	}
+
+	permission := rt.requiredPermission(r)
+	claims, err := authenticate(r)
+	if err == nil {
+		r.Header.Set(headerUserID, strconv.Itoa(claims.UserID))
+		r.Header.Set(headerUserEmail, claims.Email)
+		if len(claims.Roles) > 0 {
+			r.Header.Set(headerRoles, authz.JoinList(claims.Roles))
+		}
+		if len(claims.Permissions) > 0 {
+			r.Header.Set(headerPermissions, authz.JoinList(claims.Permissions))
+		}
+		authz.SetToken(r.Header)
+		// Checked after setting the headers, so the access log names refused users
+		if permission != "" && !claims.can(permission) {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("permission %s required", permission))
+			return false
+		}
+		return true
+	}
+
+	// Public endpoints are served anonymously, even with a bad token.
+	if permission == "" && !rt.requiresAuth(r) {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	if errors.Is(err, errMissingToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+	}
+	writeJSONError(w, http.StatusUnauthorized, err.Error())
+	return false
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
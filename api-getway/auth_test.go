@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"shared/authz"
+	"shared/jwks"
+)
+
+const testServiceToken = "test-service-token-0123456789abcdef"
+
+// spoofedIdentity is what a client could try to send to claim an identity.
+var spoofedIdentity = map[string]string{
+	headerUserID:        "1",
+	headerUserEmail:     "admin@example.com",
+	headerRoles:         authz.RoleAdmin,
+	headerPermissions:   authz.RolesManage,
+	authz.HeaderService: "order-service",
+	authz.HeaderToken:   "guessed",
+}
+
+// useTestSigningKey makes the gateway trust tokens signed by the returned
+// function and configures the service token.
+func useTestSigningKey(t *testing.T) func(claims *Claims) string {
+	t.Helper()
+	authz.Setup(testConfig(t, map[string]string{"SERVICE_TOKEN": testServiceToken}))
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := verificationKeys.keys.Load()
+	keys := map[string]verificationKey{"test-key": {alg: jwks.EdDSA, key: pub}}
+	verificationKeys.keys.Store(&keys)
+	// Unknown kids must not make the test fetch the key set
+	verificationKeys.lastFetch = time.Now()
+	t.Cleanup(func() { verificationKeys.keys.Store(saved) })
+
+	return func(claims *Claims) string {
+		if claims.ExpiresAt == nil {
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Minute))
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = "test-key"
+		signed, err := token.SignedString(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+}
+
+func TestStripIdentity(t *testing.T) {
+	var got http.Header
+	handler := stripIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/orders/1", nil)
+	for k, v := range spoofedIdentity {
+		r.Header.Set(k, v)
+	}
+	r.Header.Set("Authorization", "Bearer abc")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, h := range identityHeaders {
+		if v := got.Get(h); v != "" {
+			t.Errorf("%s = %q reached the routes", h, v)
+		}
+	}
+	if got.Get("Authorization") != "Bearer abc" {
+		t.Error("Authorization header removed")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	sign := useTestSigningKey(t)
+	table, err := loadRouteTable("routes.yaml", testConfig(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := sign(&Claims{UserID: 7, Email: "user@example.com"})
+	admin := sign(&Claims{
+		UserID: 1, Email: "admin@example.com", Roles: []string{authz.RoleAdmin},
+		Permissions: []string{authz.ProductsWrite, authz.StockWrite, authz.OrdersStatus, authz.RolesManage},
+	})
+	orderManager := sign(&Claims{UserID: 8, Roles: []string{"order_manager"}, Permissions: []string{authz.OrdersStatus}})
+	expired := sign(&Claims{UserID: 7, RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		spoof      bool
+		wantStatus int // 0 when the request is let through
+		wantUserID string
+	}{
+		// Permission rules
+		{name: "role listing anonymous", method: "GET", path: "/api/users/roles", wantStatus: http.StatusUnauthorized},
+		{name: "role listing without permission", method: "GET", path: "/api/users/roles", token: user, wantStatus: http.StatusForbidden},
+		{name: "role listing with permission", method: "GET", path: "/api/users/roles", token: admin, wantUserID: "1"},
+		{name: "grant with spoofed headers only", method: "PUT", path: "/api/users/5/roles/admin", spoof: true, wantStatus: http.StatusUnauthorized},
+		{name: "grant with spoofed permission", method: "PUT", path: "/api/users/7/roles/admin", token: user, spoof: true, wantStatus: http.StatusForbidden},
+		{name: "own roles", method: "GET", path: "/api/users/7/roles", token: user, wantUserID: "7"},
+		{name: "create product without permission", method: "POST", path: "/api/products", token: user, wantStatus: http.StatusForbidden},
+		{name: "create product with permission", method: "POST", path: "/api/products", token: admin, wantUserID: "1"},
+		{name: "stock without permission", method: "PATCH", path: "/api/products/1/stock", token: orderManager, wantStatus: http.StatusForbidden},
+		{name: "reservations read needs permission", method: "GET", path: "/api/products/reservations", token: user, wantStatus: http.StatusForbidden},
+		{name: "order status without permission", method: "PATCH", path: "/api/orders/1/status", token: user, spoof: true, wantStatus: http.StatusForbidden},
+		{name: "order status with permission", method: "PATCH", path: "/api/orders/1/status", token: orderManager, wantUserID: "8"},
+
+		// Authentication
+		{name: "orders anonymous", method: "GET", path: "/api/orders/1", spoof: true, wantStatus: http.StatusUnauthorized},
+		{name: "orders with a forged token", method: "GET", path: "/api/orders/1", token: "not.a.token", wantStatus: http.StatusUnauthorized},
+		{name: "orders with an expired token", method: "GET", path: "/api/orders/1", token: expired, wantStatus: http.StatusUnauthorized},
+		{name: "orders", method: "GET", path: "/api/orders/1", token: user, spoof: true, wantUserID: "7"},
+
+		// Public endpoints are served anonymously, never with the spoofed identity
+		{name: "login", method: "POST", path: "/api/users/login", spoof: true},
+		{name: "login with a bad token", method: "POST", path: "/api/users/login", token: "not.a.token"},
+		{name: "product read", method: "GET", path: "/api/products/1", spoof: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.spoof {
+				for k, v := range spoofedIdentity {
+					r.Header.Set(k, v)
+				}
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rt, _ := table.Match(r)
+			if rt == nil {
+				t.Fatalf("no route for %s %s", tt.method, tt.path)
+			}
+
+			w := httptest.NewRecorder()
+			ok := authorize(rt, w, r)
+			if tt.wantStatus != 0 {
+				if ok || w.Code != tt.wantStatus {
+					t.Fatalf("authorize = %v, status %d, want %d", ok, w.Code, tt.wantStatus)
+				}
+				if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+					t.Error("401 without WWW-Authenticate")
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("authorize refused with %d: %s", w.Code, w.Body)
+			}
+
+			if got := r.Header.Get(headerUserID); got != tt.wantUserID {
+				t.Errorf("%s = %q, want %q", headerUserID, got, tt.wantUserID)
+			}
+			if tt.wantUserID == "" {
+				for _, h := range identityHeaders {
+					if v := r.Header.Get(h); v != "" {
+						t.Errorf("anonymous request forwarded with %s = %q", h, v)
+					}
+				}
+				return
+			}
+			if got := r.Header.Get(authz.HeaderToken); got != testServiceToken {
+				t.Errorf("%s = %q, want the service token", authz.HeaderToken, got)
+			}
+			if got := r.Header.Get(authz.HeaderService); got != "" {
+				t.Errorf("spoofed %s = %q forwarded", authz.HeaderService, got)
+			}
+			if tt.spoof && r.Header.Get(headerRoles) == authz.RoleAdmin {
+				t.Error("spoofed roles forwarded")
+			}
+		})
+	}
+}
+
+// TestAuthorizeForwardsVerifiedIdentity checks that the services can read
+// the identity forwarded by the gateway, and only that one.
+func TestAuthorizeForwardsVerifiedIdentity(t *testing.T) {
+	sign := useTestSigningKey(t)
+	rt := &route{RouteConfig: RouteConfig{Prefix: "/api/orders", AuthRequired: true}}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/orders/1", nil)
+	for k, v := range spoofedIdentity {
+		r.Header.Set(k, v)
+	}
+	r.Header.Set("Authorization", "Bearer "+sign(&Claims{
+		UserID: 7, Email: "user@example.com", Roles: []string{"order_manager"}, Permissions: []string{authz.OrdersStatus},
+	}))
+	if !authorize(rt, httptest.NewRecorder(), r) {
+		t.Fatal("authorize refused a valid token")
+	}
+
+	id := authz.FromHeaders(r)
+	if id == nil || id.UserID != 7 || id.Email != "user@example.com" || id.IsService() {
+		t.Fatalf("services see %+v, want user 7", id)
+	}
+	if id.IsAdmin() || !id.HasRole("order_manager") || !id.Can(authz.OrdersStatus) || id.Can(authz.RolesManage) {
+		t.Errorf("services see roles %v and permissions %v", id.Roles, id.Permissions)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load balancing strategies selectable per route.
+const (
+	strategyRoundRobin       = "round_robin"
+	strategyLeastConnections = "least_connections"
+	strategyWeighted         = "weighted"
+	strategyConsistentHash   = "consistent_hash"
+)
+
+// virtualNodes is the number of ring points per unit of weight used by the
+// consistent-hash strategy.
+const virtualNodes = 100
+
+// Passive ejection: an instance failing ejectionThreshold requests in a row
+// is taken out of rotation for ejectionBaseTime, doubled on every repeated
+// ejection up to ejectionMaxTime.
+var (
+	ejectionThreshold = 5
+	ejectionBaseTime  = 30 * time.Second
+	ejectionMaxTime   = 5 * time.Minute
+)
+
+// Target is a static upstream of a route. In the route file it is either a
+// plain URL or a mapping with url and weight.
+type Target struct {
+	URL    string `yaml:"url" json:"url"`
+	Weight int    `yaml:"weight" json:"weight"`
+}
+
+func (t *Target) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		t.URL = value.Value
+		return nil
+	}
+	type plain Target
+	return value.Decode((*plain)(t))
+}
+
+func (t Target) String() string {
+	if t.Weight > 1 {
+		return fmt.Sprintf("%s (weight %d)", t.URL, t.Weight)
+	}
+	return t.URL
+}
+
+// backend is one upstream instance together with its live statistics.
+type backend struct {
+	url     *url.URL
+	weight  int
+	proxy   *httputil.ReverseProxy
+	breaker *circuitBreaker
+	health  backendHealth
+
+	active   atomic.Int64
+	requests atomic.Uint64
+	failures atomic.Uint64
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+}
+
+func newBackend(target *url.URL, weight int) *backend {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &backend{
+		url:     target,
+		weight:  weight,
+		proxy:   createReverseProxy(target),
+		breaker: &circuitBreaker{name: target.String()},
+	}
+}
+
+func (b *backend) ejected(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.ejectedUntil)
+}
+
+// observe records the outcome of a proxied request. 5xx responses, including
+// the 502/504 written for transport errors, count as failures.
+func (b *backend) observe(status int) {
+	b.requests.Add(1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if status < 500 {
+		b.consecutiveFailures = 0
+		// A backend that stayed healthy long enough starts over at the base ejection time
+		if b.ejections > 0 && time.Since(b.ejectedUntil) > ejectionMaxTime {
+			b.ejections = 0
+		}
+		return
+	}
+
+	b.failures.Add(1)
+	b.consecutiveFailures++
+	if b.consecutiveFailures < ejectionThreshold {
+		return
+	}
+
+	duration := ejectionBaseTime << min(b.ejections, 16)
+	if duration > ejectionMaxTime || duration <= 0 {
+		duration = ejectionMaxTime
+	}
+	b.ejections++
+	b.consecutiveFailures = 0
+	b.ejectedUntil = time.Now().Add(duration)
+	slog.Warn("Ejected upstream", "upstream", b.url.String(), "duration", duration.String(), "consecutive_failures", ejectionThreshold)
+}
+
+// BackendStats is the admin view of a backend.
+type BackendStats struct {
+	URL                 string     `json:"url"`
+	Weight              int        `json:"weight"`
+	ActiveRequests      int64      `json:"active_requests"`
+	Requests            uint64     `json:"requests"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Ejections           int        `json:"ejections"`
+	Ejected             bool       `json:"ejected"`
+	Breaker             string     `json:"circuit_breaker"`
+	Health              string     `json:"health"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+}
+
+func (b *backend) stats() BackendStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BackendStats{
+		URL:                 b.url.String(),
+		Weight:              b.weight,
+		ActiveRequests:      b.active.Load(),
+		Requests:            b.requests.Load(),
+		Failures:            b.failures.Load(),
+		ConsecutiveFailures: b.consecutiveFailures,
+		Ejections:           b.ejections,
+		Breaker:             b.breaker.stateAt(time.Now()).String(),
+		Health:              b.health.stats(b.url.String()).Status,
+	}
+	if time.Now().Before(b.ejectedUntil) {
+		until := b.ejectedUntil
+		s.Ejected = true
+		s.EjectedUntil = &until
+	}
+	return s
+}
+
+// balancer selects a backend for each request of one route.
+type balancer struct {
+	strategy string
+	next     atomic.Uint64
+
+	mu sync.Mutex
+	// Smooth weighted round-robin state (weighted strategy)
+	current map[*backend]int
+	// Hash ring (consistent_hash strategy), rebuilt when the backend set changes
+	ringKey string
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+func newBalancer(strategy string) (*balancer, error) {
+	switch strategy {
+	case "":
+		strategy = strategyRoundRobin
+	case strategyRoundRobin, strategyLeastConnections, strategyWeighted, strategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+	return &balancer{strategy: strategy, current: make(map[*backend]int)}, nil
+}
+
+// pick returns the backend for r, or nil if there are none. Ejected backends
+// and backends failing their health checks are skipped unless that leaves
+// none, in which case all of them are eligible again rather than failing
+// every request.
+func (lb *balancer) pick(backends []*backend, r *http.Request) *backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	healthy := make([]*backend, 0, len(backends))
+	for _, b := range backends {
+		if !b.ejected(now) && b.health.routable() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = backends
+	}
+
+	switch lb.strategy {
+	case strategyLeastConnections:
+		return lb.leastConnections(healthy)
+	case strategyWeighted:
+		return lb.weighted(healthy)
+	case strategyConsistentHash:
+		return lb.consistentHash(backends, healthy, hashKey(r))
+	default:
+		return healthy[(lb.next.Add(1)-1)%uint64(len(healthy))]
+	}
+}
+
+// leastConnections picks the backend with the fewest requests in flight,
+// starting the scan at a rotating offset so ties are spread evenly.
+func (lb *balancer) leastConnections(backends []*backend) *backend {
+	start := int((lb.next.Add(1) - 1) % uint64(len(backends)))
+	var best *backend
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if best == nil || b.active.Load() < best.active.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// weighted implements smooth weighted round-robin: each backend receives a
+// share of requests proportional to its weight, interleaved rather than in
+// bursts.
+func (lb *balancer) weighted(backends []*backend) *backend {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	total := 0
+	var best *backend
+	for _, b := range backends {
+		lb.current[b] += b.weight
+		total += b.weight
+		if best == nil || lb.current[b] > lb.current[best] {
+			best = b
+		}
+	}
+	lb.current[best] -= total
+
+	// Forget backends that left the pool
+	if len(lb.current) > len(backends) {
+		keep := make(map[*backend]bool, len(backends))
+		for _, b := range backends {
+			keep[b] = true
+		}
+		for b := range lb.current {
+			if !keep[b] {
+				delete(lb.current, b)
+			}
+		}
+	}
+	return best
+}
+
+// consistentHash maps key onto a ring built from all backends, so a key keeps
+// its backend while the pool is unchanged and only moves when its backend
+// leaves or is ejected.
+func (lb *balancer) consistentHash(all, healthy []*backend, key string) *backend {
+	eligible := make(map[*backend]bool, len(healthy))
+	for _, b := range healthy {
+		eligible[b] = true
+	}
+
+	lb.mu.Lock()
+	ring := lb.ringFor(all)
+	lb.mu.Unlock()
+
+	h := hash32(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	for n := 0; n < len(ring); n++ {
+		p := ring[(i+n)%len(ring)]
+		if eligible[p.backend] {
+			return p.backend
+		}
+	}
+	return healthy[0]
+}
+
+// ringFor returns the hash ring for backends, reusing the cached one when the
+// set is unchanged. lb.mu must be held.
+func (lb *balancer) ringFor(backends []*backend) []ringPoint {
+	keys := make([]string, len(backends))
+	for i, b := range backends {
+		keys[i] = b.url.String() + "*" + strconv.Itoa(b.weight)
+	}
+	key := strings.Join(keys, ",")
+	if key == lb.ringKey {
+		return lb.ring
+	}
+
+	ring := make([]ringPoint, 0, len(backends)*virtualNodes)
+	for _, b := range backends {
+		for i := 0; i < virtualNodes*b.weight; i++ {
+			ring = append(ring, ringPoint{hash: hash32(b.url.String() + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	lb.ringKey, lb.ring = key, ring
+	return ring
+}
+
+// hashKey is the consistent-hash key of a request: the authenticated user,
+// or the client address for anonymous requests.
+func hashKey(r *http.Request) string {
+	if userID := r.Header.Get(headerUserID); userID != "" {
+		return "user:" + userID
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// hash32 is FNV-1a followed by the murmur3 finalizer; plain FNV clusters
+// short keys that differ only in their last characters, such as user IDs.
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// the reverse proxy uses to flush streamed responses.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
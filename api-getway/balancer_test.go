@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBackends(t *testing.T, weights ...int) []*backend {
+	t.Helper()
+	backends := make([]*backend, len(weights))
+	for i, w := range weights {
+		u, err := url.Parse(fmt.Sprintf("http://upstream-%c:8080", 'a'+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = newBackend(u, w)
+	}
+	return backends
+}
+
+// letter is the letter of a backend built by testBackends.
+func letter(b *backend) string {
+	return strings.TrimSuffix(strings.TrimPrefix(b.url.String(), "http://upstream-"), ":8080")
+}
+
+func testBalancer(t *testing.T, strategy string) *balancer {
+	t.Helper()
+	lb, err := newBalancer(strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+// picks returns the backends picked for n requests as a string of letters.
+func picks(lb *balancer, backends []*backend, n int) string {
+	var b strings.Builder
+	r := httptest.NewRequest(http.MethodGet, "/api/products", nil)
+	for i := 0; i < n; i++ {
+		b.WriteString(letter(lb.pick(backends, r)))
+	}
+	return b.String()
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+		wantErr  bool
+	}{
+		{strategy: "", want: strategyRoundRobin},
+		{strategy: strategyRoundRobin, want: strategyRoundRobin},
+		{strategy: strategyLeastConnections, want: strategyLeastConnections},
+		{strategy: strategyWeighted, want: strategyWeighted},
+		{strategy: strategyConsistentHash, want: strategyConsistentHash},
+		{strategy: "random", wantErr: true},
+	}
+	for _, tt := range tests {
+		lb, err := newBalancer(tt.strategy)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newBalancer(%q) succeeded, want error", tt.strategy)
+			}
+			continue
+		}
+		if err != nil || lb.strategy != tt.want {
+			t.Errorf("newBalancer(%q) = %v, %v, want %s", tt.strategy, lb, err, tt.want)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name      string
+		eject     []int
+		unhealthy []int
+		want      string
+	}{
+		{name: "all healthy", want: "abcabcabc"},
+		{name: "ejected skipped", eject: []int{1}, want: "acacac"},
+		{name: "unhealthy skipped", unhealthy: []int{0}, want: "bcbcbc"},
+		{name: "all ejected are used again", eject: []int{0, 1, 2}, want: "abcabc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := testBackends(t, 1, 1, 1)
+			for _, i := range tt.eject {
+				backends[i].ejectedUntil = time.Now().Add(time.Minute)
+			}
+			for _, i := range tt.unhealthy {
+				backends[i].health.status = healthUnhealthy
+			}
+			if got := picks(testBalancer(t, strategyRoundRobin), backends, len(tt.want)); got != tt.want {
+				t.Errorf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if b := testBalancer(t, strategyRoundRobin).pick(nil, httptest.NewRequest(http.MethodGet, "/", nil)); b != nil {
+		t.Errorf("pick without backends = %v, want nil", b.url)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		n       int
+		want    string
+	}{
+		// The sequence nginx documents for its smooth weighted round-robin
+		{name: "5-1-1 interleaved", weights: []int{5, 1, 1}, n: 7, want: "aabacaa"},
+		{name: "equal weights", weights: []int{1, 1, 1}, n: 6, want: "abcabc"},
+		{name: "2-1", weights: []int{2, 1}, n: 6, want: "abaaba"},
+		{name: "weights below one count as one", weights: []int{0, 1}, n: 4, want: "abab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := picks(testBalancer(t, strategyWeighted), testBackends(t, tt.weights...), tt.n)
+			if got != tt.want {
+				t.Errorf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedShares(t *testing.T) {
+	backends := testBackends(t, 3, 2, 1)
+	got := picks(testBalancer(t, strategyWeighted), backends, 600)
+	for i, want := range []int{300, 200, 100} {
+		if n := strings.Count(got, letter(backends[i])); n != want {
+			t.Errorf("backend %s picked %d times, want %d", letter(backends[i]), n, want)
+		}
+	}
+}
+
+func TestWeightedForgetsRemovedBackends(t *testing.T) {
+	backends := testBackends(t, 1, 1, 1)
+	lb := testBalancer(t, strategyWeighted)
+	picks(lb, backends, 5)
+	picks(lb, backends[:2], 1)
+	if len(lb.current) != 2 {
+		t.Errorf("balancer keeps state for %d backends, want 2", len(lb.current))
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	tests := []struct {
+		name   string
+		active []int64
+		n      int
+		want   string
+	}{
+		{name: "fewest in flight", active: []int64{3, 1, 2}, n: 3, want: "bbb"},
+		{name: "ties rotate", active: []int64{0, 0, 0}, n: 6, want: "abcabc"},
+		{name: "ties among the least busy", active: []int64{1, 4, 1}, n: 4, want: "acca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := testBackends(t, 1, 1, 1)
+			for i, n := range tt.active {
+				backends[i].active.Store(n)
+			}
+			if got := picks(testBalancer(t, strategyLeastConnections), backends, tt.n); got != tt.want {
+				t.Errorf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsAccounting(t *testing.T) {
+	backends := testBackends(t, 1, 1)
+	lb := testBalancer(t, strategyLeastConnections)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// Requests are counted in flight by the caller of pick until they finish
+	var inFlight []*backend
+	for i := 0; i < 4; i++ {
+		b := lb.pick(backends, r)
+		b.active.Add(1)
+		inFlight = append(inFlight, b)
+	}
+	if a, b := backends[0].active.Load(), backends[1].active.Load(); a != 2 || b != 2 {
+		t.Fatalf("in flight %d and %d, want 2 and 2", a, b)
+	}
+
+	// Finishing a request makes its backend the least busy
+	for _, b := range inFlight {
+		if b == backends[1] {
+			b.active.Add(-1)
+			break
+		}
+	}
+	if got := lb.pick(backends, r); got != backends[1] {
+		t.Errorf("picked %s, want b", letter(got))
+	}
+}
+
+// hashAssignments maps each of n users to the backend picked for them.
+func hashAssignments(lb *balancer, backends []*backend, n int) map[string]string {
+	assigned := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+		r.Header.Set(headerUserID, fmt.Sprint(i))
+		assigned[fmt.Sprint(i)] = letter(lb.pick(backends, r))
+	}
+	return assigned
+}
+
+func TestConsistentHash(t *testing.T) {
+	const users = 3000
+	backends := testBackends(t, 1, 1, 1, 1)
+	lb := testBalancer(t, strategyConsistentHash)
+	before := hashAssignments(lb, backends[:3], users)
+
+	// Stable while the pool is unchanged, and spread over all backends
+	counts := map[string]int{}
+	for user, b := range hashAssignments(lb, backends[:3], users) {
+		if before[user] != b {
+			t.Fatalf("user %s moved from %s to %s with the same pool", user, before[user], b)
+		}
+		counts[b]++
+	}
+	for _, b := range backends[:3] {
+		if n := counts[letter(b)]; n < users/5 || n > users/2 {
+			t.Errorf("backend %s got %d of %d users", letter(b), n, users)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		backends []*backend
+		eject    *backend
+		// moveTo is where moved users may go; users of removed backends must move
+		moveTo  string
+		removed string
+	}{
+		{name: "backend added", backends: backends, moveTo: "d"},
+		{name: "backend removed", backends: []*backend{backends[0], backends[2]}, removed: "b", moveTo: "ac"},
+		{name: "backend ejected", backends: backends[:3], eject: backends[2], removed: "c", moveTo: "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.eject != nil {
+				tt.eject.ejectedUntil = time.Now().Add(time.Minute)
+				defer func() { tt.eject.ejectedUntil = time.Time{} }()
+			}
+
+			moved := 0
+			for user, b := range hashAssignments(lb, tt.backends, users) {
+				if b == before[user] {
+					if strings.Contains(tt.removed, b) {
+						t.Fatalf("user %s stayed on removed backend %s", user, b)
+					}
+					continue
+				}
+				moved++
+				if !strings.Contains(tt.removed, before[user]) && !strings.Contains(tt.moveTo, b) {
+					t.Fatalf("user %s moved from %s to %s", user, before[user], b)
+				}
+			}
+			// Only the users of the changed backend move, a quarter or a third
+			if moved > users/2 {
+				t.Errorf("%d of %d users moved", moved, users)
+			}
+		})
+	}
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	if got := hashKey(r); got != "addr:203.0.113.7" {
+		t.Errorf("hashKey anonymous = %q", got)
+	}
+	r.Header.Set(headerUserID, "42")
+	if got := hashKey(r); got != "user:42" {
+		t.Errorf("hashKey authenticated = %q", got)
+	}
+}
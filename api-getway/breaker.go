@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const headerCircuitBreaker = "X-Circuit-Breaker"
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Circuit breaker settings, shared by all upstreams: a breaker opens after
+// breakerFailureThreshold consecutive failures, fails requests fast for
+// breakerOpenTimeout, then lets up to breakerHalfOpenRequests probes through
+// and closes once that many succeeded.
+var (
+	breakerFailureThreshold = 5
+	breakerOpenTimeout      = 30 * time.Second
+	breakerHalfOpenRequests = 1
+)
+
+// circuitBreaker guards one upstream instance.
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+// stateAt returns the state as seen at now: an open breaker whose timeout
+// has passed is reported half-open even before a probe moved it there.
+func (cb *circuitBreaker) stateAt(now time.Time) breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerOpen && now.Sub(cb.openedAt) >= breakerOpenTimeout {
+		return breakerHalfOpen
+	}
+	return cb.state
+}
+
+// ready reports whether allow would currently let a request through.
+func (cb *circuitBreaker) ready(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		return now.Sub(cb.openedAt) >= breakerOpenTimeout
+	case breakerHalfOpen:
+		return cb.probes < breakerHalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// allow admits a request. probe reports whether it was admitted as a
+// half-open probe; it must be passed back to done.
+func (cb *circuitBreaker) allow(now time.Time) (ok, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerOpen && now.Sub(cb.openedAt) >= breakerOpenTimeout {
+		cb.state = breakerHalfOpen
+		cb.probes, cb.successes = 0, 0
+	}
+	switch cb.state {
+	case breakerOpen:
+		return false, false
+	case breakerHalfOpen:
+		if cb.probes >= breakerHalfOpenRequests {
+			return false, false
+		}
+		cb.probes++
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// done records the outcome of an admitted request.
+func (cb *circuitBreaker) done(probe, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe {
+		if cb.state != breakerHalfOpen {
+			return
+		}
+		cb.probes--
+		if failed {
+			cb.trip()
+			return
+		}
+		if cb.successes++; cb.successes >= breakerHalfOpenRequests {
+			cb.state = breakerClosed
+			cb.failures = 0
+			slog.Info("Circuit breaker closed", "upstream", cb.name)
+		}
+		return
+	}
+
+	if cb.state != breakerClosed {
+		return
+	}
+	if !failed {
+		cb.failures = 0
+		return
+	}
+	if cb.failures++; cb.failures >= breakerFailureThreshold {
+		cb.trip()
+	}
+}
+
+// cancel releases an admitted request whose outcome says nothing about the
+// upstream, e.g. because the client went away.
+func (cb *circuitBreaker) cancel(probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe && cb.state == breakerHalfOpen {
+		cb.probes--
+	}
+}
+
+// trip opens the breaker. cb.mu must be held.
+func (cb *circuitBreaker) trip() {
+	cb.state = breakerOpen
+	cb.openedAt = time.Now()
+	cb.failures = 0
+	slog.Warn("Circuit breaker opened", "upstream", cb.name, "open_for", breakerOpenTimeout.String())
+}
+
+// retryAfter is how long until an open breaker admits a probe.
+func (cb *circuitBreaker) retryAfter(now time.Time) time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != breakerOpen {
+		return 0
+	}
+	return max(breakerOpenTimeout-now.Sub(cb.openedAt), 0)
+}
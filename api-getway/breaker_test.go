@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useBreakerSettings sets the breaker settings for one test.
+func useBreakerSettings(t *testing.T, threshold int, openTimeout time.Duration, halfOpenRequests int) {
+	savedThreshold, savedTimeout, savedProbes := breakerFailureThreshold, breakerOpenTimeout, breakerHalfOpenRequests
+	breakerFailureThreshold, breakerOpenTimeout, breakerHalfOpenRequests = threshold, openTimeout, halfOpenRequests
+	t.Cleanup(func() {
+		breakerFailureThreshold, breakerOpenTimeout, breakerHalfOpenRequests = savedThreshold, savedTimeout, savedProbes
+	})
+}
+
+// breakerStep is one call on a breaker. allow admits a request at an offset
+// from the current time; ok, fail and cancel finish the oldest admitted one.
+type breakerStep struct {
+	op        string
+	at        time.Duration
+	wantOK    bool
+	wantState breakerState
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	useBreakerSettings(t, 3, time.Minute, 2)
+	const timeout = time.Minute + time.Second
+
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "success resets the failure count",
+			steps: []breakerStep{
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "ok", wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+			},
+		},
+		{
+			name: "opens after consecutive failures",
+			steps: []breakerStep{
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed}, {op: "fail", wantState: breakerOpen},
+				{op: "allow", wantOK: false, wantState: breakerOpen},
+				{op: "allow", at: 30 * time.Second, wantOK: false, wantState: breakerOpen},
+			},
+		},
+		{
+			name: "requests admitted before opening do not count",
+			steps: []breakerStep{
+				{op: "allow", wantOK: true, wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed},
+				{op: "allow", wantOK: true, wantState: breakerClosed},
+				{op: "fail", wantState: breakerClosed}, {op: "fail", wantState: breakerClosed},
+				{op: "fail", wantState: breakerOpen},
+				{op: "ok", wantState: breakerOpen},
+			},
+		},
+		{
+			name: "half-open limits probes and closes after enough successes",
+			steps: []breakerStep{
+				{op: "allow", wantOK: true}, {op: "fail"},
+				{op: "allow", wantOK: true}, {op: "fail"},
+				{op: "allow", wantOK: true}, {op: "fail", wantState: breakerOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+				{op: "allow", at: timeout, wantOK: false, wantState: breakerHalfOpen},
+				{op: "ok", wantState: breakerHalfOpen},
+				{op: "ok", wantState: breakerClosed},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerClosed},
+			},
+		},
+		{
+			name: "failed probe reopens",
+			steps: []breakerStep{
+				{op: "allow", wantOK: true}, {op: "fail"},
+				{op: "allow", wantOK: true}, {op: "fail"},
+				{op: "allow", wantOK: true}, {op: "fail", wantState: breakerOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+				{op: "fail", wantState: breakerOpen},
+				{op: "allow", wantOK: false, wantState: breakerOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+			},
+		},
+		{
+			name: "cancelled probe frees its slot",
+			steps: []breakerStep{
+				{op: "allow", wantOK: true}, {op: "fail"},
+				{op: "allow", wantOK: true}, {op: "fail"},
+				{op: "allow", wantOK: true}, {op: "fail", wantState: breakerOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+				{op: "cancel", wantState: breakerHalfOpen},
+				{op: "allow", at: timeout, wantOK: true, wantState: breakerHalfOpen},
+				{op: "allow", at: timeout, wantOK: false, wantState: breakerHalfOpen},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := &circuitBreaker{name: "test"}
+			var admitted []bool // probe flags of admitted requests, oldest first
+			for i, step := range tt.steps {
+				switch step.op {
+				case "allow":
+					ok, probe := cb.allow(time.Now().Add(step.at))
+					if ok != step.wantOK {
+						t.Fatalf("step %d: allow = %v, want %v", i, ok, step.wantOK)
+					}
+					if ok {
+						admitted = append(admitted, probe)
+					}
+				case "ok", "fail", "cancel":
+					probe := admitted[0]
+					admitted = admitted[1:]
+					if step.op == "cancel" {
+						cb.cancel(probe)
+					} else {
+						cb.done(probe, step.op == "fail")
+					}
+				}
+				if cb.state != step.wantState {
+					t.Fatalf("step %d (%s): state %s, want %s", i, step.op, cb.state, step.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerOpenView(t *testing.T) {
+	useBreakerSettings(t, 1, time.Minute, 1)
+
+	cb := &circuitBreaker{name: "test"}
+	now := time.Now()
+	if !cb.ready(now) || cb.stateAt(now) != breakerClosed || cb.retryAfter(now) != 0 {
+		t.Fatal("new breaker is not closed")
+	}
+
+	cb.allow(now)
+	cb.done(false, true)
+	openedAt := cb.openedAt
+
+	tests := []struct {
+		at             time.Duration
+		wantState      breakerState
+		wantReady      bool
+		wantRetryAfter time.Duration
+	}{
+		{at: 0, wantState: breakerOpen, wantRetryAfter: time.Minute},
+		{at: 45 * time.Second, wantState: breakerOpen, wantRetryAfter: 15 * time.Second},
+		{at: time.Minute, wantState: breakerHalfOpen, wantReady: true},
+		{at: 2 * time.Minute, wantState: breakerHalfOpen, wantReady: true},
+	}
+	for _, tt := range tests {
+		at := openedAt.Add(tt.at)
+		if got := cb.stateAt(at); got != tt.wantState {
+			t.Errorf("stateAt(+%v) = %s, want %s", tt.at, got, tt.wantState)
+		}
+		if got := cb.ready(at); got != tt.wantReady {
+			t.Errorf("ready(+%v) = %v, want %v", tt.at, got, tt.wantReady)
+		}
+		if got := cb.retryAfter(at); got != tt.wantRetryAfter {
+			t.Errorf("retryAfter(+%v) = %v, want %v", tt.at, got, tt.wantRetryAfter)
+		}
+	}
+
+	// Viewing the state does not start the half-open period
+	if cb.state != breakerOpen {
+		t.Errorf("state %s after viewing, want open", cb.state)
+	}
+	if ok, probe := cb.allow(openedAt.Add(time.Minute)); !ok || !probe {
+		t.Fatalf("allow after the timeout = %v, %v, want a probe", ok, probe)
+	}
+	if cb.ready(openedAt.Add(time.Minute)) {
+		t.Error("ready with the only probe in flight")
+	}
+}
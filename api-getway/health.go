@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health check statuses of a backend. Backends start out unknown and are
+// routable until a check marks them unhealthy.
+const (
+	healthUnknown   = "unknown"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+	healthDegraded  = "degraded"
+)
+
+// Active health checking: every backend is probed at healthCheckPath every
+// healthCheckInterval, each probe limited to healthCheckTimeout. A backend
+// turns unhealthy after healthCheckUnhealthyThreshold failed probes in a row
+// and healthy again after healthCheckHealthyThreshold successful ones.
+var (
+	healthCheckInterval           = 10 * time.Second
+	healthCheckTimeout            = 2 * time.Second
+	healthCheckPath               = "/health"
+	healthCheckUnhealthyThreshold = 2
+	healthCheckHealthyThreshold   = 1
+)
+
+// backendHealth is the cached result of the active checks of one backend.
+type backendHealth struct {
+	mu          sync.Mutex
+	status      string
+	latency     time.Duration
+	lastChecked time.Time
+	reason      string
+	successes   int
+	failures    int
+}
+
+// HealthStats is the reported view of a backend's health.
+type HealthStats struct {
+	URL         string     `json:"url"`
+	Status      string     `json:"status"`
+	LatencyMs   float64    `json:"latency_ms"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// routable reports whether the last checks allow sending traffic.
+func (h *backendHealth) routable() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status != healthUnhealthy
+}
+
+func (h *backendHealth) stats(url string) HealthStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HealthStats{
+		URL:       url,
+		Status:    h.status,
+		LatencyMs: float64(h.latency.Microseconds()) / 1000,
+		Error:     h.reason,
+	}
+	if s.Status == "" {
+		s.Status = healthUnknown
+	}
+	if !h.lastChecked.IsZero() {
+		checked := h.lastChecked
+		s.LastChecked = &checked
+	}
+	return s
+}
+
+// record stores the outcome of one probe and returns the status it moved
+// to, or "" if the status did not change.
+func (h *backendHealth) record(latency time.Duration, err error) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latency = latency
+	h.lastChecked = time.Now()
+
+	prev := h.status
+	if err != nil {
+		h.reason = err.Error()
+		h.successes = 0
+		if h.failures++; h.failures >= healthCheckUnhealthyThreshold {
+			h.status = healthUnhealthy
+		}
+	} else {
+		h.reason = ""
+		h.failures = 0
+		if h.successes++; h.successes >= healthCheckHealthyThreshold {
+			h.status = healthHealthy
+		}
+	}
+	if h.status == prev {
+		return ""
+	}
+	return h.status
+}
+
+// checkHealth probes the backend once.
+func (b *backend) checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := probe(ctx, b.url.JoinPath(healthCheckPath).String())
+	if status := b.health.record(time.Since(start), err); status != "" {
+		if err != nil {
+			slog.Warn("Health check status changed", "upstream", b.url.String(), "status", status, "error", err)
+		} else {
+			slog.Info("Health check status changed", "upstream", b.url.String(), "status", status)
+		}
+	}
+}
+
+func probe(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := upstreamTransport.RoundTrip(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("no response within %v", healthCheckTimeout)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkedBackends returns every backend that may receive traffic: the static
+// targets of all routes and all registered instances.
+func checkedBackends() []*backend {
+	seen := make(map[*backend]bool)
+	var backends []*backend
+	add := func(b *backend) {
+		if !seen[b] {
+			seen[b] = true
+			backends = append(backends, b)
+		}
+	}
+	for _, rt := range routeTable.Load().routes {
+		for _, b := range rt.backends {
+			add(b)
+		}
+	}
+	for _, instances := range registry.Snapshot() {
+		for _, inst := range instances {
+			add(inst.backend)
+		}
+	}
+	return backends
+}
+
+// checkAll probes every backend concurrently and waits for the results.
+func checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range checkedBackends() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.checkHealth(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// runHealthChecks checks all backends right away and then on every interval.
+func runHealthChecks() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkAll(context.Background())
+		<-ticker.C
+	}
+}
+
+// ServiceHealth is the aggregated health of the instances serving a route.
+type ServiceHealth struct {
+	Status    string        `json:"status"`
+	Source    string        `json:"source"`
+	Instances []HealthStats `json:"instances"`
+}
+
+// Health check aggregator. It reports the cached results of the background
+// checks and never probes the backends itself.
+func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	services := make(map[string]ServiceHealth)
+	allHealthy := true
+
+	for _, rt := range routeTable.Load().routes {
+		pool, fromRegistry := rt.pool()
+		sh := ServiceHealth{Source: "static", Instances: []HealthStats{}}
+		if fromRegistry {
+			sh.Source = "registry"
+		}
+		healthy := 0
+		for _, b := range pool {
+			stats := b.health.stats(b.url.String())
+			if stats.Status != healthUnhealthy {
+				healthy++
+			}
+			sh.Instances = append(sh.Instances, stats)
+		}
+		switch {
+		case healthy == len(pool) && healthy > 0:
+			sh.Status = healthHealthy
+		case healthy > 0:
+			sh.Status = healthDegraded
+		default:
+			sh.Status = healthUnhealthy
+			allHealthy = false
+		}
+		services[rt.Name] = sh
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !allHealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"gateway":  healthHealthy,
+		"services": services,
+	})
+}
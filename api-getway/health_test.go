@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useHealthThresholds sets the probe thresholds for the test.
+func useHealthThresholds(t *testing.T, unhealthy, healthy int) {
+	savedUnhealthy, savedHealthy := healthCheckUnhealthyThreshold, healthCheckHealthyThreshold
+	healthCheckUnhealthyThreshold, healthCheckHealthyThreshold = unhealthy, healthy
+	t.Cleanup(func() {
+		healthCheckUnhealthyThreshold, healthCheckHealthyThreshold = savedUnhealthy, savedHealthy
+	})
+}
+
+func TestBackendHealthThresholds(t *testing.T) {
+	errDown := errors.New("status 503")
+
+	tests := []struct {
+		name      string
+		unhealthy int
+		healthy   int
+		probes    []error
+		want      []string // status after each probe
+	}{
+		{
+			name:      "one failure is tolerated",
+			unhealthy: 2, healthy: 1,
+			probes: []error{errDown, nil, errDown},
+			want:   []string{healthUnknown, healthHealthy, healthHealthy},
+		},
+		{
+			name:      "failures in a row",
+			unhealthy: 2, healthy: 1,
+			probes: []error{nil, errDown, errDown, errDown},
+			want:   []string{healthHealthy, healthHealthy, healthUnhealthy, healthUnhealthy},
+		},
+		{
+			name:      "recovers after one success",
+			unhealthy: 1, healthy: 1,
+			probes: []error{errDown, nil},
+			want:   []string{healthUnhealthy, healthHealthy},
+		},
+		{
+			name:      "recovers after successes in a row",
+			unhealthy: 1, healthy: 3,
+			probes: []error{errDown, nil, nil, errDown, nil, nil, nil},
+			want:   []string{healthUnhealthy, healthUnhealthy, healthUnhealthy, healthUnhealthy, healthUnhealthy, healthUnhealthy, healthHealthy},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useHealthThresholds(t, tt.unhealthy, tt.healthy)
+			var h backendHealth
+			for i, err := range tt.probes {
+				h.record(time.Millisecond, err)
+				stats := h.stats("http://products-a:8002")
+				if stats.Status != tt.want[i] {
+					t.Fatalf("status after probe %d: %s, want %s", i+1, stats.Status, tt.want[i])
+				}
+				if h.routable() != (stats.Status != healthUnhealthy) {
+					t.Errorf("routable %v with status %s", h.routable(), stats.Status)
+				}
+				if (err != nil) != (stats.Error != "") {
+					t.Errorf("error %q after probe %d returned %v", stats.Error, i+1, err)
+				}
+			}
+		})
+	}
+}
+
+// flakyBackend answers health checks with 503 while failing is set.
+type flakyBackend struct {
+	*httptest.Server
+	failing atomic.Bool
+	probes  atomic.Int32
+}
+
+func newFlakyBackend(t *testing.T) *flakyBackend {
+	t.Helper()
+	f := &flakyBackend{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthCheckPath {
+			http.NotFound(w, r)
+			return
+		}
+		f.probes.Add(1)
+		if f.failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": "healthy"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// healthReport serves the health endpoint from the cached results.
+func healthReport(t *testing.T) (int, map[string]ServiceHealth) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	healthCheckHandler(w, httptest.NewRequest("GET", "/health", nil))
+	var report struct {
+		Gateway  string                   `json:"gateway"`
+		Services map[string]ServiceHealth `json:"services"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report.Services
+}
+
+func TestHealthChecksFailAndRecover(t *testing.T) {
+	useHealthThresholds(t, 2, 1)
+	saved := routeTable.Load()
+	t.Cleanup(func() { routeTable.Store(saved) })
+
+	flaky, steady := newFlakyBackend(t), newFlakyBackend(t)
+	products := testRoute(t, nil, flaky.URL, steady.URL)
+	products.Name = "products"
+	orders := testRoute(t, nil, flaky.URL)
+	orders.Name = "orders"
+	routeTable.Store(&RouteTable{routes: []*route{products, orders}})
+
+	// Nothing probed yet: the backends are unknown but routable
+	code, services := healthReport(t)
+	if code != http.StatusOK || services["orders"].Instances[0].Status != healthUnknown {
+		t.Fatalf("before the first check: %d %+v", code, services)
+	}
+
+	statuses := func(sh ServiceHealth) []string {
+		var s []string
+		for _, inst := range sh.Instances {
+			s = append(s, inst.Status)
+		}
+		return s
+	}
+
+	flaky.failing.Store(true)
+	checkAll(context.Background())
+	if code, services := healthReport(t); code != http.StatusOK || services["orders"].Status != healthHealthy {
+		t.Errorf("after one failed probe: %d %+v, want the backend still routable", code, services["orders"])
+	}
+
+	checkAll(context.Background())
+	code, services = healthReport(t)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with an unhealthy service, want 503", code)
+	}
+	if sh := services["products"]; sh.Status != healthDegraded || strings.Join(statuses(sh), ",") != "unhealthy,healthy" {
+		t.Errorf("products %+v, want degraded", sh)
+	}
+	if sh := services["orders"]; sh.Status != healthUnhealthy || sh.Instances[0].Error != "status 503" || sh.Instances[0].LastChecked == nil {
+		t.Errorf("orders %+v, want unhealthy with the probe error", sh)
+	}
+	if products.backends[0].health.routable() {
+		t.Error("unhealthy backend still routable")
+	}
+
+	// The report is served from the cache without probing
+	probes := flaky.probes.Load()
+	healthReport(t)
+	if flaky.probes.Load() != probes {
+		t.Error("health endpoint probed the backends")
+	}
+
+	flaky.failing.Store(false)
+	checkAll(context.Background())
+	code, services = healthReport(t)
+	if code != http.StatusOK || services["products"].Status != healthHealthy || services["orders"].Status != healthHealthy {
+		t.Errorf("after recovery: %d %+v", code, services)
+	}
+	if !products.backends[0].health.routable() || services["orders"].Instances[0].Error != "" {
+		t.Error("recovered backend not routable or still reporting an error")
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	useHealthThresholds(t, 1, 1)
+	savedTimeout := healthCheckTimeout
+	healthCheckTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { healthCheckTimeout = savedTimeout })
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	rt := testRoute(t, nil, slow.URL)
+	b := rt.backends[0]
+	b.checkHealth(context.Background())
+
+	stats := b.health.stats(slow.URL)
+	if stats.Status != healthUnhealthy || !strings.Contains(stats.Error, "no response within") {
+		t.Errorf("slow backend %+v, want unhealthy after the timeout", stats)
+	}
+}
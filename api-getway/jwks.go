@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"shared/jwks"
+	"shared/tracing"
+)
+
+// Where the token verification keys are fetched from and how often. A
+// token signed with a key not seen yet triggers an early fetch, at most once
+// per jwksMinRefreshInterval.
+var (
+	jwksURL             = "http://user-service:8001/.well-known/jwks.json"
+	jwksRefreshInterval = 5 * time.Minute
+)
+
+const jwksMinRefreshInterval = 10 * time.Second
+
+var jwksClient = &http.Client{Timeout: 5 * time.Second, Transport: tracing.Transport(nil)}
+
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// jwksCache holds the last key set fetched from user-service.
+type jwksCache struct {
+	keys atomic.Pointer[map[string]verificationKey]
+	set  atomic.Pointer[jwks.Set]
+
+	// fetches runs one fetch at a time; callers arriving while one is in
+	// flight wait for it and share its result. lastFetch is only used from
+	// within it.
+	fetches   singleflight.Group
+	lastFetch time.Time
+}
+
+var verificationKeys jwksCache
+
+// fetch replaces the cached keys with the current key set.
+func (c *jwksCache) fetch(ctx context.Context) error {
+	return c.fetchOlderThan(ctx, 0)
+}
+
+// fetchOlderThan fetches the key set unless the last attempt, successful or
+// not, was less than age ago.
+func (c *jwksCache) fetchOlderThan(ctx context.Context, age time.Duration) error {
+	_, err, _ := c.fetches.Do("jwks", func() (any, error) {
+		if time.Since(c.lastFetch) < age {
+			return nil, nil
+		}
+		// The fetch is shared, so it must outlive the caller that started it.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksClient.Timeout)
+		defer cancel()
+		err := c.load(ctx)
+		c.lastFetch = time.Now()
+		return nil, err
+	})
+	return err
+}
+
+// load fetches the key set and stores it. Keys that cannot be used are
+// skipped.
+func (c *jwksCache) load(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS returned %d", resp.StatusCode)
+	}
+
+	var set jwks.Set
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]verificationKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := k.PublicKey()
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping unusable JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = verificationKey{alg: k.Algorithm(), key: pub}
+	}
+	c.keys.Store(&keys)
+	c.set.Store(&set)
+	return nil
+}
+
+// lookup returns the key kid. Unknown keys may have just been published, so
+// the set is fetched again unless that was done very recently; tokens with
+// made-up kids cannot make the gateway flood user-service.
+func (c *jwksCache) lookup(ctx context.Context, kid string) (verificationKey, bool) {
+	if keys := c.keys.Load(); keys != nil {
+		if k, ok := (*keys)[kid]; ok {
+			return k, true
+		}
+	}
+
+	if err := c.fetchOlderThan(ctx, jwksMinRefreshInterval); err != nil {
+		slog.WarnContext(ctx, "JWKS fetch failed", "url", jwksURL, "error", err)
+		return verificationKey{}, false
+	}
+	if keys := c.keys.Load(); keys != nil {
+		k, ok := (*keys)[kid]
+		return k, ok
+	}
+	return verificationKey{}, false
+}
+
+// runJWKSRefresh fetches the key set right away and then on every interval.
+// While user-service cannot be reached the cached keys stay in use.
+func runJWKSRefresh() {
+	ticker := time.NewTicker(jwksRefreshInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), jwksClient.Timeout)
+		if err := verificationKeys.fetch(ctx); err != nil {
+			slog.Warn("JWKS fetch failed, using the cached keys", "url", jwksURL, "error", err)
+		}
+		cancel()
+		<-ticker.C
+	}
+}
+
+// jwksHandler republishes the cached key set, so that clients outside the
+// internal network can verify tokens too.
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	set := verificationKeys.set.Load()
+	if set == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Signing keys not loaded")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"shared/jwks"
+)
+
+// jwksServer serves a key set with the given kids and counts the fetches.
+// Fetches wait for release to be closed, when it is set.
+type jwksServer struct {
+	fetches atomic.Int32
+	release chan struct{}
+	set     jwks.Set
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	s := &jwksServer{}
+	for _, kid := range kids {
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := jwks.New(kid, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.set.Keys = append(s.set.Keys, k)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		if s.release != nil {
+			<-s.release
+		}
+		json.NewEncoder(w).Encode(s.set)
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := jwksURL
+	jwksURL = srv.URL
+	t.Cleanup(func() { jwksURL = saved })
+	return s
+}
+
+func TestJWKSLookupSharesFetch(t *testing.T) {
+	srv := newJWKSServer(t, "k1")
+	srv.release = make(chan struct{})
+	var c jwksCache
+
+	const lookups = 20
+	var wg sync.WaitGroup
+	var found atomic.Int32
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := c.lookup(context.Background(), "k1"); ok {
+				found.Add(1)
+			}
+		}()
+	}
+
+	// A lookup of a cached key is not held up by the fetch in flight
+	for srv.fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	keys := map[string]verificationKey{"cached": {}}
+	c.keys.Store(&keys)
+	done := make(chan bool)
+	go func() {
+		_, ok := c.lookup(context.Background(), "cached")
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("cached key not found")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup of a cached key waited for the fetch")
+	}
+
+	close(srv.release)
+	wg.Wait()
+	if n := srv.fetches.Load(); n != 1 {
+		t.Errorf("%d concurrent lookups made %d fetches, want 1", lookups, n)
+	}
+	if n := found.Load(); n != lookups {
+		t.Errorf("%d of %d lookups found the new key", n, lookups)
+	}
+}
+
+func TestJWKSLookupRateLimitsUnknownKids(t *testing.T) {
+	srv := newJWKSServer(t, "k1")
+	var c jwksCache
+	ctx := context.Background()
+
+	if _, ok := c.lookup(ctx, "k1"); !ok {
+		t.Fatal("k1 not found")
+	}
+	for _, kid := range []string{"made-up-1", "made-up-2", "made-up-3"} {
+		if _, ok := c.lookup(ctx, kid); ok {
+			t.Errorf("unknown kid %s found", kid)
+		}
+	}
+	if _, ok := c.lookup(ctx, "k1"); !ok {
+		t.Error("k1 no longer found")
+	}
+	if n := srv.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches within the refresh interval, want 1", n)
+	}
+
+	// Once the interval has passed an unknown kid fetches again
+	c.lastFetch = time.Now().Add(-jwksMinRefreshInterval)
+	c.lookup(ctx, "made-up-4")
+	if n := srv.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches after the refresh interval, want 2", n)
+	}
+
+	// The periodic refresh is not limited
+	if err := c.fetch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.fetches.Load(); n != 3 {
+		t.Errorf("%d fetches after a forced fetch, want 3", n)
+	}
+}
+
+func TestJWKSLookupRateLimitsFailedFetches(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	saved := jwksURL
+	jwksURL = srv.URL
+	t.Cleanup(func() { jwksURL = saved })
+
+	var c jwksCache
+	for i := 0; i < 5; i++ {
+		if _, ok := c.lookup(context.Background(), "k1"); ok {
+			t.Fatal("key found without a key set")
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d fetches while user-service fails, want 1", n)
+	}
+}
+
+func TestJWKSFetchOutlivesCanceledCaller(t *testing.T) {
+	srv := newJWKSServer(t, "k1")
+	srv.release = make(chan struct{})
+	var c jwksCache
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan bool)
+	go func() {
+		_, ok := c.lookup(ctx, "k1")
+		first <- ok
+	}()
+	for srv.fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan bool)
+	go func() {
+		_, ok := c.lookup(context.Background(), "k1")
+		second <- ok
+	}()
+
+	// The caller that started the fetch giving up must not fail it for the
+	// callers sharing it
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(srv.release)
+	if !<-first || !<-second {
+		t.Error("shared fetch failed after its first caller was canceled")
+	}
+}
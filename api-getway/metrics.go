@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"shared/logging"
+	"shared/metrics"
+	"shared/tracing"
+)
+
+// Gateway metrics, next to the request metrics of shared/metrics.
+var (
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_errors_total",
+		Help: "Requests that could not be proxied, by route and reason (timeout, connection, circuit_open, no_instances).",
+	}, []string{"service", "reason"})
+
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_rate_limit_rejections_total",
+		Help: "Requests rejected with 429, by rate limit scope.",
+	}, []string{"scope"})
+)
+
+// recordUpstreamError counts a failed proxy attempt. Retryable statuses the
+// upstream did answer with and clients going away are not upstream errors.
+func recordUpstreamError(r *http.Request, err error) {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) || errors.Is(err, context.Canceled) {
+		return
+	}
+	service := "unknown"
+	if a, ok := r.Context().Value(attemptKey{}).(*attempt); ok {
+		service = a.route
+	}
+	reason := "connection"
+	if errors.Is(err, context.DeadlineExceeded) {
+		reason = "timeout"
+	}
+	upstreamErrors.WithLabelValues(service, reason).Inc()
+}
+
+// nameRoute sets the route a request is traced, counted and logged under.
+func nameRoute(r *http.Request, route string) {
+	tracing.SetSpanName(r.Context(), r.Method+" "+route)
+	metrics.SetRoute(r.Context(), route)
+	logging.SetRoute(r.Context(), route)
+}
+
+// routeNameMiddleware names a request after the gateway route template it
+// matched. Proxied requests are renamed after their route table entry once
+// it is known.
+func routeNameMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				nameRoute(r, tpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shared/config"
+)
+
+const (
+	headerAPIKey = "X-API-Key"
+
+	rateLimitStoreMemory = "memory"
+	rateLimitStoreRedis  = "redis"
+)
+
+// RateLimit is a token bucket quota: Requests per Window on average, with
+// bursts of up to Burst requests (default Requests).
+type RateLimit struct {
+	Requests int           `yaml:"requests" json:"requests"`
+	Window   time.Duration `yaml:"window" json:"window"`
+	Burst    int           `yaml:"burst" json:"burst,omitempty"`
+}
+
+// PathRateLimit overrides the route quota for a path (and optionally only
+// some methods) of the route.
+type PathRateLimit struct {
+	Path      string   `yaml:"path" json:"path"`
+	Methods   []string `yaml:"methods" json:"methods"`
+	RateLimit `yaml:",inline"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Requests <= 0 {
+		return errors.New("rate limit requests must be positive")
+	}
+	if l.Window <= 0 {
+		return errors.New("rate limit window must be positive")
+	}
+	if l.Burst < 0 {
+		return errors.New("rate limit burst must not be negative")
+	}
+	return nil
+}
+
+func (l RateLimit) capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// perSecond is the rate at which the bucket refills.
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+// policy renders the quota for the RateLimit-Policy header.
+func (l RateLimit) policy() string {
+	p := fmt.Sprintf("%d;w=%d", l.Requests, int(math.Ceil(l.Window.Seconds())))
+	if l.Burst > 0 {
+		p += fmt.Sprintf(";burst=%d", l.Burst)
+	}
+	return p
+}
+
+// rateLimitDecision is the outcome of taking a token from a bucket.
+type rateLimitDecision struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next token, for rejected requests.
+	RetryAfter time.Duration
+}
+
+// rateLimitStore keeps the token buckets. The memory store is local to one
+// gateway; the Redis store shares quotas between gateway instances.
+type rateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (rateLimitDecision, error)
+}
+
+// decide derives a decision from the tokens left after the request.
+func decide(limit RateLimit, tokens float64, allowed bool) rateLimitDecision {
+	rate := limit.perSecond()
+	d := rateLimitDecision{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit.capacity()) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		d.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return d
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryStore keeps buckets in process memory.
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: make(map[string]*tokenBucket)}
+}
+
+func (s *memoryStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (rateLimitDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	capacity := float64(limit.capacity())
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed.Seconds()*limit.perSecond())
+		b.last = now
+	}
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return decide(limit, b.tokens, allowed), nil
+}
+
+// sweep drops buckets idle for longer than maxIdle; they would be full again.
+func (s *memoryStore) sweep(maxIdle time.Duration) {
+	cutoff := time.Now().Add(-maxIdle)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		if b.last.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func (s *memoryStore) runSweeper(maxIdle time.Duration) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sweep(maxIdle)
+	}
+}
+
+// Rate limiting settings: ipRateLimit applies per client address to every
+// request before it is routed or authenticated, defaultRateLimit per caller
+// to routes without their own rate_limit. X-Forwarded-For is only honored on
+// requests arriving from trustedProxies.
+var (
+	ipRateLimit      = RateLimit{Requests: 300, Window: time.Minute}
+	defaultRateLimit = RateLimit{Requests: 100, Window: time.Minute}
+	trustedProxies   []*net.IPNet
+)
+
+var rateLimiter rateLimitStore = newMemoryStore()
+
+// initRateLimits reads the RATE_LIMIT_* settings and TRUSTED_PROXIES.
+func initRateLimits(conf *config.Loader) {
+	defaultRateLimit.Requests = conf.Int("RATE_LIMIT_REQUESTS", defaultRateLimit.Requests)
+	defaultRateLimit.Window = conf.Duration("RATE_LIMIT_WINDOW", defaultRateLimit.Window)
+	defaultRateLimit.Burst = conf.Int("RATE_LIMIT_BURST", defaultRateLimit.Burst)
+	if err := defaultRateLimit.validate(); err != nil {
+		conf.Invalid("RATE_LIMIT_REQUESTS", "%v", err)
+	}
+	ipRateLimit.Requests = conf.Int("RATE_LIMIT_IP_REQUESTS", ipRateLimit.Requests)
+	ipRateLimit.Window = conf.Duration("RATE_LIMIT_IP_WINDOW", ipRateLimit.Window)
+	ipRateLimit.Burst = conf.Int("RATE_LIMIT_IP_BURST", ipRateLimit.Burst)
+	if err := ipRateLimit.validate(); err != nil {
+		conf.Invalid("RATE_LIMIT_IP_REQUESTS", "%v", err)
+	}
+
+	for _, cidr := range strings.Split(conf.String("TRUSTED_PROXIES", ""), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			conf.Invalid("TRUSTED_PROXIES", "%q is not an IP address or CIDR", cidr)
+			continue
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	switch conf.OneOf("RATE_LIMIT_STORE", rateLimitStoreMemory, rateLimitStoreMemory, rateLimitStoreRedis) {
+	case rateLimitStoreRedis:
+		store, err := newRedisStore(conf.String("RATE_LIMIT_REDIS_URL", "redis://localhost:6379/0"))
+		if err != nil {
+			conf.Invalid("RATE_LIMIT_REDIS_URL", "%v", err)
+			return
+		}
+		rateLimiter = store
+	default:
+		store := newMemoryStore()
+		go store.runSweeper(10 * time.Minute)
+		rateLimiter = store
+	}
+}
+
+// trustedProxy reports whether ip may set X-Forwarded-For. Without
+// TRUSTED_PROXIES, loopback and private addresses (nginx and other
+// containers on the compose network) are trusted.
+func trustedProxy(ip net.IP) bool {
+	if len(trustedProxies) == 0 {
+		return ip.IsLoopback() || ip.IsPrivate()
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client, without the port. When the request
+// came through trusted proxies, it is the last X-Forwarded-For entry not
+// added by one of them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// rateLimitKey identifies the caller of an authorized request: the verified
+// user, else the API key, else the client address. API keys are hashed so
+// they never reach the store.
+func rateLimitKey(r *http.Request) string {
+	if userID := r.Header.Get(headerUserID); userID != "" {
+		return "user:" + userID
+	}
+	if apiKey := r.Header.Get(headerAPIKey); apiKey != "" {
+		sum := sha256.Sum256([]byte(apiKey))
+		return "key:" + hex.EncodeToString(sum[:12])
+	}
+	return "ip:" + clientIP(r)
+}
+
+// allowRequest takes a token for the caller key from the bucket of scope and
+// sets the RateLimit-* headers. When the quota is used up it writes a 429
+// with Retry-After and returns false. Store failures let the request through.
+func allowRequest(w http.ResponseWriter, r *http.Request, scope, key string, limit RateLimit) bool {
+	d, err := rateLimiter.Take(r.Context(), "ratelimit:"+scope+":"+key, limit, time.Now())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Rate limiter unavailable, allowing request", "error", err)
+		return true
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Policy", limit.policy())
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.capacity()))
+	h.Set("RateLimit-Remaining", strconv.Itoa(max(d.Remaining, 0)))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(d.Reset.Seconds()))))
+	if d.Allowed {
+		return true
+	}
+
+	rateLimitRejections.WithLabelValues(scope).Inc()
+	h.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(d.RetryAfter.Seconds())))))
+	writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+	return false
+}
+
+// rateLimitMiddleware applies the anonymous quota per client address to
+// every request, so failed authentication, unknown paths and wrong methods
+// count too. Proxied requests are then limited per caller by their route
+// once authenticated.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowRequest(w, r, "ip", "ip:"+clientIP(r), ipRateLimit) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript refills and takes from a bucket atomically on the
+// server. The tokens are returned as a string since Redis truncates Lua
+// numbers to integers.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local per_ms = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+  tokens = math.min(capacity, tokens + (now - ts) * per_ms)
+  ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}
+`)
+
+const (
+	redisPoolSize = 16
+	redisTimeout  = 500 * time.Millisecond
+)
+
+// redisStore keeps buckets in Redis or any server speaking its protocol and
+// scripting commands, so every gateway instance shares the same quotas.
+type redisStore struct {
+	client *redis.Client
+}
+
+// newRedisStore parses a redis://[user:password@]host:port/db URL. No
+// connection is made until the first request.
+func newRedisStore(rawURL string) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a redis:// URL", rawURL)
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", rawURL, err)
+	}
+	opts.PoolSize = redisPoolSize
+	opts.DialTimeout = redisTimeout
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+	// Request deadlines shorten the timeouts above
+	opts.ContextTimeoutEnabled = true
+	// A retried script could take a token twice, and a store that is down
+	// should fail fast rather than delay every request
+	opts.MaxRetries = -1
+	opts.DisableIdentity = true
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (rateLimitDecision, error) {
+	ttl := time.Duration(float64(limit.capacity())/limit.perSecond()*float64(time.Second)) + time.Second
+	reply, err := tokenBucketScript.Run(ctx, s.client, []string{key},
+		limit.capacity(),
+		strconv.FormatFloat(limit.perSecond()/1000, 'g', -1, 64),
+		now.UnixMilli(),
+		ttl.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return rateLimitDecision{}, fmt.Errorf("redis: %w", err)
+	}
+
+	if len(reply) != 2 {
+		return rateLimitDecision{}, fmt.Errorf("redis: unexpected script reply %v", reply)
+	}
+	allowed, _ := reply[0].(int64)
+	tokensText, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(tokensText, 64)
+	if err != nil {
+		return rateLimitDecision{}, fmt.Errorf("redis: unexpected token count %q", tokensText)
+	}
+	return decide(limit, tokens, allowed == 1), nil
+}
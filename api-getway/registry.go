@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/config"
+)
+
+const (
+	defaultRegistryTTL  = 30 * time.Second
+	defaultRegistryAddr = ":8010"
+	headerRegistryToken = "X-Registry-Token"
+	// devRegistryToken is the token older compose files defaulted to; it is
+	// public, so the gateway refuses it.
+	devRegistryToken = "dev-only-registry-token"
+)
+
+// Instance is one registered upstream of a service.
+type Instance struct {
+	ID            string            `json:"id"`
+	Service       string            `json:"service"`
+	URL           string            `json:"url"`
+	Version       string            `json:"version,omitempty"`
+	Weight        int               `json:"weight,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	RegisteredAt  time.Time         `json:"registered_at"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+
+	backend *backend
+}
+
+// Registry tracks live service instances. Instances that miss heartbeats
+// for longer than ttl are evicted.
+type Registry struct {
+	mu       sync.RWMutex
+	services map[string]map[string]*Instance
+	ttl      time.Duration
+	token    string
+}
+
+var registry = NewRegistry(defaultRegistryTTL, "")
+
+func NewRegistry(ttl time.Duration, token string) *Registry {
+	return &Registry{services: make(map[string]map[string]*Instance), ttl: ttl, token: token}
+}
+
+var errUnknownInstance = errors.New("instance not registered")
+
+// initRegistry configures the registry from REGISTRY_TTL and REGISTRY_TOKEN
+// and returns the internal listen address of the registration endpoints,
+// REGISTRY_LISTEN_ADDR. The token is required: anyone holding it can route
+// traffic to an instance of their choosing.
+func initRegistry(conf *config.Loader) string {
+	ttl := conf.Duration("REGISTRY_TTL", defaultRegistryTTL)
+	token := conf.Secret("REGISTRY_TOKEN", 32)
+	if token == devRegistryToken {
+		conf.Invalid("REGISTRY_TOKEN", "the development default is not accepted, generate a token")
+	}
+	registry = NewRegistry(ttl, token)
+	return conf.String("REGISTRY_LISTEN_ADDR", defaultRegistryAddr)
+}
+
+// Register adds an instance or replaces the one with the same ID.
+func (reg *Registry) Register(inst *Instance) error {
+	if inst.Service == "" {
+		return errors.New("service is required")
+	}
+	target, err := url.Parse(inst.URL)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("invalid url %q: scheme and host are required", inst.URL)
+	}
+	if inst.ID == "" {
+		inst.ID = inst.Service + "-" + target.Host
+	}
+
+	if inst.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+
+	now := time.Now()
+	inst.RegisteredAt = now
+	inst.LastHeartbeat = now
+	inst.backend = newBackend(target, inst.Weight)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.services[inst.Service] == nil {
+		reg.services[inst.Service] = make(map[string]*Instance)
+	}
+	if prev, ok := reg.services[inst.Service][inst.ID]; ok && prev.URL == inst.URL && prev.Weight == inst.Weight {
+		// Re-registration of the same instance keeps its stats and ejection state
+		inst.RegisteredAt = prev.RegisteredAt
+		inst.backend = prev.backend
+	}
+	reg.services[inst.Service][inst.ID] = inst
+	return nil
+}
+
+// Heartbeat renews an instance's lease.
+func (reg *Registry) Heartbeat(service, id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	inst, ok := reg.services[service][id]
+	if !ok {
+		return errUnknownInstance
+	}
+	inst.LastHeartbeat = time.Now()
+	return nil
+}
+
+// Deregister removes an instance.
+func (reg *Registry) Deregister(service, id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.services[service][id]; !ok {
+		return errUnknownInstance
+	}
+	delete(reg.services[service], id)
+	if len(reg.services[service]) == 0 {
+		delete(reg.services, service)
+	}
+	return nil
+}
+
+// Instances returns the live instances of service ordered by ID.
+func (reg *Registry) Instances(service string) []*Instance {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	instances := make([]*Instance, 0, len(reg.services[service]))
+	for _, inst := range reg.services[service] {
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
+
+// Snapshot returns a copy of every registered instance grouped by service.
+func (reg *Registry) Snapshot() map[string][]Instance {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	snapshot := make(map[string][]Instance, len(reg.services))
+	for service, instances := range reg.services {
+		list := make([]Instance, 0, len(instances))
+		for _, inst := range instances {
+			list = append(list, *inst)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		snapshot[service] = list
+	}
+	return snapshot
+}
+
+// evictExpired removes instances whose last heartbeat is older than the TTL.
+func (reg *Registry) evictExpired() {
+	cutoff := time.Now().Add(-reg.ttl)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for service, instances := range reg.services {
+		for id, inst := range instances {
+			if inst.LastHeartbeat.Before(cutoff) {
+				delete(instances, id)
+				slog.Warn("Registry: evicted instance", "service", service, "instance_id", id,
+					"url", inst.URL, "last_heartbeat", inst.LastHeartbeat.Format(time.RFC3339))
+			}
+		}
+		if len(instances) == 0 {
+			delete(reg.services, service)
+		}
+	}
+}
+
+func (reg *Registry) runEviction() {
+	ticker := time.NewTicker(reg.ttl / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		reg.evictExpired()
+	}
+}
+
+// authorized checks the shared registration token. A registry without a
+// token accepts no registrations.
+func (reg *Registry) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if reg.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(headerRegistryToken)), []byte(reg.token)) == 1 {
+		return true
+	}
+	writeJSONError(w, http.StatusUnauthorized, "invalid registry token")
+	return false
+}
+
+func (reg *Registry) leaseResponse(w http.ResponseWriter, status int, inst *Instance) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":                         inst.ID,
+		"service":                    inst.Service,
+		"ttl_seconds":                int(reg.ttl.Seconds()),
+		"heartbeat_interval_seconds": max(1, int((reg.ttl / 3).Seconds())),
+	})
+}
+
+// Handler serves the registration endpoints. It is mounted on the internal
+// registry listener, never on the public port.
+func (reg *Registry) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/registry/instances", reg.registerHandler).Methods("POST")
+	r.HandleFunc("/registry/instances/{service}/{id}/heartbeat", reg.heartbeatHandler).Methods("PUT")
+	r.HandleFunc("/registry/instances/{service}/{id}", reg.deregisterHandler).Methods("DELETE")
+	return r
+}
+
+func (reg *Registry) registerHandler(w http.ResponseWriter, r *http.Request) {
+	if !reg.authorized(w, r) {
+		return
+	}
+
+	var inst Instance
+	if err := json.NewDecoder(r.Body).Decode(&inst); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	if err := reg.Register(&inst); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Registry: registered instance", "service", inst.Service, "instance_id", inst.ID, "url", inst.URL, "version", inst.Version)
+	reg.leaseResponse(w, http.StatusCreated, &inst)
+}
+
+func (reg *Registry) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if !reg.authorized(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := reg.Heartbeat(vars["service"], vars["id"]); err != nil {
+		// The instance was evicted or the gateway restarted: the client re-registers
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	reg.leaseResponse(w, http.StatusOK, &Instance{ID: vars["id"], Service: vars["service"]})
+}
+
+func (reg *Registry) deregisterHandler(w http.ResponseWriter, r *http.Request) {
+	if !reg.authorized(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := reg.Deregister(vars["service"], vars["id"]); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "Registry: deregistered instance", "service", vars["service"], "instance_id", vars["id"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Service discovery endpoint
+func servicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"services":    registry.Snapshot(),
+		"ttl_seconds": int(registry.ttl.Seconds()),
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRegistryToken = "test-registry-token-0123456789abcdef"
+
+// registryRequest sends a request to the registration endpoints of reg.
+func registryRequest(reg *Registry, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set(headerRegistryToken, token)
+	}
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestRegistryRegister(t *testing.T) {
+	reg := NewRegistry(time.Minute, testRegistryToken)
+
+	w := registryRequest(reg, "POST", "/registry/instances", testRegistryToken,
+		`{"service": "products", "url": "http://products-a:8002", "version": "v2"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"id":"products-products-a:8002"`) {
+		t.Errorf("lease %s, want the generated ID", w.Body)
+	}
+	instances := reg.Instances("products")
+	if len(instances) != 1 || instances[0].URL != "http://products-a:8002" || instances[0].Version != "v2" {
+		t.Fatalf("instances = %+v", instances)
+	}
+
+	// Registering again keeps the backend state of the instance
+	instances[0].backend.observe(http.StatusBadGateway)
+	registryRequest(reg, "POST", "/registry/instances", testRegistryToken,
+		`{"service": "products", "url": "http://products-a:8002"}`)
+	if again := reg.Instances("products"); len(again) != 1 || again[0].backend != instances[0].backend {
+		t.Error("re-registration replaced the backend")
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "malformed", body: `{"service":`},
+		{name: "no service", body: `{"url": "http://products-a:8002"}`},
+		{name: "no scheme", body: `{"service": "products", "url": "products-a:8002"}`},
+		{name: "negative weight", body: `{"service": "products", "url": "http://products-b:8002", "weight": -1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := registryRequest(reg, "POST", "/registry/instances", testRegistryToken, tt.body); w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want 400", w.Code)
+			}
+		})
+	}
+	if n := len(reg.Instances("products")); n != 1 {
+		t.Errorf("%d instances after invalid registrations, want 1", n)
+	}
+}
+
+func TestRegistryHeartbeat(t *testing.T) {
+	reg := NewRegistry(time.Minute, testRegistryToken)
+	if err := reg.Register(&Instance{ID: "a", Service: "products", URL: "http://products-a:8002"}); err != nil {
+		t.Fatal(err)
+	}
+	inst := reg.Instances("products")[0]
+	inst.LastHeartbeat = time.Now().Add(-30 * time.Second)
+
+	w := registryRequest(reg, "PUT", "/registry/instances/products/a/heartbeat", testRegistryToken, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("heartbeat: %d %s", w.Code, w.Body)
+	}
+	if time.Since(inst.LastHeartbeat) > time.Second {
+		t.Error("heartbeat did not renew the lease")
+	}
+
+	// An evicted instance is told to register again
+	if w := registryRequest(reg, "PUT", "/registry/instances/products/b/heartbeat", testRegistryToken, ""); w.Code != http.StatusNotFound {
+		t.Errorf("heartbeat of an unknown instance: %d, want 404", w.Code)
+	}
+
+	if w := registryRequest(reg, "DELETE", "/registry/instances/products/a", testRegistryToken, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("deregister: %d %s", w.Code, w.Body)
+	}
+	if n := len(reg.Instances("products")); n != 0 {
+		t.Errorf("%d instances after deregistration", n)
+	}
+}
+
+func TestRegistryEvictsExpired(t *testing.T) {
+	reg := NewRegistry(time.Minute, testRegistryToken)
+	for _, inst := range []*Instance{
+		{ID: "live", Service: "products", URL: "http://products-a:8002"},
+		{ID: "stale", Service: "products", URL: "http://products-b:8002"},
+		{ID: "stale", Service: "orders", URL: "http://orders-a:8003"},
+	} {
+		if err := reg.Register(inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg.services["products"]["stale"].LastHeartbeat = time.Now().Add(-2 * time.Minute)
+	reg.services["orders"]["stale"].LastHeartbeat = time.Now().Add(-2 * time.Minute)
+
+	reg.evictExpired()
+
+	snapshot := reg.Snapshot()
+	if products := snapshot["products"]; len(products) != 1 || products[0].ID != "live" {
+		t.Errorf("products = %+v, want only the live instance", products)
+	}
+	if _, ok := snapshot["orders"]; ok {
+		t.Error("service without instances left in the registry")
+	}
+}
+
+func TestRegistryRejectsUnauthorized(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry string
+		token    string
+	}{
+		{name: "no token", registry: testRegistryToken},
+		{name: "wrong token", registry: testRegistryToken, token: "guessed"},
+		{name: "prefix of the token", registry: testRegistryToken, token: testRegistryToken[:10]},
+		{name: "registry without a token", token: "anything"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry(time.Minute, tt.registry)
+			if err := reg.Register(&Instance{ID: "a", Service: "products", URL: "http://products-a:8002"}); err != nil {
+				t.Fatal(err)
+			}
+
+			requests := []struct{ method, path, body string }{
+				{"POST", "/registry/instances", `{"service": "products", "url": "http://attacker:8002"}`},
+				{"PUT", "/registry/instances/products/a/heartbeat", ""},
+				{"DELETE", "/registry/instances/products/a", ""},
+			}
+			for _, req := range requests {
+				if w := registryRequest(reg, req.method, req.path, tt.token, req.body); w.Code != http.StatusUnauthorized {
+					t.Errorf("%s %s: %d, want 401", req.method, req.path, w.Code)
+				}
+			}
+			if instances := reg.Instances("products"); len(instances) != 1 || instances[0].ID != "a" {
+				t.Errorf("unauthorized requests changed the registry: %+v", instances)
+			}
+		})
+	}
+}
+
+func TestInitRegistryRequiresToken(t *testing.T) {
+	saved := registry
+	t.Cleanup(func() { registry = saved })
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "unset", wantErr: true},
+		{name: "development default", token: devRegistryToken, wantErr: true},
+		{name: "too short", token: "short", wantErr: true},
+		{name: "generated", token: testRegistryToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testConfig(t, map[string]string{"REGISTRY_TOKEN": tt.token, "REGISTRY_LISTEN_ADDR": ":9010"})
+			addr := initRegistry(conf)
+			if err := conf.Err(); (err != nil) != tt.wantErr {
+				t.Fatalf("Err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if addr != ":9010" {
+				t.Errorf("listen address %q", addr)
+			}
+		})
+	}
+}
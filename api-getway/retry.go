@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Retry settings: idempotent requests are retried up to retryMax times
+// (unless the route overrides it) after a transport error or a 502, 503 or
+// 504, waiting a random delay of up to retryBaseDelay doubled per attempt and
+// capped at retryMaxDelay.
+var (
+	retryMax       = 2
+	retryBaseDelay = 50 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+// maxRetryBody is the largest request body buffered for replay. Requests
+// with bigger bodies are sent once.
+const maxRetryBody = 1 << 20
+
+// attemptKey carries the *attempt of a proxied request in its context.
+type attemptKey struct{}
+
+// attempt tells the proxy error handling whether another attempt follows.
+// For a non-final attempt, failures are recorded in err instead of being
+// written to the client, so the request can be retried.
+type attempt struct {
+	final bool
+	err   error
+	// route is the name of the route table entry, for metrics.
+	route string
+}
+
+// upstreamStatusError turns a retryable upstream status into a proxy error.
+type upstreamStatusError struct {
+	StatusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream returned %d", e.StatusCode)
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// pendingAttempt returns the attempt of r if it is not the final one.
+func pendingAttempt(r *http.Request) (*attempt, bool) {
+	a, ok := r.Context().Value(attemptKey{}).(*attempt)
+	return a, ok && !a.final
+}
+
+// bufferBody reads the request body into memory so it can be sent again and
+// reports whether that succeeded. Bodies over maxRetryBody are left
+// streaming (with the part already read put back).
+func bufferBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > maxRetryBody {
+		return false
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil || len(data) > maxRetryBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return false
+	}
+	r.Body.Close()
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true
+}
+
+// backoff sleeps before retry number n (starting at 1) and reports false if
+// ctx ended first.
+func backoff(ctx context.Context, n int) bool {
+	ceiling := retryBaseDelay << min(n-1, 16)
+	if ceiling > retryMaxDelay || ceiling <= 0 {
+		ceiling = retryMaxDelay
+	}
+	delay := time.Duration(rand.Int64N(int64(ceiling)) + 1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream is a test backend that counts its requests and keeps the body
+// of the last one.
+type upstream struct {
+	*httptest.Server
+	hits     atomic.Int32
+	lastBody atomic.Value
+}
+
+// newUpstream starts a backend answering with status, reading the request
+// body first.
+func newUpstream(t *testing.T, status int) *upstream {
+	t.Helper()
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		u.lastBody.Store(string(body))
+		w.WriteHeader(status)
+		io.WriteString(w, r.Host)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) body() string {
+	body, _ := u.lastBody.Load().(string)
+	return body
+}
+
+// useRetrySettings makes retries wait at most a millisecond.
+func useRetrySettings(t *testing.T) {
+	savedBase, savedMax := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, retryMaxDelay = savedBase, savedMax })
+}
+
+// testRoute builds a round-robin route over urls; the first request goes
+// to the first one.
+func testRoute(t *testing.T, retries *int, urls ...string) *route {
+	t.Helper()
+	cfg := RouteConfig{Prefix: "/api/products", Retries: retries}
+	for _, u := range urls {
+		cfg.Targets = append(cfg.Targets, Target{URL: u})
+	}
+	rt, err := newRoute(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestRouteRetriesOnNextBackend(t *testing.T) {
+	useRetrySettings(t)
+	noRetries := 0
+
+	tests := []struct {
+		name       string
+		method     string
+		first      int // status of the first backend
+		retries    *int
+		wantStatus int
+		wantSecond int32 // requests reaching the second backend
+	}{
+		{name: "GET after 502", method: "GET", first: http.StatusBadGateway, wantStatus: http.StatusOK, wantSecond: 1},
+		{name: "GET after 503", method: "GET", first: http.StatusServiceUnavailable, wantStatus: http.StatusOK, wantSecond: 1},
+		{name: "GET after 504", method: "GET", first: http.StatusGatewayTimeout, wantStatus: http.StatusOK, wantSecond: 1},
+		{name: "PUT after 503", method: "PUT", first: http.StatusServiceUnavailable, wantStatus: http.StatusOK, wantSecond: 1},
+		{name: "DELETE after 502", method: "DELETE", first: http.StatusBadGateway, wantStatus: http.StatusOK, wantSecond: 1},
+		{name: "POST is not retried", method: "POST", first: http.StatusServiceUnavailable, wantStatus: http.StatusServiceUnavailable},
+		{name: "PATCH is not retried", method: "PATCH", first: http.StatusBadGateway, wantStatus: http.StatusBadGateway},
+		{name: "500 is not retried", method: "GET", first: http.StatusInternalServerError, wantStatus: http.StatusInternalServerError},
+		{name: "404 is not retried", method: "GET", first: http.StatusNotFound, wantStatus: http.StatusNotFound},
+		{name: "retries disabled on the route", method: "GET", first: http.StatusServiceUnavailable, retries: &noRetries, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := newUpstream(t, tt.first)
+			second := newUpstream(t, http.StatusOK)
+			rt := testRoute(t, tt.retries, first.URL, second.URL)
+
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, "/api/products/1", strings.NewReader(`{"name": "x"}`)))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if n := first.hits.Load(); n != 1 {
+				t.Errorf("first backend got %d requests, want 1", n)
+			}
+			if n := second.hits.Load(); n != tt.wantSecond {
+				t.Errorf("second backend got %d requests, want %d", n, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestRouteRetriesConnectionErrors(t *testing.T) {
+	useRetrySettings(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := newUpstream(t, http.StatusOK)
+	rt := testRoute(t, nil, down.URL, up.URL)
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/1", nil))
+	if w.Code != http.StatusOK || up.hits.Load() != 1 {
+		t.Errorf("status %d after %d requests to the live backend, want 200 after 1", w.Code, up.hits.Load())
+	}
+}
+
+func TestRouteRetriesGiveUp(t *testing.T) {
+	useRetrySettings(t)
+	a := newUpstream(t, http.StatusServiceUnavailable)
+	b := newUpstream(t, http.StatusServiceUnavailable)
+	rt := testRoute(t, nil, a.URL, b.URL)
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/1", nil))
+
+	// retryMax retries after the first attempt, the last one answered as is
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want the upstream's 503", w.Code)
+	}
+	if n := a.hits.Load() + b.hits.Load(); n != int32(retryMax+1) {
+		t.Errorf("%d attempts, want %d", n, retryMax+1)
+	}
+	if a.hits.Load() == 0 || b.hits.Load() == 0 {
+		t.Error("retries did not spread over both backends")
+	}
+}
+
+func TestRouteRetryReplaysBody(t *testing.T) {
+	useRetrySettings(t)
+
+	tests := []struct {
+		name       string
+		size       int
+		wantStatus int
+		wantSecond int32
+	}{
+		{name: "small body", size: 1024, wantStatus: http.StatusOK, wantSecond: 1},
+		{name: "at the buffer limit", size: maxRetryBody, wantStatus: http.StatusOK, wantSecond: 1},
+		// Too large to buffer: sent once, the failure is returned as is
+		{name: "over the buffer limit", size: maxRetryBody + 1, wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := newUpstream(t, http.StatusServiceUnavailable)
+			second := newUpstream(t, http.StatusOK)
+			rt := testRoute(t, nil, first.URL, second.URL)
+
+			body := strings.Repeat("x", tt.size)
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest("PUT", "/api/products/1", strings.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if first.body() != body {
+				t.Errorf("first backend got %d bytes, want %d", len(first.body()), len(body))
+			}
+			if n := second.hits.Load(); n != tt.wantSecond {
+				t.Fatalf("second backend got %d requests, want %d", n, tt.wantSecond)
+			}
+			if tt.wantSecond > 0 && second.body() != body {
+				t.Errorf("retry sent %d bytes, want %d", len(second.body()), len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"shared/tracing"
+)
+
+// Where and how often the revoked access tokens are fetched from
+// user-service. An empty URL disables revocation checks.
+var (
+	revocationListURL      = "http://user-service:8001/revocations"
+	revocationSyncInterval = 10 * time.Second
+)
+
+var revocationClient = &http.Client{Timeout: 5 * time.Second, Transport: tracing.Transport(nil)}
+
+// revokedTokens maps the jti of revoked, unexpired access tokens to their
+// expiry. It is replaced as a whole on every sync.
+var revokedTokens atomic.Pointer[map[string]time.Time]
+
+// isRevoked reports whether the access token with jti was revoked.
+func isRevoked(jti string) bool {
+	list := revokedTokens.Load()
+	if list == nil || jti == "" {
+		return false
+	}
+	_, ok := (*list)[jti]
+	return ok
+}
+
+// syncRevocations fetches the revocation list.
+func syncRevocations(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", revocationListURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := revocationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation list returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Revoked []struct {
+			JTI       string    `json:"jti"`
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"revoked"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	list := make(map[string]time.Time, len(body.Revoked))
+	for _, t := range body.Revoked {
+		list[t.JTI] = t.ExpiresAt
+	}
+	revokedTokens.Store(&list)
+	return nil
+}
+
+// runRevocationSync fetches the revocation list right away and then on
+// every interval. While user-service cannot be reached the last list stays
+// in use.
+func runRevocationSync() {
+	ticker := time.NewTicker(revocationSyncInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), revocationClient.Timeout)
+		err := syncRevocations(ctx)
+		cancel()
+		switch {
+		case err != nil && !failing:
+			slog.Warn("Revocation list sync failed, using the last list", "url", revocationListURL, "error", err)
+		case err == nil && failing:
+			slog.Info("Revocation list sync recovered", "url", revocationListURL)
+		}
+		failing = err != nil
+		<-ticker.C
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule replaces the forwarded path when it matches Pattern, a regular
+// expression. Replacement may refer to capture groups as $1 or ${name}
+// (written $${name} in route files, which are expanded from the environment).
+type RewriteRule struct {
+	Pattern     string `yaml:"pattern" json:"pattern"`
+	Replacement string `yaml:"replacement" json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// compileRewrites checks the rewrite settings of cfg and compiles its rules.
+func compileRewrites(cfg *RouteConfig) error {
+	if cfg.AddPrefix != "" && !strings.HasPrefix(cfg.AddPrefix, "/") {
+		return fmt.Errorf("add_prefix %q must start with /", cfg.AddPrefix)
+	}
+	cfg.AddPrefix = strings.TrimSuffix(cfg.AddPrefix, "/")
+
+	for i, rule := range cfg.Rewrite {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rewrite %q: %w", rule.Pattern, err)
+		}
+		cfg.Rewrite[i].re = re
+	}
+	return nil
+}
+
+// upstreamPath is the path forwarded for path: the route prefix is removed
+// if strip_prefix is set, then the first matching rewrite rule is applied,
+// then add_prefix is prepended. The result ends in a slash only if path did,
+// so /api/catalog is not forwarded as /api/products/.
+func (rt *route) upstreamPath(path string) string {
+	trailingSlash := strings.HasSuffix(path, "/")
+	if rt.StripPrefix {
+		path = "/" + strings.TrimLeft(strings.TrimPrefix(path, rt.Prefix), "/")
+	}
+	for _, rule := range rt.Rewrite {
+		if rule.re.MatchString(path) {
+			path = rule.re.ReplaceAllString(path, rule.Replacement)
+			break
+		}
+	}
+	if rt.AddPrefix != "" {
+		path = rt.AddPrefix + "/" + strings.TrimLeft(path, "/")
+	}
+	if !trailingSlash && len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// rewrites reports whether the route changes the forwarded path.
+func (rt *route) rewrites() bool {
+	return rt.StripPrefix || len(rt.Rewrite) > 0 || rt.AddPrefix != ""
+}
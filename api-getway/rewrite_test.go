@@ -0,0 +1,163 @@
+package main
+
+import "testing"
+
+func TestUpstreamPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefix      string
+		stripPrefix bool
+		rewrite     []RewriteRule
+		addPrefix   string
+		path        string
+		want        string
+	}{
+		{name: "no rewrite", prefix: "/api/products", path: "/api/products/1", want: "/api/products/1"},
+		{name: "strip prefix", prefix: "/api/products", stripPrefix: true, path: "/api/products/1", want: "/1"},
+		{name: "strip prefix exact", prefix: "/api/products", stripPrefix: true, path: "/api/products", want: "/"},
+		{name: "strip prefix trailing slash", prefix: "/api/products", stripPrefix: true, path: "/api/products/", want: "/"},
+		{name: "strip prefix ending in slash", prefix: "/api/products/", stripPrefix: true, path: "/api/products/1/stock", want: "/1/stock"},
+		{name: "strip prefix repeated slashes", prefix: "/api/products", stripPrefix: true, path: "/api/products//1", want: "/1"},
+		{name: "replace prefix", prefix: "/shop", stripPrefix: true, addPrefix: "/api/products", path: "/shop/1", want: "/api/products/1"},
+		{name: "replace prefix exact", prefix: "/shop", stripPrefix: true, addPrefix: "/api/products", path: "/shop", want: "/api/products"},
+		{name: "replace prefix trailing slash", prefix: "/shop", stripPrefix: true, addPrefix: "/api/products", path: "/shop/", want: "/api/products/"},
+		{name: "add prefix to root", prefix: "/", addPrefix: "/internal", path: "/", want: "/internal/"},
+		{name: "add prefix keeps path", prefix: "/v1", addPrefix: "/internal", path: "/v1/users", want: "/internal/v1/users"},
+		{
+			name: "rewrite with groups", prefix: "/api/catalog",
+			rewrite: []RewriteRule{{Pattern: `^/api/catalog/items/(\d+)$`, Replacement: "/api/products/$1"}},
+			path:    "/api/catalog/items/42", want: "/api/products/42",
+		},
+		{
+			name: "rewrite with named groups", prefix: "/api/catalog",
+			rewrite: []RewriteRule{{Pattern: `^/api/catalog/(?P<id>\d+)/(?P<what>\w+)$`, Replacement: "/api/products/${id}/${what}"}},
+			path:    "/api/catalog/7/stock", want: "/api/products/7/stock",
+		},
+		{
+			// The example from the README
+			name: "strip and rewrite exact prefix", prefix: "/api/catalog", stripPrefix: true,
+			rewrite: []RewriteRule{{Pattern: `^/(.*)$`, Replacement: "/api/products/$1"}},
+			path:    "/api/catalog", want: "/api/products",
+		},
+		{
+			name: "strip and rewrite trailing slash", prefix: "/api/catalog", stripPrefix: true,
+			rewrite: []RewriteRule{{Pattern: `^/(.*)$`, Replacement: "/api/products/$1"}},
+			path:    "/api/catalog/", want: "/api/products/",
+		},
+		{
+			name: "strip and rewrite below prefix", prefix: "/api/catalog", stripPrefix: true,
+			rewrite: []RewriteRule{{Pattern: `^/(.*)$`, Replacement: "/api/products/$1"}},
+			path:    "/api/catalog/1/stock", want: "/api/products/1/stock",
+		},
+		{
+			name: "first matching rule only", prefix: "/api/catalog",
+			rewrite: []RewriteRule{
+				{Pattern: `^/api/catalog/search$`, Replacement: "/api/products/search"},
+				{Pattern: `^/api/catalog`, Replacement: "/api/products"},
+			},
+			path: "/api/catalog/search", want: "/api/products/search",
+		},
+		{
+			name: "no rule matches", prefix: "/api/catalog",
+			rewrite: []RewriteRule{{Pattern: `^/api/catalog/items/(\d+)$`, Replacement: "/api/products/$1"}},
+			path:    "/api/catalog/tags", want: "/api/catalog/tags",
+		},
+		{
+			name: "strip, rewrite then add prefix", prefix: "/store", stripPrefix: true, addPrefix: "/api/v2/",
+			rewrite: []RewriteRule{{Pattern: `^/items/`, Replacement: "/products/"}},
+			path:    "/store/items/3", want: "/api/v2/products/3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := RouteConfig{Prefix: tt.prefix, StripPrefix: tt.stripPrefix, Rewrite: tt.rewrite, AddPrefix: tt.addPrefix}
+			if err := compileRewrites(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			rt := &route{RouteConfig: cfg}
+			if wantRewrites := tt.stripPrefix || len(tt.rewrite) > 0 || tt.addPrefix != ""; rt.rewrites() != wantRewrites {
+				t.Errorf("rewrites() = %v, want %v", rt.rewrites(), wantRewrites)
+			}
+			if got := rt.upstreamPath(tt.path); got != tt.want {
+				t.Errorf("upstreamPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRewrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RouteConfig
+		wantErr bool
+	}{
+		{name: "valid", cfg: RouteConfig{AddPrefix: "/api", Rewrite: []RewriteRule{{Pattern: `^/(\d+)$`, Replacement: "/$1"}}}},
+		{name: "relative add_prefix", cfg: RouteConfig{AddPrefix: "api"}, wantErr: true},
+		{name: "bad pattern", cfg: RouteConfig{Rewrite: []RewriteRule{{Pattern: `^/(\d+$`}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := compileRewrites(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("compileRewrites = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchesRulePath(t *testing.T) {
+	tests := []struct {
+		path string
+		rule string
+		want bool
+	}{
+		// Plain rules match the path and everything below it
+		{"/api/products", "/api/products", true},
+		{"/api/products/", "/api/products", true},
+		{"/api/products/1", "/api/products", true},
+		{"/api/productsearch", "/api/products", false},
+		{"/api/product", "/api/products", false},
+		{"/api/products/1", "/api/products/", true},
+		{"/api/products", "/api/products/", false},
+
+		// * matches exactly one segment
+		{"/api/orders/1/status", "/api/orders/*/status", true},
+		{"/api/orders/abc/status", "/api/orders/*/status", true},
+		{"/api/orders/1/status/history", "/api/orders/*/status", true},
+		{"/api/orders/1/status/", "/api/orders/*/status", true},
+		{"/api/orders/1/items", "/api/orders/*/status", false},
+		{"/api/orders/1", "/api/orders/*/status", false},
+		{"/api/orders/1/2/status", "/api/orders/*/status", false},
+		{"/api/products/7/stock", "/api/products/*/stock", true},
+		{"/api/products/reservations", "/api/products/*/stock", false},
+		{"/api/orders/1", "/api/orders/*", true},
+		{"/api/orders/1", "/api/orders/*/", true},
+		{"/api/orders", "/api/orders/*", false},
+		{"/api/users/1/roles/admin", "/api/users/*/roles/*", true},
+		{"/api/users/1/roles", "/api/users/*/roles/*", false},
+	}
+	for _, tt := range tests {
+		if got := matchesRulePath(tt.path, tt.rule); got != tt.want {
+			t.Errorf("matchesRulePath(%q, %q) = %v, want %v", tt.path, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{"/api/users", "/api/users", true},
+		{"/api/users/1", "/api/users", true},
+		{"/api/users-admin", "/api/users", false},
+		{"/api/users/1", "/api/users/", true},
+		{"/api", "/api/users", false},
+		{"/anything", "/", true},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
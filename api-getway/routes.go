@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"shared/config"
+	"shared/versioning"
+)
+
+const defaultRouteTimeout = 30 * time.Second
+
+// RouteConfig describes one entry of the gateway route file.
+type RouteConfig struct {
+	Name   string `yaml:"name" json:"name"`
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// Service names the registry entry whose live instances serve the
+	// route. Targets are used while no instance is registered.
+	Service string   `yaml:"service" json:"service"`
+	Targets []Target `yaml:"targets" json:"targets"`
+	// Strategy selects the load balancing strategy: round_robin (default),
+	// least_connections, weighted or consistent_hash (on the user ID).
+	Strategy string `yaml:"strategy" json:"strategy"`
+	// Retries overrides RETRY_MAX for idempotent requests; 0 disables them.
+	Retries     *int     `yaml:"retries" json:"retries"`
+	Methods     []string `yaml:"methods" json:"methods"`
+	StripPrefix bool     `yaml:"strip_prefix" json:"strip_prefix"`
+	// Rewrite and AddPrefix change the forwarded path after StripPrefix.
+	Rewrite   []RewriteRule `yaml:"rewrite" json:"rewrite,omitempty"`
+	AddPrefix string        `yaml:"add_prefix" json:"add_prefix,omitempty"`
+	// Versions lists the API versions the upstream serves. Requests for
+	// another version are rejected; an empty list lets any through.
+	Versions     []string      `yaml:"versions" json:"versions,omitempty"`
+	Timeout      time.Duration `yaml:"timeout" json:"timeout"`
+	AuthRequired bool          `yaml:"auth_required" json:"auth_required"`
+	Public       []PublicRule  `yaml:"public" json:"public"`
+	// RateLimit overrides the default per-caller quota of the route;
+	// RateLimits sets stricter quotas on some of its paths.
+	RateLimit  *RateLimit      `yaml:"rate_limit" json:"rate_limit"`
+	RateLimits []PathRateLimit `yaml:"rate_limits" json:"rate_limits"`
+	// Permissions restricts paths to callers whose token grants a permission.
+	Permissions []PermissionRule `yaml:"permissions" json:"permissions,omitempty"`
+}
+
+// PublicRule exempts a path (and optionally only some methods) of an
+// auth_required route from token verification.
+type PublicRule struct {
+	Path    string   `yaml:"path" json:"path"`
+	Methods []string `yaml:"methods" json:"methods"`
+}
+
+// PermissionRule requires a permission for a path (and optionally only some
+// methods) of a route. The first matching rule applies.
+type PermissionRule struct {
+	Path       string   `yaml:"path" json:"path"`
+	Methods    []string `yaml:"methods" json:"methods"`
+	Permission string   `yaml:"permission" json:"permission"`
+}
+
+type routeFile struct {
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// route is a validated RouteConfig with its static backends built.
+type route struct {
+	RouteConfig
+	backends []*backend
+	balancer *balancer
+}
+
+// RouteTable holds the routes sorted from the most to the least specific prefix.
+type RouteTable struct {
+	routes []*route
+}
+
+var routeTable atomic.Pointer[RouteTable]
+
+// loadRouteTable reads the route table from path. ${VAR} and ${VAR:-default}
+// references in the file are replaced with settings from conf.
+func loadRouteTable(path string, conf *config.Loader) (*RouteTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON, so either format is accepted here.
+	var file routeFile
+	if err := yaml.Unmarshal([]byte(conf.Expand(string(data))), &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(file.Routes) == 0 {
+		return nil, fmt.Errorf("%s: no routes defined", path)
+	}
+
+	table := &RouteTable{}
+	for i, cfg := range file.Routes {
+		rt, err := newRoute(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: route %d (%s): %w", path, i, cfg.Prefix, err)
+		}
+		table.routes = append(table.routes, rt)
+	}
+
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		return len(table.routes[i].Prefix) > len(table.routes[j].Prefix)
+	})
+
+	return table, nil
+}
+
+func newRoute(cfg RouteConfig) (*route, error) {
+	if !strings.HasPrefix(cfg.Prefix, "/") {
+		return nil, errors.New("prefix must start with /")
+	}
+	if len(cfg.Targets) == 0 && cfg.Service == "" {
+		return nil, errors.New("a service or at least one target is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.Prefix
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultRouteTimeout
+	}
+	for i, m := range cfg.Methods {
+		cfg.Methods[i] = strings.ToUpper(m)
+	}
+	for i, rule := range cfg.Public {
+		if !hasPathPrefix(rule.Path, cfg.Prefix) {
+			return nil, fmt.Errorf("public path %q is outside the route prefix", rule.Path)
+		}
+		for j, m := range rule.Methods {
+			cfg.Public[i].Methods[j] = strings.ToUpper(m)
+		}
+	}
+
+	if cfg.RateLimit != nil {
+		if err := cfg.RateLimit.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i, rule := range cfg.RateLimits {
+		if !hasPathPrefix(rule.Path, cfg.Prefix) {
+			return nil, fmt.Errorf("rate limited path %q is outside the route prefix", rule.Path)
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rate limit of %s: %w", rule.Path, err)
+		}
+		for j, m := range rule.Methods {
+			cfg.RateLimits[i].Methods[j] = strings.ToUpper(m)
+		}
+	}
+	for i, rule := range cfg.Permissions {
+		if !hasPathPrefix(rule.Path, cfg.Prefix) {
+			return nil, fmt.Errorf("permission path %q is outside the route prefix", rule.Path)
+		}
+		if rule.Permission == "" {
+			return nil, fmt.Errorf("permission rule for %s names no permission", rule.Path)
+		}
+		for j, m := range rule.Methods {
+			cfg.Permissions[i].Methods[j] = strings.ToUpper(m)
+		}
+	}
+
+	if cfg.Retries != nil && *cfg.Retries < 0 {
+		return nil, errors.New("retries must not be negative")
+	}
+	if err := compileRewrites(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateVersions(&cfg); err != nil {
+		return nil, err
+	}
+
+	lb, err := newBalancer(cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Strategy = lb.strategy
+
+	rt := &route{RouteConfig: cfg, balancer: lb}
+	for _, t := range cfg.Targets {
+		target, err := url.Parse(t.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", t.URL, err)
+		}
+		if target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid target %q: scheme and host are required", t.URL)
+		}
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("invalid target %q: weight must not be negative", t.URL)
+		}
+		rt.backends = append(rt.backends, newBackend(target, t.Weight))
+	}
+
+	return rt, nil
+}
+
+// hasPathPrefix reports whether path falls under prefix on a segment boundary.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// matchesRulePath reports whether path falls under the path of a public,
+// rate limit or permission rule. A * segment in the rule matches any one
+// segment, as in /api/orders/*/status.
+func matchesRulePath(path, rule string) bool {
+	if !strings.Contains(rule, "*") {
+		return hasPathPrefix(path, rule)
+	}
+	segments := strings.Split(path, "/")
+	ruleSegments := strings.Split(strings.TrimSuffix(rule, "/"), "/")
+	if len(segments) < len(ruleSegments) {
+		return false
+	}
+	for i, s := range ruleSegments {
+		if s != "*" && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func methodAllowed(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *route) matchesPath(path string) bool {
+	return hasPathPrefix(path, rt.Prefix)
+}
+
+func (rt *route) allowsMethod(method string) bool {
+	return methodAllowed(rt.Methods, method)
+}
+
+// requiresAuth reports whether the request needs a verified token on this route.
+func (rt *route) requiresAuth(r *http.Request) bool {
+	if !rt.AuthRequired {
+		return false
+	}
+	for _, rule := range rt.Public {
+		if matchesRulePath(r.URL.Path, rule.Path) && methodAllowed(rule.Methods, r.Method) {
+			return false
+		}
+	}
+	return true
+}
+
+// requiredPermission returns the permission the request needs on this
+// route, or "" when a valid token (if required at all) is enough.
+func (rt *route) requiredPermission(r *http.Request) string {
+	for _, rule := range rt.Permissions {
+		if matchesRulePath(r.URL.Path, rule.Path) && methodAllowed(rule.Methods, r.Method) {
+			return rule.Permission
+		}
+	}
+	return ""
+}
+
+// rateLimit returns the bucket scope and quota for the request: the first
+// matching path rule, else the route's own quota, else the default one.
+func (rt *route) rateLimit(r *http.Request) (string, RateLimit) {
+	for _, rule := range rt.RateLimits {
+		if matchesRulePath(r.URL.Path, rule.Path) && methodAllowed(rule.Methods, r.Method) {
+			return rt.Name + rule.Path, rule.RateLimit
+		}
+	}
+	if rt.RateLimit != nil {
+		return rt.Name, *rt.RateLimit
+	}
+	return rt.Name, defaultRateLimit
+}
+
+// Match returns the most specific route for the request. The second return
+// value reports whether some route matched the path but not the method.
+func (t *RouteTable) Match(r *http.Request) (*route, bool) {
+	pathMatched := false
+	for _, rt := range t.routes {
+		if !rt.matchesPath(r.URL.Path) {
+			continue
+		}
+		if rt.allowsMethod(r.Method) {
+			return rt, false
+		}
+		pathMatched = true
+	}
+	return nil, pathMatched
+}
+
+func (rt *route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nameRoute(r, rt.Prefix)
+
+	if !authorize(rt, w, r) {
+		return
+	}
+	if scope, limit := rt.rateLimit(r); !allowRequest(w, r, scope, rateLimitKey(r), limit) {
+		return
+	}
+
+	if rt.rewrites() {
+		r.URL.Path = rt.upstreamPath(r.URL.Path)
+		r.URL.RawPath = ""
+	}
+	if version := requestedVersion(r); version != "" {
+		r.URL.Path = versioning.Join(version, r.URL.Path)
+		r.URL.RawPath = ""
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), rt.Timeout)
+	defer cancel()
+
+	pool, _ := rt.pool()
+	if len(pool) == 0 {
+		upstreamErrors.WithLabelValues(rt.Name, "no_instances").Inc()
+		writeJSONError(w, http.StatusServiceUnavailable, "No instances available")
+		return
+	}
+
+	attempts := 1
+	if idempotentMethod(r.Method) && bufferBody(r) {
+		attempts += rt.retries()
+	}
+
+	tried := make(map[*backend]bool)
+	for n := 1; ; n++ {
+		b, probe, wait := rt.choose(pool, r, tried)
+		if b == nil {
+			upstreamErrors.WithLabelValues(rt.Name, "circuit_open").Inc()
+			w.Header().Set(headerCircuitBreaker, breakerOpen.String())
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+			writeJSONError(w, http.StatusServiceUnavailable, "Service unavailable, circuit breaker open")
+			return
+		}
+		tried[b] = true
+
+		a := &attempt{final: n >= attempts, route: rt.Name}
+		req := r.WithContext(context.WithValue(ctx, attemptKey{}, a))
+		if n > 1 && r.GetBody != nil {
+			req.Body, _ = r.GetBody()
+		}
+
+		w.Header().Set(headerCircuitBreaker, b.breaker.stateAt(time.Now()).String())
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		b.active.Add(1)
+		b.proxy.ServeHTTP(rec, req)
+		b.active.Add(-1)
+
+		status := rec.status
+		if a.err != nil {
+			status = http.StatusBadGateway
+		}
+		if r.Context().Err() != nil {
+			// The client went away; that says nothing about the upstream
+			b.breaker.cancel(probe)
+			return
+		}
+		b.breaker.done(probe, status >= 500)
+		b.observe(status)
+
+		if a.err == nil {
+			return
+		}
+		slog.WarnContext(r.Context(), "Upstream attempt failed", "upstream", b.url.String(), "attempt", n, "attempts", attempts, "error", a.err)
+		if !backoff(ctx, n) {
+			writeJSONError(w, http.StatusGatewayTimeout, "Upstream timeout")
+			return
+		}
+	}
+}
+
+// retries is the number of retries allowed for an idempotent request.
+func (rt *route) retries() int {
+	if rt.Retries != nil {
+		return *rt.Retries
+	}
+	return retryMax
+}
+
+// choose picks a backend whose circuit breaker admits the request,
+// preferring backends not tried yet. When every breaker is open it returns
+// nil and the time until the first one admits a probe.
+func (rt *route) choose(pool []*backend, r *http.Request, tried map[*backend]bool) (*backend, bool, time.Duration) {
+	now := time.Now()
+	var fresh, ready []*backend
+	for _, b := range pool {
+		if b.breaker.ready(now) {
+			ready = append(ready, b)
+			if !tried[b] {
+				fresh = append(fresh, b)
+			}
+		}
+	}
+
+	candidates := fresh
+	if len(candidates) == 0 {
+		candidates = ready
+	}
+	for len(candidates) > 0 {
+		b := rt.balancer.pick(candidates, r)
+		if ok, probe := b.breaker.allow(now); ok {
+			return b, probe, 0
+		}
+		candidates = slices.DeleteFunc(slices.Clone(candidates), func(c *backend) bool { return c == b })
+	}
+
+	wait := breakerOpenTimeout
+	for _, b := range pool {
+		wait = min(wait, b.breaker.retryAfter(now))
+	}
+	return nil, false, wait
+}
+
+// pool returns the backends serving the route: the registered instances of
+// its service if there are any, otherwise its static targets. The second
+// return value reports whether the registry was used.
+func (rt *route) pool() ([]*backend, bool) {
+	if rt.Service != "" {
+		if instances := registry.Instances(rt.Service); len(instances) > 0 {
+			backends := make([]*backend, len(instances))
+			for i, inst := range instances {
+				backends[i] = inst.backend
+			}
+			return backends, true
+		}
+	}
+	return rt.backends, false
+}
+
+// watchRouteReloads reloads the route table from path whenever the process receives SIGHUP.
+// A file that fails to load is logged and the previous table stays active.
+func watchRouteReloads(path string, conf *config.Loader) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for range sig {
+			if err := reloadRoutes(path, conf); err != nil {
+				slog.Error("Route reload failed, keeping previous routes", "file", path, "error", err)
+			}
+		}
+	}()
+}
+
+// reloadRoutes replaces the active route table with the one in path. On
+// error the active table is left untouched.
+func reloadRoutes(path string, conf *config.Loader) error {
+	table, err := loadRouteTable(path, conf)
+	if err != nil {
+		return err
+	}
+	table.adoptBackends(routeTable.Load())
+	routeTable.Store(table)
+	slog.Info("Reloaded routes", "file", path, "routes", len(table.routes))
+	return nil
+}
+
+// adoptBackends replaces the static backends of t with the ones prev already
+// had for the same route, URL and weight, so that a reload keeps their
+// circuit breakers, ejections, health and statistics.
+func (t *RouteTable) adoptBackends(prev *RouteTable) {
+	if prev == nil {
+		return
+	}
+	known := make(map[string]*backend)
+	for _, rt := range prev.routes {
+		for _, b := range rt.backends {
+			known[backendKey(rt.Name, b)] = b
+		}
+	}
+	for _, rt := range t.routes {
+		for i, b := range rt.backends {
+			if prevBackend, ok := known[backendKey(rt.Name, b)]; ok {
+				rt.backends[i] = prevBackend
+			}
+		}
+	}
+}
+
+func backendKey(route string, b *backend) string {
+	return fmt.Sprintf("%s %s %d", route, b.url, b.weight)
+}
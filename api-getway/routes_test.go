@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"shared/config"
+)
+
+func testConfig(t *testing.T, env map[string]string) *config.Loader {
+	t.Helper()
+	t.Setenv(config.FileEnv, "")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	conf, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func writeRoutes(t *testing.T, path, routes string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(routes), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRouteTableExpandsSettings(t *testing.T) {
+	conf := testConfig(t, map[string]string{"PRODUCT_SERVICE_URL": "http://products:8002"})
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	writeRoutes(t, path, `
+routes:
+  - prefix: /api/products
+    targets: ["${PRODUCT_SERVICE_URL:-http://localhost:8002}"]
+  - prefix: /api/orders
+    targets: ["${ORDER_SERVICE_URL:-${FALLBACK_URL:-http://localhost:8003}}"]
+`)
+
+	table, err := loadRouteTable(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/api/products": "http://products:8002",
+		"/api/orders":   "http://localhost:8003",
+	}
+	for _, rt := range table.routes {
+		if got := rt.Targets[0].URL; got != want[rt.Prefix] {
+			t.Errorf("%s: target %q, want %q", rt.Prefix, got, want[rt.Prefix])
+		}
+	}
+}
+
+func TestReloadRoutesKeepsTableOnError(t *testing.T) {
+	saved := routeTable.Load()
+	t.Cleanup(func() { routeTable.Store(saved) })
+
+	conf := testConfig(t, nil)
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	writeRoutes(t, path, `
+routes:
+  - prefix: /api/products
+    targets: [http://localhost:9999]
+`)
+	if err := reloadRoutes(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := routeTable.Load()
+	if len(loaded.routes) != 1 || loaded.routes[0].Prefix != "/api/products" {
+		t.Fatalf("loaded %d routes, want /api/products", len(loaded.routes))
+	}
+
+	tests := []struct {
+		name   string
+		routes string
+	}{
+		{name: "malformed YAML", routes: "routes: [prefix: /api/products"},
+		{name: "no routes", routes: "routes: []"},
+		{name: "invalid route", routes: "routes:\n  - prefix: api/products\n    targets: [http://localhost:9999]"},
+		{name: "no targets", routes: "routes:\n  - prefix: /api/products"},
+		{name: "bad strategy", routes: "routes:\n  - prefix: /api/products\n    strategy: random\n    targets: [http://localhost:9999]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeRoutes(t, path, tt.routes)
+			if err := reloadRoutes(path, conf); err == nil {
+				t.Fatal("reloadRoutes succeeded with an invalid file")
+			}
+			if routeTable.Load() != loaded {
+				t.Error("failed reload replaced the route table")
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := reloadRoutes(filepath.Join(t.TempDir(), "missing.yaml"), conf); err == nil {
+			t.Fatal("reloadRoutes succeeded without a file")
+		}
+		if routeTable.Load() != loaded {
+			t.Error("failed reload replaced the route table")
+		}
+	})
+}
+
+func TestReloadRoutesKeepsBackendState(t *testing.T) {
+	saved := routeTable.Load()
+	t.Cleanup(func() { routeTable.Store(saved) })
+
+	conf := testConfig(t, nil)
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	writeRoutes(t, path, `
+routes:
+  - name: products
+    prefix: /api/products
+    targets: [http://products-a:8002, http://products-b:8002]
+`)
+	if err := reloadRoutes(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	before := routeTable.Load().routes[0].backends
+	before[0].observe(http.StatusBadGateway)
+
+	// b gets a new weight and c is added; a is unchanged
+	writeRoutes(t, path, `
+routes:
+  - name: products
+    prefix: /api/products
+    targets:
+      - http://products-a:8002
+      - url: http://products-b:8002
+        weight: 2
+      - http://products-c:8002
+  - name: orders
+    prefix: /api/orders
+    targets: [http://products-a:8002]
+`)
+	if err := reloadRoutes(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	table := routeTable.Load()
+	after := table.routes[0].backends
+	if table.routes[0].Name != "products" {
+		after = table.routes[1].backends
+	}
+	if after[0] != before[0] || after[0].failures.Load() != 1 {
+		t.Error("unchanged target lost its state")
+	}
+	if after[1] == before[1] || after[1].weight != 2 {
+		t.Error("target with a new weight kept its old backend")
+	}
+	if after[2].url.Host != "products-c:8002" {
+		t.Errorf("new target %s", after[2].url)
+	}
+	for _, rt := range table.routes {
+		if rt.Name == "orders" && rt.backends[0] == before[0] {
+			t.Error("another route shares the backend of the same URL")
+		}
+	}
+}
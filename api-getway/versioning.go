@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"shared/versioning"
+)
+
+type apiVersionKey struct{}
+
+// negotiateVersion takes the version out of /api/vN/... paths, so that the
+// route table only holds unversioned prefixes, and returns the version the
+// client asked for in the path or else in the Accept header. The second
+// return value reports whether it came from the path.
+func negotiateVersion(r *http.Request) (string, bool) {
+	if version, rest := versioning.Split(r.URL.Path); version != "" {
+		r.URL.Path = rest
+		r.URL.RawPath = ""
+		return version, true
+	}
+	return versioning.FromAccept(r.Header.Get("Accept")), false
+}
+
+// withVersion records the negotiated version for the proxy.
+func withVersion(r *http.Request, version string) *http.Request {
+	if version == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+}
+
+// requestedVersion returns the version negotiated for the request, or "".
+func requestedVersion(r *http.Request) string {
+	version, _ := r.Context().Value(apiVersionKey{}).(string)
+	return version
+}
+
+// validateVersions checks the versions listed by a route.
+func validateVersions(cfg *RouteConfig) error {
+	if version, _ := versioning.Split(cfg.Prefix); version != "" {
+		return fmt.Errorf("prefix %q must not contain a version, list it in versions", cfg.Prefix)
+	}
+	for _, v := range cfg.Versions {
+		if !versioning.Valid(v) {
+			return fmt.Errorf("invalid version %q", v)
+		}
+	}
+	return nil
+}
+
+// supportsVersion reports whether the route serves version. Routes that do
+// not list their versions are sent any version.
+func (rt *route) supportsVersion(version string) bool {
+	return len(rt.Versions) == 0 || slices.Contains(rt.Versions, version)
+}
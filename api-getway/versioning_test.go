@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		wantVersion string
+		wantInPath  bool
+		wantPath    string
+	}{
+		{name: "path", path: "/api/v2/products/1", wantVersion: "v2", wantInPath: true, wantPath: "/api/products/1"},
+		{name: "vendor media type", path: "/api/products/1", accept: "application/vnd.microservice.v2+json", wantVersion: "v2", wantPath: "/api/products/1"},
+		{name: "version parameter", path: "/api/products/1", accept: "application/json; version=2", wantVersion: "v2", wantPath: "/api/products/1"},
+		// The route's default version serves requests naming none
+		{name: "missing", path: "/api/products/1", accept: "application/json", wantPath: "/api/products/1"},
+		{name: "unusable Accept version", path: "/api/products/1", accept: "application/json; version=0", wantPath: "/api/products/1"},
+		// The path is explicit about the resource and wins over Accept
+		{name: "conflicting path and Accept", path: "/api/v1/products/1", accept: "application/vnd.microservice.v2+json", wantVersion: "v1", wantInPath: true, wantPath: "/api/products/1"},
+		{name: "not versioned", path: "/health", accept: "application/vnd.microservice.v2+json", wantVersion: "v2", wantPath: "/health"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			version, inPath := negotiateVersion(r)
+			if version != tt.wantVersion || inPath != tt.wantInPath {
+				t.Errorf("negotiateVersion = %q, %v, want %q, %v", version, inPath, tt.wantVersion, tt.wantInPath)
+			}
+			if r.URL.Path != tt.wantPath {
+				t.Errorf("path %q, want %q", r.URL.Path, tt.wantPath)
+			}
+			if got := requestedVersion(withVersion(r, version)); got != version {
+				t.Errorf("requestedVersion = %q, want %q", got, version)
+			}
+		})
+	}
+}
+
+func TestRouteHandlerVersions(t *testing.T) {
+	table := &RouteTable{routes: []*route{{RouteConfig: RouteConfig{
+		Name:     "product-service",
+		Prefix:   "/api/products",
+		Methods:  []string{http.MethodGet},
+		Versions: []string{"v1", "v2"},
+	}}}}
+	saved := routeTable.Load()
+	routeTable.Store(table)
+	t.Cleanup(func() { routeTable.Store(saved) })
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		accept     string
+		wantStatus int
+	}{
+		{name: "unknown version in path", path: "/api/v3/products/1", wantStatus: http.StatusNotFound},
+		{name: "unknown version in Accept", path: "/api/products/1", accept: "application/vnd.microservice.v3+json", wantStatus: http.StatusNotAcceptable},
+		{name: "unknown path version wins over a known Accept one", path: "/api/v3/products/1", accept: "application/vnd.microservice.v2+json", wantStatus: http.StatusNotFound},
+		{name: "no route", path: "/api/v2/carts/1", wantStatus: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodPost, path: "/api/v2/products", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			routeHandler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want Accept", got)
+			}
+		})
+	}
+}
+
+func TestSupportsVersion(t *testing.T) {
+	listed := &route{RouteConfig: RouteConfig{Versions: []string{"v1", "v2"}}}
+	unlisted := &route{}
+	tests := []struct {
+		rt      *route
+		version string
+		want    bool
+	}{
+		{listed, "v1", true},
+		{listed, "v2", true},
+		{listed, "v3", false},
+		{unlisted, "v7", true},
+	}
+	for _, tt := range tests {
+		if got := tt.rt.supportsVersion(tt.version); got != tt.want {
+			t.Errorf("supportsVersion(%q) with versions %v = %v, want %v", tt.version, tt.rt.Versions, got, tt.want)
+		}
+	}
+}
+
+func TestValidateVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RouteConfig
+		wantErr bool
+	}{
+		{name: "valid", cfg: RouteConfig{Prefix: "/api/products", Versions: []string{"v1", "v2"}}},
+		{name: "none listed", cfg: RouteConfig{Prefix: "/api/products"}},
+		{name: "versioned prefix", cfg: RouteConfig{Prefix: "/api/v2/products"}, wantErr: true},
+		{name: "invalid version", cfg: RouteConfig{Prefix: "/api/products", Versions: []string{"2"}}, wantErr: true},
+		{name: "zero version", cfg: RouteConfig{Prefix: "/api/products", Versions: []string{"v0"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateVersions(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("validateVersions = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
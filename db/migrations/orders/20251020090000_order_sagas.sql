@@ -0,0 +1,31 @@
+-- migrate:up
+-- orders_db: persisted state for the order placement saga.
+CREATE TABLE IF NOT EXISTS order_sagas (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS order_saga_steps (
+    id SERIAL PRIMARY KEY,
+    saga_id INTEGER NOT NULL REFERENCES order_sagas(id) ON DELETE CASCADE,
+    step_index INTEGER NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    product_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    error TEXT,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (saga_id, step_index)
+);
+
+-- Recovery scans unfinished sagas by age
+CREATE INDEX IF NOT EXISTS idx_order_sagas_unfinished ON order_sagas(updated_at) WHERE status IN ('running', 'compensating');
+CREATE INDEX IF NOT EXISTS idx_order_saga_steps_saga_id ON order_saga_steps(saga_id);
+
+-- migrate:down
+DROP TABLE IF EXISTS order_saga_steps;
+DROP TABLE IF EXISTS order_sagas;
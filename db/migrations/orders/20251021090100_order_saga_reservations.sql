@@ -0,0 +1,11 @@
+-- migrate:up
+-- orders_db: saga steps that hold a product-service reservation instead of a single product.
+ALTER TABLE order_saga_steps ADD COLUMN IF NOT EXISTS reservation_id INTEGER;
+ALTER TABLE order_saga_steps ALTER COLUMN product_id DROP NOT NULL;
+ALTER TABLE order_saga_steps ALTER COLUMN quantity DROP NOT NULL;
+
+-- migrate:down
+DELETE FROM order_saga_steps WHERE product_id IS NULL OR quantity IS NULL;
+ALTER TABLE order_saga_steps ALTER COLUMN quantity SET NOT NULL;
+ALTER TABLE order_saga_steps ALTER COLUMN product_id SET NOT NULL;
+ALTER TABLE order_saga_steps DROP COLUMN IF EXISTS reservation_id;
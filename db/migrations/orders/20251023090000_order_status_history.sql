@@ -0,0 +1,21 @@
+-- migrate:up
+-- orders_db: audit trail of order status changes.
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    changed_by INTEGER,
+    reason TEXT,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id);
+
+-- Only the lifecycle states are accepted from now on; existing rows are left as they are
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('pending', 'paid', 'shipped', 'delivered', 'cancelled', 'refunded')) NOT VALID;
+
+-- migrate:down
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+DROP TABLE IF EXISTS order_status_history;
@@ -0,0 +1,6 @@
+-- migrate:up
+-- orders_db: tracks which items of a cancelled order had their stock returned.
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS restocked_at TIMESTAMP;
+
+-- migrate:down
+ALTER TABLE order_items DROP COLUMN IF EXISTS restocked_at;
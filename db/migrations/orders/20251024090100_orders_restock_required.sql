@@ -0,0 +1,8 @@
+-- migrate:up
+-- orders_db: cancelled orders whose stock is still being returned, scanned by
+-- the restock retry loop.
+CREATE INDEX IF NOT EXISTS idx_orders_restock_required ON orders(id)
+    WHERE (metadata->>'restock_required')::boolean;
+
+-- migrate:down
+DROP INDEX IF EXISTS idx_orders_restock_required;
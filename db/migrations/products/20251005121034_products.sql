@@ -0,0 +1,25 @@
+-- migrate:up
+-- products_db: the product catalog.
+CREATE TABLE IF NOT EXISTS products (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    price DECIMAL(10, 2) NOT NULL,
+    stock_quantity INTEGER NOT NULL DEFAULT 0,
+    category VARCHAR(100),
+    tags TEXT[],
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- GIN index for full-text search on products (name + description)
+CREATE INDEX IF NOT EXISTS idx_products_search ON products USING GIN(to_tsvector('english', name || ' ' || COALESCE(description, '')));
+
+-- GIN index for array search on tags
+CREATE INDEX IF NOT EXISTS idx_products_tags ON products USING GIN(tags);
+
+-- Regular B-tree index for category filtering
+CREATE INDEX IF NOT EXISTS idx_products_category ON products(category);
+
+-- migrate:down
+DROP TABLE IF EXISTS products;
@@ -0,0 +1,25 @@
+-- migrate:up
+-- products_db: time-limited stock holds.
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id SERIAL PRIMARY KEY,
+    reference VARCHAR(255) UNIQUE,
+    status VARCHAR(20) NOT NULL DEFAULT 'held',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS stock_reservation_items (
+    id SERIAL PRIMARY KEY,
+    reservation_id INTEGER NOT NULL REFERENCES stock_reservations(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0)
+);
+
+-- The sweeper looks for held reservations past their expiry
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_expiry ON stock_reservations(expires_at) WHERE status = 'held';
+CREATE INDEX IF NOT EXISTS idx_stock_reservation_items_reservation_id ON stock_reservation_items(reservation_id);
+
+-- migrate:down
+DROP TABLE IF EXISTS stock_reservation_items;
+DROP TABLE IF EXISTS stock_reservations;
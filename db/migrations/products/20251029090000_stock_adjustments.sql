@@ -0,0 +1,12 @@
+-- migrate:up
+-- products_db: stock adjustments made with a caller reference, so that a
+-- repeated request is applied once.
+CREATE TABLE IF NOT EXISTS stock_adjustments (
+    reference VARCHAR(255) PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- migrate:down
+DROP TABLE IF EXISTS stock_adjustments;
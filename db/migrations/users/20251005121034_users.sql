@@ -1,4 +1,5 @@
 -- migrate:up
+-- users_db: registered users.
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     email VARCHAR(255) UNIQUE NOT NULL,
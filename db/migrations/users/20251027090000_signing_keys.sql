@@ -0,0 +1,16 @@
+-- migrate:up
+-- users_db: keys user-service signs access tokens with. The newest key whose
+-- activates_at has passed signs; older keys stay published in the JWKS until
+-- their retires_at plus the grace period, so tokens they signed remain valid.
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL,
+    -- PKCS #8, PEM encoded, sealed with AES-GCM under JWT_KEY_ENCRYPTION_KEY
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    activates_at TIMESTAMP NOT NULL,
+    retires_at TIMESTAMP
+);
+
+-- migrate:down
+DROP TABLE IF EXISTS signing_keys;
@@ -0,0 +1,45 @@
+-- migrate:up
+-- users_db: roles, the permissions they grant and the users they are granted
+-- to. Permissions end up in the access token, so role changes apply to
+-- tokens issued afterwards.
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    permission VARCHAR(100) NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+    granted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    granted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_roles_role ON user_roles(role);
+
+INSERT INTO roles (name, description) VALUES
+    ('admin', 'Full access, including granting roles'),
+    ('catalog_manager', 'Creates products and manages stock'),
+    ('order_manager', 'Moves orders through their statuses')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'products:write'),
+    ('admin', 'products:stock'),
+    ('admin', 'orders:status'),
+    ('admin', 'roles:manage'),
+    ('catalog_manager', 'products:write'),
+    ('catalog_manager', 'products:stock'),
+    ('order_manager', 'orders:status')
+ON CONFLICT DO NOTHING;
+
+-- migrate:down
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/authz"
+)
+
+var (
+	errForbidden        = errors.New("forbidden")
+	errOrderBeingPlaced = errors.New("order is still being placed, try again shortly")
+)
+
+const (
+	restockRetryInterval = time.Minute
+	restockRetryBatch    = 100
+)
+
+// cancelOrder moves an order to cancelled and flags it for restocking. It is
+// a no-op for an order that is already cancelled.
+func cancelOrder(ctx context.Context, orderID int, caller *authz.Identity, reason string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var ownerID int
+	err = tx.QueryRowContext(ctx, `SELECT status, user_id FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(&status, &ownerID)
+	if err == sql.ErrNoRows {
+		return errOrderNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !caller.CanAccess(ownerID) {
+		return errForbidden
+	}
+	if status == statusCancelled {
+		return nil
+	}
+	if status != statusPending && status != statusPaid {
+		return &invalidTransitionError{From: status, To: statusCancelled}
+	}
+
+	// Stock of an order still being placed is owned by its saga
+	var sagaStatus string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status FROM order_sagas WHERE order_id = $1 ORDER BY id DESC LIMIT 1
+	`, orderID).Scan(&sagaStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if sagaStatus == sagaRunning || sagaStatus == sagaCompensating {
+		return errOrderBeingPlaced
+	}
+
+	if _, err := transitionOrderStatus(ctx, tx, orderID, statusCancelled, caller.UserID, reason); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders
+		SET metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object(
+			'cancellation_reason', $1::text,
+			'cancelled_by', $2::int,
+			'cancelled_at', to_char(NOW() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			'restock_required', true)
+		WHERE id = $3
+	`, reason, caller.UserID, orderID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// restockCancelledOrder returns the stock of every item of a cancelled order
+// that has not been returned yet, and marks the items once product-service
+// confirms. Each item is restocked with its own reference, so retries and
+// concurrent calls never credit it twice, even after a timeout or a crash.
+// Once every item is back the order's restock_required flag is cleared.
+func restockCancelledOrder(ctx context.Context, orderID int) error {
+	var restockRequired bool
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE((metadata->>'restock_required')::boolean, false) FROM orders WHERE id = $1
+	`, orderID).Scan(&restockRequired)
+	if err != nil || !restockRequired {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, product_id, quantity FROM order_items
+		WHERE order_id = $1 AND restocked_at IS NULL
+		ORDER BY id
+	`, orderID)
+	if err != nil {
+		return err
+	}
+	var items []OrderItem
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.Quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+
+	for _, item := range items {
+		reference := fmt.Sprintf("order-item-%d-restock", item.ID)
+		if err := updateProductStock(ctx, item.ProductID, item.Quantity, reference); err != nil {
+			return fmt.Errorf("restock product %d: %w", item.ProductID, err)
+		}
+		_, err := db.ExecContext(ctx, `
+			UPDATE order_items SET restocked_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND restocked_at IS NULL
+		`, item.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE orders SET metadata = metadata || jsonb_build_object('restock_required', false)
+		WHERE id = $1 AND NOT EXISTS (
+			SELECT 1 FROM order_items WHERE order_id = $1 AND restocked_at IS NULL
+		)
+	`, orderID)
+	return err
+}
+
+// retryRestocks finishes restocking cancelled orders whose stock could not
+// all be returned when they were cancelled, e.g. because product-service was
+// unreachable. Restocking is idempotent, so racing the cancel handler or
+// another instance is harmless.
+func retryRestocks(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM orders
+		WHERE (metadata->>'restock_required')::boolean
+		ORDER BY id
+		LIMIT $1
+	`, restockRetryBatch)
+	if err != nil {
+		slog.Error("Restock retry failed", "error", err)
+		return
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := restockCancelledOrder(ctx, id); err != nil {
+			slog.Warn("Order restock incomplete, will retry", "order_id", id, "error", err)
+			continue
+		}
+		slog.Info("Order restocked", "order_id", id)
+	}
+}
+
+// runRestockRetries runs retryRestocks at startup and then periodically
+// until ctx is cancelled.
+func runRestockRetries(ctx context.Context) {
+	ticker := time.NewTicker(restockRetryInterval)
+	defer ticker.Stop()
+	for {
+		retryRestocks(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cancelOrderHandler cancels a pending or paid order and gives its stock
+// back. Repeating the call is safe: it finishes any restocking left over
+// from an earlier attempt and otherwise does nothing.
+func cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "cancelled by customer"
+	}
+
+	err = cancelOrder(r.Context(), orderID, authz.FromContext(r.Context()), req.Reason)
+	var transitionErr *invalidTransitionError
+	switch {
+	case err == errOrderNotFound:
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	case err == errForbidden:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	case err == errOrderBeingPlaced:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.As(err, &transitionErr):
+		http.Error(w, fmt.Sprintf("Order cannot be cancelled once %s", transitionErr.From), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := restockCancelledOrder(context.WithoutCancel(r.Context()), orderID); err != nil {
+		slog.ErrorContext(r.Context(), "Order restock incomplete", "order_id", orderID, "error", err)
+		http.Error(w, "Order cancelled but restocking failed, retry the request", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Order cancelled successfully",
+		"order_id": orderID,
+		"status":   statusCancelled,
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+const (
+	lockOrder       = `SELECT status, user_id FROM orders WHERE id = \$1 FOR UPDATE`
+	latestSaga      = `SELECT status FROM order_sagas WHERE order_id = \$1`
+	flagRestock     = `'restock_required', true\)`
+	restockRequired = `SELECT COALESCE\(\(metadata->>'restock_required'\)::boolean, false\) FROM orders`
+	pendingItems    = `SELECT id, product_id, quantity FROM order_items\s+WHERE order_id = \$1 AND restocked_at IS NULL`
+	markRestocked   = `UPDATE order_items SET restocked_at = CURRENT_TIMESTAMP`
+	clearRestock    = `UPDATE orders SET metadata = metadata \|\| jsonb_build_object\('restock_required', false\)`
+)
+
+// expectRestock expects order 10 to be restocked: the items not returned yet
+// are read, the ones in restocked marked, and the flag cleared if all were.
+func expectRestock(mock sqlmock.Sqlmock, items [][3]int, restocked ...int) {
+	mock.ExpectQuery(restockRequired).WithArgs(10).WillReturnRows(sqlmock.NewRows([]string{"flag"}).AddRow(true))
+	rows := sqlmock.NewRows([]string{"id", "product_id", "quantity"})
+	for _, item := range items {
+		rows.AddRow(item[0], item[1], item[2])
+	}
+	mock.ExpectQuery(pendingItems).WithArgs(10).WillReturnRows(rows)
+	for _, id := range restocked {
+		mock.ExpectExec(markRestocked).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	if len(restocked) == len(items) {
+		mock.ExpectExec(clearRestock).WithArgs(10).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+}
+
+func TestCancelOrderHandler(t *testing.T) {
+	orderRow := func(status string, owner int) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"status", "user_id"}).AddRow(status, owner)
+	}
+
+	tests := []struct {
+		name       string
+		expect     func(mock sqlmock.Sqlmock)
+		stock      map[string]stubResponse
+		wantStatus int
+		wantCalls  []string
+	}{
+		{
+			name: "pending order",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WithArgs(10).WillReturnRows(orderRow(statusPending, 7))
+				mock.ExpectQuery(latestSaga).WithArgs(10).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(sagaCompleted))
+				mock.ExpectQuery(transitionOrder).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(statusPending))
+				mock.ExpectExec(insertHistory).WithArgs(10, statusPending, statusCancelled, 7, "changed my mind").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(insertOutbox).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(flagRestock).WithArgs("changed my mind", 7, 10).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectRestock(mock, [][3]int{{20, 3, 2}, {21, 4, 1}}, 20, 21)
+			},
+			stock: map[string]stubResponse{
+				"PATCH /api/v2/products/3/stock": {http.StatusOK, `{}`},
+				"PATCH /api/v2/products/4/stock": {http.StatusOK, `{}`},
+			},
+			wantStatus: http.StatusOK,
+			wantCalls:  []string{"PATCH /api/v2/products/3/stock", "PATCH /api/v2/products/4/stock"},
+		},
+		{
+			name: "restock fails",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WillReturnRows(orderRow(statusPaid, 7))
+				mock.ExpectQuery(latestSaga).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(sagaCompleted))
+				mock.ExpectQuery(transitionOrder).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(statusPaid))
+				mock.ExpectExec(insertHistory).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(insertOutbox).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(flagRestock).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				// The first item is returned, the second is left to a retry
+				expectRestock(mock, [][3]int{{20, 3, 2}, {21, 4, 1}}, 20)
+			},
+			stock: map[string]stubResponse{
+				"PATCH /api/v2/products/3/stock": {http.StatusOK, `{}`},
+				"PATCH /api/v2/products/4/stock": {http.StatusServiceUnavailable, ""},
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCalls:  []string{"PATCH /api/v2/products/3/stock", "PATCH /api/v2/products/4/stock"},
+		},
+		{
+			name: "already cancelled finishes restocking",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WillReturnRows(orderRow(statusCancelled, 7))
+				mock.ExpectRollback()
+				expectRestock(mock, [][3]int{{21, 4, 1}}, 21)
+			},
+			stock:      map[string]stubResponse{"PATCH /api/v2/products/4/stock": {http.StatusOK, `{}`}},
+			wantStatus: http.StatusOK,
+			wantCalls:  []string{"PATCH /api/v2/products/4/stock"},
+		},
+		{
+			name: "missing order",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WillReturnRows(sqlmock.NewRows([]string{"status", "user_id"}))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "another user's order",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WillReturnRows(orderRow(statusPending, 8))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "shipped order",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WillReturnRows(orderRow(statusShipped, 7))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name: "order still being placed",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockOrder).WillReturnRows(orderRow(statusPending, 7))
+				mock.ExpectQuery(latestSaga).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(sagaRunning))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			stub := newProductStub(t, tt.stock)
+			tt.expect(mock)
+
+			r := httptest.NewRequest("POST", "/api/orders/10/cancel", strings.NewReader(`{"reason": "changed my mind"}`))
+			r = mux.SetURLVars(r, map[string]string{"id": "10"})
+			w := serveAsUser(t, cancelOrderHandler, r, 7)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if calls := stub.Calls(); !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("product-service calls %v, want %v", calls, tt.wantCalls)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRestockCancelledOrderWithoutFlag(t *testing.T) {
+	mock := useMockDB(t)
+	stub := newProductStub(t, nil)
+	mock.ExpectQuery(restockRequired).WithArgs(10).WillReturnRows(sqlmock.NewRows([]string{"flag"}).AddRow(false))
+
+	if err := restockCancelledOrder(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stub.Calls(); len(calls) != 0 {
+		t.Errorf("order without restock_required restocked: %v", calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetryRestocks(t *testing.T) {
+	mock := useMockDB(t)
+	stub := newProductStub(t, map[string]stubResponse{
+		"PATCH /api/v2/products/3/stock": {http.StatusServiceUnavailable, ""},
+		"PATCH /api/v2/products/4/stock": {http.StatusOK, `{}`},
+	})
+
+	mock.ExpectQuery(`SELECT id FROM orders\s+WHERE \(metadata->>'restock_required'\)::boolean`).WithArgs(restockRetryBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10).AddRow(11))
+	// Order 10 still fails and stays flagged
+	expectRestock(mock, [][3]int{{20, 3, 2}})
+	// Order 11 is restocked and its flag cleared
+	mock.ExpectQuery(restockRequired).WithArgs(11).WillReturnRows(sqlmock.NewRows([]string{"flag"}).AddRow(true))
+	mock.ExpectQuery(pendingItems).WithArgs(11).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "quantity"}).AddRow(22, 4, 1))
+	mock.ExpectExec(markRestocked).WithArgs(22).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(clearRestock).WithArgs(11).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	retryRestocks(context.Background())
+
+	want := []string{"PATCH /api/v2/products/3/stock", "PATCH /api/v2/products/4/stock"}
+	if calls := stub.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("product-service calls %v, want %v", calls, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"shared/authz"
+	"shared/config"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+	// idempotencyLockTimeout is how long a key may stay claimed without a
+	// stored response before another request is allowed to take it over,
+	// e.g. after the process handling the first request crashed.
+	idempotencyLockTimeout     = 2 * time.Minute
+	idempotencyCleanupInterval = 10 * time.Minute
+)
+
+var idempotencyKeyTTL = 24 * time.Hour
+
+func initIdempotency(conf *config.Loader) {
+	idempotencyKeyTTL = conf.Duration("IDEMPOTENCY_KEY_TTL", idempotencyKeyTTL)
+}
+
+// captureWriter passes the response through while keeping a copy of it.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	cw.status = status
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.body.Write(p)
+	return cw.ResponseWriter.Write(p)
+}
+
+// claimIdempotencyKey tries to reserve key for the current request. It
+// returns true when the caller owns the key and must execute the request.
+func claimIdempotencyKey(ctx context.Context, userID int, key, requestHash string) (bool, error) {
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = NULL,
+		    response_body = NULL, created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW()
+		   OR (idempotency_keys.status_code IS NULL
+		       AND idempotency_keys.request_hash = EXCLUDED.request_hash
+		       AND idempotency_keys.created_at < NOW() - make_interval(secs => $5))
+	`, userID, key, requestHash, idempotencyKeyTTL.Seconds(), idempotencyLockTimeout.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// withIdempotency makes a handler safe to retry: the first response for an
+// Idempotency-Key is stored and replayed for later requests with the same key
+// and body, a different body with the same key is rejected with 422, and a
+// key whose first request is still running is answered with 409.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(headerIdempotencyKey)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		requestHash := idempotencyRequestHash(r.Method, r.URL.Path, body)
+		userID := authz.FromContext(r.Context()).UserID
+
+		claimed, err := claimIdempotencyKey(r.Context(), userID, key, requestHash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !claimed {
+			replayIdempotentResponse(r.Context(), w, userID, key, requestHash)
+			return
+		}
+
+		cw := &captureWriter{ResponseWriter: w}
+		next(cw, r)
+
+		// The outcome is recorded even if the client has gone away meanwhile,
+		// so its retry gets the response instead of executing again
+		ctx := context.WithoutCancel(r.Context())
+
+		// Server errors are not stored so the client can retry with the same key
+		if cw.status >= http.StatusInternalServerError {
+			_, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`, userID, key)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to release idempotency key", "idempotency_key", key, "error", err)
+			}
+			return
+		}
+
+		_, err = db.ExecContext(ctx, `
+			UPDATE idempotency_keys
+			SET status_code = $1, content_type = $2, response_body = $3
+			WHERE user_id = $4 AND key = $5
+		`, cw.status, cw.Header().Get("Content-Type"), cw.body.String(), userID, key)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to store response for idempotency key", "idempotency_key", key, "error", err)
+		}
+	}
+}
+
+// idempotencyRequestHash identifies the request a key was first used with.
+func idempotencyRequestHash(method, path string, body []byte) string {
+	sum := sha256.Sum256(append([]byte(method+" "+path+"\n"), body...))
+	return hex.EncodeToString(sum[:])
+}
+
+func replayIdempotentResponse(ctx context.Context, w http.ResponseWriter, userID int, key, requestHash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var contentType, body sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT request_hash, status_code, content_type, response_body
+		FROM idempotency_keys WHERE user_id = $1 AND key = $2
+	`, userID, key).Scan(&storedHash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// The owner failed and released the key in the meantime
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Request with this Idempotency-Key is being retried, try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if storedHash != requestHash {
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !status.Valid {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+
+	if contentType.String != "" {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	io.WriteString(w, body.String)
+}
+
+// deleteExpiredIdempotencyKeys removes the keys past their TTL and returns
+// how many there were.
+func deleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// runIdempotencyCleanup periodically deletes expired idempotency keys until
+// ctx is cancelled.
+func runIdempotencyCleanup(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := deleteExpiredIdempotencyKeys(ctx)
+		if err != nil {
+			slog.Error("Idempotency key cleanup failed", "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Deleted expired idempotency keys", "count", n)
+		}
+	}
+}
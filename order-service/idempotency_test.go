@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"shared/authz"
+	"shared/config"
+)
+
+const testServiceToken = "test-service-token-0123456789abcdef"
+
+// serveAsUser serves r with handler as if the gateway forwarded it for userID.
+func serveAsUser(t *testing.T, handler http.HandlerFunc, r *http.Request, userID int) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Setenv(config.FileEnv, "")
+	t.Setenv("SERVICE_TOKEN", testServiceToken)
+	conf, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz.Setup(conf)
+
+	r.Header.Set(authz.HeaderUserID, strconv.Itoa(userID))
+	authz.SetToken(r.Header)
+	w := httptest.NewRecorder()
+	authz.RequireIdentity(handler).ServeHTTP(w, r)
+	return w
+}
+
+const (
+	claimKey      = `INSERT INTO idempotency_keys \(user_id, key, request_hash, expires_at\)`
+	selectKey     = `SELECT request_hash, status_code, content_type, response_body\s+FROM idempotency_keys`
+	storeResponse = `UPDATE idempotency_keys\s+SET status_code = \$1, content_type = \$2, response_body = \$3`
+	releaseKey    = `DELETE FROM idempotency_keys WHERE user_id = \$1 AND key = \$2`
+)
+
+const orderBody = `{"items": [{"product_id": 3, "quantity": 2}]}`
+
+func TestWithIdempotency(t *testing.T) {
+	hash := idempotencyRequestHash("POST", "/api/orders", []byte(orderBody))
+	keyRow := func(hash string, status interface{}, body string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"request_hash", "status_code", "content_type", "response_body"}).
+			AddRow(hash, status, "application/json", body)
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		handler    int // status the order handler answers with
+		expect     func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantBody   string
+		wantCalled bool
+		replayed   bool
+	}{
+		{
+			name:       "no key",
+			handler:    http.StatusCreated,
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusCreated,
+			wantCalled: true,
+		},
+		{
+			name:    "first request stores the response",
+			key:     "k1",
+			handler: http.StatusCreated,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WithArgs(7, "k1", hash, idempotencyKeyTTL.Seconds(), idempotencyLockTimeout.Seconds()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(storeResponse).WithArgs(http.StatusCreated, "application/json", `{"id": 1}`, 7, "k1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id": 1}`,
+			wantCalled: true,
+		},
+		{
+			name:    "replay",
+			key:     "k1",
+			handler: http.StatusCreated,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(selectKey).WithArgs(7, "k1").WillReturnRows(keyRow(hash, http.StatusCreated, `{"id": 1}`))
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id": 1}`,
+			replayed:   true,
+		},
+		{
+			name:    "different body",
+			key:     "k1",
+			handler: http.StatusCreated,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(selectKey).WillReturnRows(keyRow("other", http.StatusCreated, `{"id": 1}`))
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "still in flight",
+			key:     "k1",
+			handler: http.StatusCreated,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(selectKey).WillReturnRows(keyRow(hash, nil, ""))
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:    "released by a failed owner",
+			key:     "k1",
+			handler: http.StatusCreated,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(selectKey).WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "content_type", "response_body"}))
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:    "server error releases the key",
+			key:     "k1",
+			handler: http.StatusBadGateway,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(releaseKey).WithArgs(7, "k1").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCalled: true,
+		},
+		{
+			name:    "client error is stored",
+			key:     "k1",
+			handler: http.StatusConflict,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(storeResponse).WithArgs(http.StatusConflict, "application/json", `{"id": 1}`, 7, "k1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusConflict,
+			wantCalled: true,
+		},
+		{
+			name:       "key too long",
+			key:        strings.Repeat("k", maxIdempotencyKeyLen+1),
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			tt.expect(mock)
+
+			called := false
+			handler := withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.handler)
+				w.Write([]byte(`{"id": 1}`))
+			})
+			r := httptest.NewRequest("POST", "/api/orders", strings.NewReader(orderBody))
+			if tt.key != "" {
+				r.Header.Set(headerIdempotencyKey, tt.key)
+			}
+			w := serveAsUser(t, handler, r, 7)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", w.Body, tt.wantBody)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("handler called: %v, want %v", called, tt.wantCalled)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+				t.Errorf("replayed: %v, want %v", replayed, tt.replayed)
+			}
+			if w.Code == http.StatusConflict && !tt.wantCalled && w.Header().Get("Retry-After") == "" {
+				t.Error("409 without Retry-After")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWithIdempotencyStoresResponseAfterDisconnect(t *testing.T) {
+	mock := useMockDB(t)
+	mock.ExpectExec(claimKey).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(storeResponse).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		// The client gives up once the order is placed
+		cancel()
+		w.WriteHeader(http.StatusCreated)
+	})
+	r := httptest.NewRequestWithContext(ctx, "POST", "/api/orders", strings.NewReader(orderBody))
+	r.Header.Set(headerIdempotencyKey, "k1")
+	serveAsUser(t, handler, r, 7)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("response not stored: %v", err)
+	}
+}
+
+func TestDeleteExpiredIdempotencyKeys(t *testing.T) {
+	mock := useMockDB(t)
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE expires_at < NOW\(\)`).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := deleteExpiredIdempotencyKeys(context.Background())
+	if err != nil || n != 3 {
+		t.Errorf("cleanup = %d, %v, want 3 keys", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
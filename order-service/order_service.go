@@ -1,16 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"shared/authz"
+	"shared/config"
+	"shared/discovery"
+	"shared/graceful"
+	"shared/health"
+	"shared/logging"
+	"shared/metrics"
+	"shared/outbox"
+	"shared/tracing"
+	"shared/versioning"
 )
 
 var db *sql.DB
@@ -32,6 +48,8 @@ type OrderItem struct {
 }
 
 type CreateOrderRequest struct {
+	// UserID is optional and defaults to the authenticated user. Only admins
+	// may place orders on behalf of someone else.
 	UserID int `json:"user_id"`
 	Items  []struct {
 		ProductID int `json:"product_id"`
@@ -39,27 +57,75 @@ type CreateOrderRequest struct {
 	} `json:"items"`
 }
 
+// validate rejects requests the placement saga could only fail on, before
+// an order is created for them.
+func (req *CreateOrderRequest) validate() error {
+	if len(req.Items) == 0 {
+		return errors.New("at least one item is required")
+	}
+	for i, item := range req.Items {
+		if item.ProductID <= 0 {
+			return fmt.Errorf("item %d: invalid product_id", i)
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("item %d: quantity must be positive", i)
+		}
+	}
+	return nil
+}
+
 type Product struct {
 	ID            int     `json:"id"`
 	Price         float64 `json:"price"`
 	StockQuantity int     `json:"stock_quantity"`
 }
 
-func initDB() {
-	connStr := "host=postgres port=5432 user=postgres password=postgres dbname=orders_db sslmode=disable"
+func initDB(conf config.Database) {
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	connector, err := pq.NewConnector(conf.DSN())
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Invalid database settings", "error", err)
 	}
+	db = tracing.OpenDB(connector)
 	if err = db.Ping(); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to connect to database", "database", conf.Name, "error", err)
 	}
-	log.Println("Connected to orders database")
+	slog.Info("Connected to database", "database", conf.Name)
+}
+
+func startOutboxRelay(ctx context.Context, kind, channel string) *outbox.Relay {
+	sink, err := outbox.NewSink(kind, db, channel)
+	if err != nil {
+		logging.Fatal("Failed to create outbox sink", "sink", kind, "error", err)
+	}
+	relay := &outbox.Relay{DB: db, Sink: sink, Source: "order-service"}
+	go relay.Run(ctx)
+	return relay
+}
+
+// Product service location and client used for all calls to it. Calls go
+// to the v2 API, whose products and reservations match what is decoded here.
+// Stock changes are made as order-service, granted authz.StockWrite.
+var productServiceURL = "http://localhost:8002"
+var productClient = &http.Client{Timeout: 10 * time.Second, Transport: tracing.Transport(nil)}
+
+// productServiceError is returned when product-service answers with a non-success status.
+type productServiceError struct {
+	StatusCode int
+	Message    string
 }
 
-func getProductFromService(productID int) (*Product, error) {
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8002/api/products/%d", productID))
+func (e *productServiceError) Error() string {
+	return fmt.Sprintf("product-service returned %d: %s", e.StatusCode, e.Message)
+}
+
+func getProductFromService(ctx context.Context, productID int) (*Product, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/v2/products/%d", productServiceURL, productID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := productClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -77,19 +143,22 @@ func getProductFromService(productID int) (*Product, error) {
 	return &product, nil
 }
 
-func updateProductStock(productID, quantity int) error {
-	reqBody, _ := json.Marshal(map[string]int{"quantity": quantity})
-	req, err := http.NewRequest("PATCH",
-		fmt.Sprintf("http://localhost:8002/api/products/%d/stock", productID),
-		io.NopCloser(io.NopCloser(io.NopCloser(jsonReader{reqBody}))))
+// updateProductStock adjusts the stock of a product by quantity.
+// product-service applies an adjustment once per reference, so a call that
+// failed or timed out can be retried with the same reference.
+func updateProductStock(ctx context.Context, productID, quantity int, reference string) error {
+	reqBody, _ := json.Marshal(map[string]interface{}{"quantity": quantity, "reference": reference})
+	req, err := http.NewRequestWithContext(ctx, "PATCH",
+		fmt.Sprintf("%s/api/v2/products/%d/stock", productServiceURL, productID),
+		bytes.NewReader(reqBody))
 
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	authz.SetService(req.Header, "order-service", authz.StockWrite)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := productClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -102,17 +171,90 @@ func updateProductStock(productID, quantity int) error {
 	return nil
 }
 
-type jsonReader struct {
-	data []byte
+// Reservation mirrors the product-service stock reservation.
+type Reservation struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
 }
 
-func (jr jsonReader) Read(p []byte) (n int, err error) {
-	if len(jr.data) == 0 {
-		return 0, io.EOF
+// callReservationAPI sends a reservation request to product-service and
+// decodes the reservation it returns.
+func callReservationAPI(ctx context.Context, method, path string, body interface{}) (*Reservation, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, productServiceURL+"/api/v2/products/reservations"+path, reqBody)
+	if err != nil {
+		return nil, err
 	}
-	n = copy(p, jr.data)
-	jr.data = jr.data[n:]
-	return n, nil
+	req.Header.Set("Content-Type", "application/json")
+	authz.SetService(req.Header, "order-service", authz.StockWrite)
+
+	resp, err := productClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &productServiceError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	var reservation Reservation
+	if err := json.NewDecoder(resp.Body).Decode(&reservation); err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// reserveStock holds stock for all items at once. Reusing a reference returns
+// the reservation made earlier instead of holding the stock twice.
+func reserveStock(ctx context.Context, reference string, items []OrderItem) (*Reservation, error) {
+	type reserveItem struct {
+		ProductID int `json:"product_id"`
+		Quantity  int `json:"quantity"`
+	}
+	body := struct {
+		Reference string        `json:"reference"`
+		Items     []reserveItem `json:"items"`
+	}{Reference: reference}
+	for _, item := range items {
+		body.Items = append(body.Items, reserveItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+
+	return callReservationAPI(ctx, "POST", "", body)
+}
+
+// findReservation returns the reservation made with reference, or nil if
+// product-service never created one.
+func findReservation(ctx context.Context, reference string) (*Reservation, error) {
+	reservation, err := callReservationAPI(ctx, "GET", "?reference="+url.QueryEscape(reference), nil)
+	var psErr *productServiceError
+	if errors.As(err, &psErr) && psErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return reservation, err
+}
+
+func getReservation(ctx context.Context, reservationID int) (*Reservation, error) {
+	return callReservationAPI(ctx, "GET", fmt.Sprintf("/%d", reservationID), nil)
+}
+
+func confirmReservation(ctx context.Context, reservationID int) error {
+	_, err := callReservationAPI(ctx, "POST", fmt.Sprintf("/%d/confirm", reservationID), nil)
+	return err
+}
+
+func releaseReservation(ctx context.Context, reservationID int) error {
+	_, err := callReservationAPI(ctx, "POST", fmt.Sprintf("/%d/release", reservationID), nil)
+	return err
 }
 
 func createOrderHandler(w http.ResponseWriter, r *http.Request) {
@@ -121,13 +263,26 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	caller := authz.FromContext(r.Context())
+	if req.UserID == 0 {
+		req.UserID = caller.UserID
+	}
+	if !caller.CanAccess(req.UserID) {
+		http.Error(w, "Cannot create orders for another user", http.StatusForbidden)
+		return
+	}
 
 	// Validate products and calculate total
 	var totalAmount float64
 	var orderItems []OrderItem
 
 	for _, item := range req.Items {
-		product, err := getProductFromService(item.ProductID)
+		product, err := getProductFromService(r.Context(), item.ProductID)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Product %d not found", item.ProductID), http.StatusBadRequest)
 			return
@@ -148,8 +303,8 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	// Create order in transaction
-	tx, err := db.Begin()
+	// Create order, items and saga state in one transaction
+	tx, err := db.BeginTx(r.Context(), nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -157,20 +312,25 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	var orderID int
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(r.Context(), `
 		INSERT INTO orders (user_id, status, total_amount) 
 		VALUES ($1, $2, $3) 
 		RETURNING id
-	`, req.UserID, "pending", totalAmount).Scan(&orderID)
+	`, req.UserID, statusPending, totalAmount).Scan(&orderID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := recordStatusChange(r.Context(), tx, orderID, "", statusPending, caller.UserID, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Insert order items
 	for _, item := range orderItems {
-		_, err := tx.Exec(`
+		_, err := tx.ExecContext(r.Context(), `
 			INSERT INTO order_items (order_id, product_id, quantity, price) 
 			VALUES ($1, $2, $3, $4)
 		`, orderID, item.ProductID, item.Quantity, item.Price)
@@ -179,12 +339,12 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+	}
 
-		// Update stock in product service
-		if err := updateProductStock(item.ProductID, -item.Quantity); err != nil {
-			http.Error(w, "Failed to update product stock", http.StatusInternalServerError)
-			return
-		}
+	saga, err := startOrderSaga(r.Context(), tx, orderID, orderItems)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -192,6 +352,19 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Reserve and confirm stock in product service; failed sagas release the hold.
+	// The saga outlives a client that disconnects, keeping only the trace.
+	if err := saga.run(context.WithoutCancel(r.Context())); err != nil {
+		slog.WarnContext(r.Context(), "Order saga failed", "order_id", orderID, "saga_id", saga.ID, "error", err)
+		var psErr *productServiceError
+		if errors.As(err, &psErr) && (psErr.StatusCode == http.StatusConflict || psErr.StatusCode == http.StatusNotFound) {
+			http.Error(w, psErr.Message, psErr.StatusCode)
+			return
+		}
+		http.Error(w, "Failed to reserve product stock", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -206,7 +379,7 @@ func getOrderHandler(w http.ResponseWriter, r *http.Request) {
 	orderID := vars["id"]
 
 	var order Order
-	err := db.QueryRow(`
+	err := db.QueryRowContext(r.Context(), `
 		SELECT id, user_id, status, total_amount, created_at 
 		FROM orders WHERE id = $1
 	`, orderID).Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.CreatedAt)
@@ -216,8 +389,13 @@ func getOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authz.FromContext(r.Context()).CanAccess(order.UserID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	// Get order items
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(r.Context(), `
 		SELECT id, product_id, quantity, price 
 		FROM order_items WHERE order_id = $1
 	`, orderID)
@@ -241,9 +419,18 @@ func getOrderHandler(w http.ResponseWriter, r *http.Request) {
 
 func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	userID := vars["user_id"]
+	userID, err := strconv.Atoi(vars["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
 
-	rows, err := db.Query(`
+	if !authz.FromContext(r.Context()).CanAccess(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
 		SELECT id, user_id, status, total_amount, created_at 
 		FROM orders WHERE user_id = $1 
 		ORDER BY created_at DESC
@@ -267,55 +454,86 @@ func getUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(orders)
 }
 
-func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	orderID := vars["id"]
+// requiredMigrations are the dbmate versions whose schema this service uses.
+// Readiness fails until all of them are applied.
+var requiredMigrations = []string{
+	"20251005121034",
+	"20251020090000",
+	"20251021090100",
+	"20251022090000",
+	"20251023090000",
+	"20251024090000",
+	"20251024090100",
+	"20251025090000",
+}
 
-	var req struct {
-		Status string `json:"status"`
+func main() {
+	conf, err := config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	logging.Setup(conf, "order-service")
+	dbConf := conf.Database("orders_db")
+	server := conf.Server(8003)
+	productServiceURL = conf.URL("PRODUCT_SERVICE_URL", productServiceURL)
+	productClient.Timeout = conf.Duration("PRODUCT_SERVICE_TIMEOUT", productClient.Timeout)
+	initIdempotency(conf)
+	outboxSink := conf.OneOf("OUTBOX_SINK", "log", outbox.SinkKinds...)
+	outboxChannel := conf.String("OUTBOX_CHANNEL", "outbox_events")
+	authz.Setup(conf)
+	registration := discovery.FromConfig(conf, "order-service", server)
+	checker := health.FromConfig(conf, "order-service")
+	shutdownTracing := tracing.Setup(conf, "order-service")
+	if err := conf.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
 	}
 
-	result, err := db.Exec(`
-		UPDATE orders 
-		SET status = $1, updated_at = CURRENT_TIMESTAMP 
-		WHERE id = $2
-	`, req.Status, orderID)
+	ctx, stop := graceful.SignalContext()
+	defer stop()
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	initDB(dbConf)
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		http.Error(w, "Order not found", http.StatusNotFound)
-		return
-	}
+	checker.Add("database", health.Database(db))
+	checker.Add("migrations", health.Migrations(db, requiredMigrations...))
+	metrics.RegisterDB(db, dbConf.Name)
+	checker.Add("product-service", health.HTTP(productClient, productServiceURL+"/livez"))
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Order status updated successfully"})
-}
+	go runSagaRecovery(ctx)
+	go runRestockRetries(ctx)
+	go runIdempotencyCleanup(ctx)
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy", "service": "order-service"})
-}
-
-func main() {
-	initDB()
-	defer db.Close()
+	relay := startOutboxRelay(ctx, outboxSink, outboxChannel)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/health", healthHandler).Methods("GET")
-	r.HandleFunc("/api/orders", createOrderHandler).Methods("POST")
-	r.HandleFunc("/api/orders/{id}", getOrderHandler).Methods("GET")
-	r.HandleFunc("/api/orders/user/{user_id}", getUserOrdersHandler).Methods("GET")
-	r.HandleFunc("/api/orders/{id}/status", updateOrderStatusHandler).Methods("PATCH")
-
-	fmt.Println("Order Service running on :8003")
-	log.Fatal(http.ListenAndServe(":8003", r))
+	r.Use(tracing.Middleware)
+	r.Use(metrics.Middleware)
+	r.Use(logging.Middleware)
+	r.HandleFunc("/livez", checker.Liveness).Methods("GET")
+	r.HandleFunc("/readyz", checker.Readiness).Methods("GET")
+	r.HandleFunc("/health", checker.Readiness).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	api := versioning.New(r, "/api/orders", "v1")
+	api.Version(versioning.Version{Name: "v1"}, func(r *mux.Router) {
+		r.Use(authz.RequireIdentity)
+		r.HandleFunc("", withIdempotency(createOrderHandler)).Methods("POST")
+		r.HandleFunc("/{id}", getOrderHandler).Methods("GET")
+		r.HandleFunc("/user/{user_id}", getUserOrdersHandler).Methods("GET")
+		r.Handle("/{id}/status", authz.Require(authz.OrdersStatus, updateOrderStatusHandler)).Methods("PATCH")
+		r.HandleFunc("/{id}/history", getOrderHistoryHandler).Methods("GET")
+		r.HandleFunc("/{id}/cancel", cancelOrderHandler).Methods("POST")
+	})
+
+	deregistered := registration.Start(ctx)
+
+	slog.Info("Order Service running", "addr", server.Addr)
+	err = graceful.Run(ctx, server, r,
+		graceful.Cleanup{Name: "registry", Fn: deregistered},
+		graceful.Cleanup{Name: "outbox", Fn: relay.Flush},
+		graceful.Cleanup{Name: "tracing", Fn: shutdownTracing},
+		graceful.Cleanup{Name: "database", Fn: func(context.Context) error { return db.Close() }},
+	)
+	if err != nil {
+		logging.Fatal("Server failed to start", "error", err)
+	}
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"shared/authz"
+	"shared/outbox"
+)
+
+// Order lifecycle:
+//
+//	pending -> paid -> shipped -> delivered
+//	pending, paid            -> cancelled
+//	paid, shipped, delivered -> refunded
+const (
+	statusPending   = "pending"
+	statusPaid      = "paid"
+	statusShipped   = "shipped"
+	statusDelivered = "delivered"
+	statusCancelled = "cancelled"
+	statusRefunded  = "refunded"
+)
+
+var orderTransitions = map[string][]string{
+	statusPending:   {statusPaid, statusCancelled},
+	statusPaid:      {statusShipped, statusCancelled, statusRefunded},
+	statusShipped:   {statusDelivered, statusRefunded},
+	statusDelivered: {statusRefunded},
+	statusCancelled: {},
+	statusRefunded:  {},
+}
+
+var errOrderNotFound = errors.New("order not found")
+
+// invalidTransitionError is returned for a status change the lifecycle does not allow.
+type invalidTransitionError struct {
+	From, To string
+}
+
+func (e *invalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot change order status from %s to %s", e.From, e.To)
+}
+
+func isKnownStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionsTo lists the statuses an order may move to status from.
+func transitionsTo(status string) []string {
+	var from []string
+	for s := range orderTransitions {
+		if canTransition(s, status) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
+
+type StatusChange struct {
+	ID         int       `json:"id"`
+	FromStatus *string   `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  *int      `json:"changed_by"`
+	Reason     string    `json:"reason,omitempty"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// recordStatusChange appends to the order's status history. from is empty
+// for the initial status and changedBy is 0 for changes made by the service.
+func recordStatusChange(ctx context.Context, tx *sql.Tx, orderID int, from, to string, changedBy int, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, reason)
+		VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, 0), NULLIF($5, ''))
+	`, orderID, from, to, changedBy, reason)
+	return err
+}
+
+// transitionOrderStatus moves an order to status within tx if the lifecycle
+// allows it, records the change and returns the previous status. The UPDATE
+// checks the current status itself; only when it matches no row is the order
+// looked up again, to tell a missing order from a refused transition.
+func transitionOrderStatus(ctx context.Context, tx *sql.Tx, orderID int, status string, changedBy int, reason string) (string, error) {
+	var current string
+	err := tx.QueryRowContext(ctx, `
+		UPDATE orders o SET status = $1, updated_at = CURRENT_TIMESTAMP
+		FROM (SELECT id, status FROM orders WHERE id = $2 FOR UPDATE) prev
+		WHERE o.id = prev.id AND prev.status = ANY($3)
+		RETURNING prev.status
+	`, status, orderID, pq.Array(transitionsTo(status))).Scan(&current)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRowContext(ctx, `SELECT status FROM orders WHERE id = $1`, orderID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return "", errOrderNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+		return current, &invalidTransitionError{From: current, To: status}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := recordStatusChange(ctx, tx, orderID, current, status, changedBy, reason); err != nil {
+		return current, err
+	}
+
+	err = outbox.Write(ctx, tx, "order", orderID, outbox.OrderStatusChanged, map[string]interface{}{
+		"order_id":    orderID,
+		"from_status": current,
+		"to_status":   status,
+		"changed_by":  changedBy,
+		"reason":      reason,
+	})
+	return current, err
+}
+
+// orderOwner returns the user an order belongs to.
+func orderOwner(ctx context.Context, orderID int) (int, error) {
+	var userID int
+	err := db.QueryRowContext(ctx, `SELECT user_id FROM orders WHERE id = $1`, orderID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errOrderNotFound
+	}
+	return userID, err
+}
+
+func updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !isKnownStatus(req.Status) {
+		http.Error(w, fmt.Sprintf("Unknown order status %q", req.Status), http.StatusBadRequest)
+		return
+	}
+	// Only the cancel endpoint returns the stock of a cancelled order
+	if req.Status == statusCancelled {
+		http.Error(w, fmt.Sprintf("Cancel orders with POST /api/orders/%d/cancel", orderID), http.StatusBadRequest)
+		return
+	}
+
+	// Callers are granted authz.OrdersStatus, whoever owns the order
+	caller := authz.FromContext(r.Context())
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	previous, err := transitionOrderStatus(r.Context(), tx, orderID, req.Status, caller.UserID, req.Reason)
+	if err == errOrderNotFound {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	var transitionErr *invalidTransitionError
+	if errors.As(err, &transitionErr) {
+		http.Error(w, transitionErr.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":         "Order status updated successfully",
+		"previous_status": previous,
+		"status":          req.Status,
+	})
+}
+
+func getOrderHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	ownerID, err := orderOwner(r.Context(), orderID)
+	if err == errOrderNotFound {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authz.FromContext(r.Context()).CanAccess(ownerID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, from_status, to_status, changed_by, COALESCE(reason, ''), changed_at
+		FROM order_status_history WHERE order_id = $1
+		ORDER BY changed_at, id
+	`, orderID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []StatusChange{}
+	for rows.Next() {
+		var change StatusChange
+		var from sql.NullString
+		var changedBy sql.NullInt64
+		if err := rows.Scan(&change.ID, &from, &change.ToStatus, &changedBy, &change.Reason, &change.ChangedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if from.Valid {
+			change.FromStatus = &from.String
+		}
+		if changedBy.Valid {
+			id := int(changedBy.Int64)
+			change.ChangedBy = &id
+		}
+		history = append(history, change)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
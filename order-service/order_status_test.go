@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+var allStatuses = []string{statusPending, statusPaid, statusShipped, statusDelivered, statusCancelled, statusRefunded}
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]string]bool{
+		{statusPending, statusPaid}:       true,
+		{statusPending, statusCancelled}:  true,
+		{statusPaid, statusShipped}:       true,
+		{statusPaid, statusCancelled}:     true,
+		{statusPaid, statusRefunded}:      true,
+		{statusShipped, statusDelivered}:  true,
+		{statusShipped, statusRefunded}:   true,
+		{statusDelivered, statusRefunded}: true,
+	}
+	for _, from := range allStatuses {
+		for _, to := range allStatuses {
+			want := allowed[[2]string{from, to}]
+			if got := canTransition(from, to); got != want {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+	if canTransition("unknown", statusPaid) || canTransition(statusPending, "unknown") {
+		t.Error("transition with an unknown status allowed")
+	}
+}
+
+// statusSet matches the pq.Array of statuses transitionOrderStatus accepts
+// the order in, whatever their order. An empty set is sent as NULL.
+type statusSet []string
+
+func (s statusSet) Match(v driver.Value) bool {
+	if v == nil {
+		return len(s) == 0
+	}
+	text, ok := v.(string)
+	if !ok {
+		return false
+	}
+	var got []string
+	for _, status := range strings.Split(strings.Trim(text, "{}"), ",") {
+		if status = strings.Trim(status, `"`); status != "" {
+			got = append(got, status)
+		}
+	}
+	slices.Sort(got)
+	want := slices.Clone(s)
+	slices.Sort(want)
+	return slices.Equal(got, want)
+}
+
+func TestTransitionOrderStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string // status of order 10, empty when it does not exist
+		to      string
+		wantErr error
+	}{
+		{name: "pay", current: statusPending, to: statusPaid},
+		{name: "ship", current: statusPaid, to: statusShipped},
+		{name: "deliver", current: statusShipped, to: statusDelivered},
+		{name: "refund delivered", current: statusDelivered, to: statusRefunded},
+		{name: "cancel paid", current: statusPaid, to: statusCancelled},
+		{name: "ship pending", current: statusPending, to: statusShipped, wantErr: &invalidTransitionError{statusPending, statusShipped}},
+		{name: "reopen cancelled", current: statusCancelled, to: statusPending, wantErr: &invalidTransitionError{statusCancelled, statusPending}},
+		{name: "cancel shipped", current: statusShipped, to: statusCancelled, wantErr: &invalidTransitionError{statusShipped, statusCancelled}},
+		{name: "pay twice", current: statusPaid, to: statusPaid, wantErr: &invalidTransitionError{statusPaid, statusPaid}},
+		{name: "missing order", to: statusPaid, wantErr: errOrderNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			allowed := tt.current != "" && canTransition(tt.current, tt.to)
+
+			mock.ExpectBegin()
+			update := mock.ExpectQuery(transitionOrder).WithArgs(tt.to, 10, statusSet(transitionsTo(tt.to)))
+			switch {
+			case allowed:
+				update.WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(tt.current))
+				mock.ExpectExec(insertHistory).WithArgs(10, tt.current, tt.to, 4, "customer request").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(insertOutbox).WithArgs("order", "10", "OrderStatusChanged", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			case tt.current != "":
+				update.WillReturnRows(sqlmock.NewRows([]string{"status"}))
+				mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1`).WithArgs(10).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(tt.current))
+			default:
+				update.WillReturnRows(sqlmock.NewRows([]string{"status"}))
+				mock.ExpectQuery(`SELECT status FROM orders WHERE id = \$1`).WithArgs(10).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}))
+			}
+			mock.ExpectRollback()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			previous, err := transitionOrderStatus(context.Background(), tx, 10, tt.to, 4, "customer request")
+			tx.Rollback()
+
+			var transitionErr *invalidTransitionError
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("transition refused: %v", err)
+				}
+				if previous != tt.current {
+					t.Errorf("previous status %q, want %q", previous, tt.current)
+				}
+			case *invalidTransitionError:
+				if !errors.As(err, &transitionErr) || *transitionErr != *want {
+					t.Errorf("err = %v, want %v", err, want)
+				}
+			default:
+				if err != want {
+					t.Errorf("err = %v, want %v", err, want)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGetOrderHistory(t *testing.T) {
+	mock := useMockDB(t)
+	mock.ExpectQuery(`SELECT user_id FROM orders WHERE id = \$1`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+	changedAt := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM order_status_history WHERE order_id = \$1`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "from_status", "to_status", "changed_by", "reason", "changed_at"}).
+			AddRow(1, nil, statusPending, 7, "", changedAt).
+			AddRow(2, statusPending, statusPaid, nil, "", changedAt.Add(time.Minute)).
+			AddRow(3, statusPaid, statusCancelled, 7, "changed my mind", changedAt.Add(time.Hour)))
+
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/api/orders/10/history", nil), map[string]string{"id": "10"})
+	w := serveAsUser(t, getOrderHistoryHandler, r, 7)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var history []StatusChange
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("%d changes, want 3", len(history))
+	}
+	if history[0].FromStatus != nil || history[0].ToStatus != statusPending {
+		t.Errorf("initial change %+v, want no previous status", history[0])
+	}
+	if history[1].ChangedBy != nil {
+		t.Errorf("change made by the service attributed to user %d", *history[1].ChangedBy)
+	}
+	if c := history[2]; c.FromStatus == nil || *c.FromStatus != statusPaid || c.ChangedBy == nil || *c.ChangedBy != 7 || c.Reason != "changed my mind" {
+		t.Errorf("cancellation %+v", c)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// Another customer cannot read it
+	mock.ExpectQuery(`SELECT user_id FROM orders WHERE id = \$1`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+	r = mux.SetURLVars(httptest.NewRequest("GET", "/api/orders/10/history", nil), map[string]string{"id": "10"})
+	if w := serveAsUser(t, getOrderHistoryHandler, r, 8); w.Code != http.StatusForbidden {
+		t.Errorf("history of another user's order: %d, want 403", w.Code)
+	}
+}
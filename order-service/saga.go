@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/outbox"
+)
+
+// Order placement runs as an orchestrated saga: the order, its items and the
+// saga steps are committed together, then each step is applied against
+// product-service. Stock is first held with a reservation and the reservation
+// is confirmed once everything else succeeded. If a step fails, the steps
+// already applied are compensated and the order is cancelled. Sagas left
+// unfinished by a crash are picked up by the recovery loop.
+
+var ordersCreated = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "orders_created_total",
+	Help: "Orders whose placement saga completed.",
+})
+
+const (
+	sagaRunning      = "running"
+	sagaCompensating = "compensating"
+	sagaCompleted    = "completed"
+	sagaAborted      = "aborted"
+)
+
+const (
+	stepPending     = "pending"
+	stepStarted     = "started"
+	stepDone        = "done"
+	stepFailed      = "failed"
+	stepCompensated = "compensated"
+	// stepUnknown marks a step whose call was in flight when the process
+	// died and whose outcome cannot be determined from product-service.
+	stepUnknown = "unknown"
+)
+
+const (
+	actionReserveStock       = "reserve_stock"
+	actionConfirmReservation = "confirm_reservation"
+	// actionDecrementStock is no longer created; it is kept so sagas
+	// recorded before reservations existed can still be compensated.
+	actionDecrementStock = "decrement_stock"
+)
+
+const (
+	sagaRecoveryInterval = 30 * time.Second
+	// sagaStaleAfter must exceed the time a healthy saga takes to finish,
+	// so recovery never races a saga that is still being executed.
+	sagaStaleAfter = 2 * time.Minute
+)
+
+type sagaStep struct {
+	ID            int
+	Index         int
+	Action        string
+	ProductID     int
+	Quantity      int
+	ReservationID int
+	Status        string
+}
+
+type orderSaga struct {
+	ID      int
+	OrderID int
+	Status  string
+	Steps   []*sagaStep
+	// Items is only populated for sagas started by this process.
+	Items []OrderItem
+}
+
+// startOrderSaga records a saga for orderID inside tx. Nothing is sent to
+// product-service until run.
+func startOrderSaga(ctx context.Context, tx *sql.Tx, orderID int, items []OrderItem) (*orderSaga, error) {
+	saga := &orderSaga{OrderID: orderID, Status: sagaRunning, Items: items}
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO order_sagas (order_id, status)
+		VALUES ($1, $2)
+		RETURNING id
+	`, orderID, sagaRunning).Scan(&saga.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, action := range []string{actionReserveStock, actionConfirmReservation} {
+		step := &sagaStep{Index: i, Action: action, Status: stepPending}
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO order_saga_steps (saga_id, step_index, action, status)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		`, saga.ID, step.Index, step.Action, step.Status).Scan(&step.ID)
+		if err != nil {
+			return nil, err
+		}
+		saga.Steps = append(saga.Steps, step)
+	}
+
+	return saga, nil
+}
+
+func loadOrderSaga(ctx context.Context, sagaID int) (*orderSaga, error) {
+	saga := &orderSaga{ID: sagaID}
+	err := db.QueryRowContext(ctx, `
+		SELECT order_id, status FROM order_sagas WHERE id = $1
+	`, sagaID).Scan(&saga.OrderID, &saga.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, step_index, action, COALESCE(product_id, 0), COALESCE(quantity, 0),
+		       COALESCE(reservation_id, 0), status
+		FROM order_saga_steps WHERE saga_id = $1
+		ORDER BY step_index
+	`, sagaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		step := &sagaStep{}
+		if err := rows.Scan(&step.ID, &step.Index, &step.Action, &step.ProductID, &step.Quantity, &step.ReservationID, &step.Status); err != nil {
+			return nil, err
+		}
+		saga.Steps = append(saga.Steps, step)
+	}
+
+	return saga, rows.Err()
+}
+
+// reference is the idempotency key of the saga's product-service reservation.
+func (s *orderSaga) reference() string {
+	return fmt.Sprintf("order-saga-%d", s.ID)
+}
+
+func (s *orderSaga) reservationID() int {
+	for _, step := range s.Steps {
+		if step.Action == actionReserveStock {
+			return step.ReservationID
+		}
+	}
+	return 0
+}
+
+// run applies the pending steps in order. On failure the applied steps are
+// compensated and the error of the failing step is returned.
+func (s *orderSaga) run(ctx context.Context) error {
+	for _, step := range s.Steps {
+		if step.Status != stepPending {
+			continue
+		}
+
+		if err := s.setStepStatus(ctx, step, stepStarted, nil); err != nil {
+			return s.abort(ctx, err)
+		}
+
+		var err error
+		switch step.Action {
+		case actionReserveStock:
+			var reservation *Reservation
+			if reservation, err = reserveStock(ctx, s.reference(), s.Items); err == nil {
+				step.ReservationID = reservation.ID
+			}
+		case actionConfirmReservation:
+			err = confirmReservation(ctx, s.reservationID())
+		default:
+			err = fmt.Errorf("unsupported saga action %q", step.Action)
+		}
+		if err != nil {
+			s.setStepStatus(ctx, step, stepFailed, err)
+			return s.abort(ctx, err)
+		}
+
+		if err := s.setStepStatus(ctx, step, stepDone, nil); err != nil {
+			// A confirmed reservation can no longer be released; leave
+			// the saga to recovery, which will find it confirmed.
+			if step.Action == actionConfirmReservation {
+				return err
+			}
+			// The in-memory status is already done, so the abort still
+			// compensates this step.
+			return s.abort(ctx, err)
+		}
+	}
+
+	return s.complete(ctx)
+}
+
+// complete marks the saga completed and publishes OrderPlaced in the same
+// transaction, so the event is emitted exactly when the order is in place.
+func (s *orderSaga) complete(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE order_sagas SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status <> $1
+	`, sagaCompleted, s.ID)
+	if err != nil {
+		return err
+	}
+	s.Status = sagaCompleted
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	var order Order
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, user_id, status, total_amount FROM orders WHERE id = $1
+	`, s.OrderID).Scan(&order.ID, &order.UserID, &order.Status, &order.TotalAmount)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, product_id, quantity, price FROM order_items WHERE order_id = $1 ORDER BY id
+	`, s.OrderID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.Quantity, &item.Price); err != nil {
+			rows.Close()
+			return err
+		}
+		order.Items = append(order.Items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	err = outbox.Write(ctx, tx, "order", s.OrderID, outbox.OrderPlaced, map[string]interface{}{
+		"order_id":     order.ID,
+		"user_id":      order.UserID,
+		"status":       order.Status,
+		"total_amount": order.TotalAmount,
+		"items":        order.Items,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ordersCreated.Inc()
+	return nil
+}
+
+// abort switches the saga to compensation and returns cause.
+func (s *orderSaga) abort(ctx context.Context, cause error) error {
+	if err := s.setStatus(ctx, sagaCompensating, cause); err != nil {
+		slog.ErrorContext(ctx, "Saga: failed to record compensation start", "saga_id", s.ID, "error", err)
+	}
+	if err := s.compensate(ctx, cause.Error()); err != nil {
+		slog.WarnContext(ctx, "Saga: compensation incomplete, will retry", "saga_id", s.ID, "error", err)
+	}
+	return cause
+}
+
+// resolveInterrupted asks product-service what happened to steps that were
+// in flight when the saga stopped, so recovery can act on their real outcome.
+func (s *orderSaga) resolveInterrupted(ctx context.Context) error {
+	for _, step := range s.Steps {
+		if step.Status != stepStarted {
+			continue
+		}
+
+		switch step.Action {
+		case actionReserveStock:
+			reservation, err := findReservation(ctx, s.reference())
+			if err != nil {
+				return err
+			}
+			if reservation == nil {
+				s.setStepStatus(ctx, step, stepFailed, errors.New("reservation was never created"))
+				continue
+			}
+			step.ReservationID = reservation.ID
+			s.setStepStatus(ctx, step, stepDone, nil)
+		case actionConfirmReservation:
+			reservation, err := getReservation(ctx, s.reservationID())
+			if err != nil {
+				return err
+			}
+			if reservation.Status == "confirmed" {
+				s.setStepStatus(ctx, step, stepDone, nil)
+			} else {
+				s.setStepStatus(ctx, step, stepFailed, fmt.Errorf("reservation is %s", reservation.Status))
+			}
+		default:
+			slog.ErrorContext(ctx, "Saga: step outcome unknown, needs manual reconciliation", "saga_id", s.ID,
+				"step", step.Index, "action", step.Action, "product_id", step.ProductID, "quantity", step.Quantity)
+			s.setStepStatus(ctx, step, stepUnknown, nil)
+		}
+	}
+	return nil
+}
+
+// compensate undoes every applied step in reverse order. When all steps are
+// undone the order is cancelled with reason recorded in its metadata.
+func (s *orderSaga) compensate(ctx context.Context, reason string) error {
+	for i := len(s.Steps) - 1; i >= 0; i-- {
+		step := s.Steps[i]
+		if step.Status != stepDone {
+			continue
+		}
+
+		var err error
+		switch step.Action {
+		case actionReserveStock:
+			err = releaseReservation(ctx, step.ReservationID)
+		case actionDecrementStock:
+			err = updateProductStock(ctx, step.ProductID, step.Quantity, fmt.Sprintf("saga-%d-step-%d-compensate", s.ID, step.Index))
+		}
+		if err != nil {
+			return fmt.Errorf("compensate step %d (%s): %w", step.Index, step.Action, err)
+		}
+		if err := s.setStepStatus(ctx, step, stepCompensated, nil); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = transitionOrderStatus(ctx, tx, s.OrderID, statusCancelled, 0, reason)
+	var transitionErr *invalidTransitionError
+	switch {
+	case err == nil:
+		_, err = tx.ExecContext(ctx, `
+			UPDATE orders
+			SET metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object('cancellation_reason', $1::text)
+			WHERE id = $2
+		`, reason, s.OrderID)
+		if err != nil {
+			return err
+		}
+	case errors.As(err, &transitionErr):
+		slog.WarnContext(ctx, "Saga: order left unchanged", "saga_id", s.ID, "order_id", s.OrderID, "status", transitionErr.From, "error", err)
+	case err != errOrderNotFound:
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE order_sagas SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, sagaAborted, s.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.Status = sagaAborted
+	return nil
+}
+
+func (s *orderSaga) setStatus(ctx context.Context, status string, cause error) error {
+	s.Status = status
+	_, err := db.ExecContext(ctx, `
+		UPDATE order_sagas
+		SET status = $1, error = COALESCE($2, error), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, status, errorText(cause), s.ID)
+	return err
+}
+
+// setStepStatus records a step transition and refreshes the saga's
+// updated_at so recovery does not treat a live saga as stale.
+func (s *orderSaga) setStepStatus(ctx context.Context, step *sagaStep, status string, cause error) error {
+	step.Status = status
+	_, err := db.ExecContext(ctx, `
+		UPDATE order_saga_steps
+		SET status = $1, error = $2, reservation_id = NULLIF($3, 0), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4
+	`, status, errorText(cause), step.ReservationID, step.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `UPDATE order_sagas SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, s.ID)
+	return err
+}
+
+func errorText(err error) sql.NullString {
+	if err == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: err.Error(), Valid: true}
+}
+
+// recover finishes a saga that stopped making progress: if every step turns
+// out to have been applied the saga is completed, otherwise it is compensated.
+func (s *orderSaga) recover(ctx context.Context) error {
+	if err := s.resolveInterrupted(ctx); err != nil {
+		return err
+	}
+
+	allDone := true
+	for _, step := range s.Steps {
+		if step.Status != stepDone {
+			allDone = false
+		}
+	}
+	if allDone && s.Status == sagaRunning {
+		slog.InfoContext(ctx, "Saga: all steps applied, completing order", "saga_id", s.ID, "order_id", s.OrderID)
+		return s.complete(ctx)
+	}
+
+	if err := s.setStatus(ctx, sagaCompensating, nil); err != nil {
+		return err
+	}
+	if err := s.compensate(ctx, "order placement interrupted"); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Saga: compensated, order cancelled", "saga_id", s.ID, "order_id", s.OrderID)
+	return nil
+}
+
+// recoverSagas picks up sagas that stopped making progress, either because
+// the process crashed mid-saga or because an earlier compensation attempt
+// could not reach product-service.
+func recoverSagas(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM order_sagas
+		WHERE status IN ($1, $2) AND updated_at < NOW() - make_interval(secs => $3)
+		ORDER BY id
+	`, sagaRunning, sagaCompensating, sagaStaleAfter.Seconds())
+	if err != nil {
+		slog.Error("Saga recovery failed", "error", err)
+		return
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		// Claim the saga by bumping updated_at; another instance that
+		// already claimed it makes this update affect no rows.
+		result, err := db.ExecContext(ctx, `
+			UPDATE order_sagas
+			SET updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status IN ($2, $3) AND updated_at < NOW() - make_interval(secs => $4)
+		`, id, sagaRunning, sagaCompensating, sagaStaleAfter.Seconds())
+		if err != nil {
+			slog.Error("Saga: claim failed", "saga_id", id, "error", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+
+		saga, err := loadOrderSaga(ctx, id)
+		if err != nil {
+			slog.Error("Saga: load failed", "saga_id", id, "error", err)
+			continue
+		}
+
+		if err := saga.recover(ctx); err != nil {
+			slog.Warn("Saga: recovery incomplete, will retry", "saga_id", id, "error", err)
+		}
+	}
+}
+
+// runSagaRecovery runs recoverSagas at startup and then periodically until
+// ctx is cancelled.
+func runSagaRecovery(ctx context.Context) {
+	ticker := time.NewTicker(sagaRecoveryInterval)
+	defer ticker.Stop()
+	for {
+		recoverSagas(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Statements of the saga, matched as regular expressions
+const (
+	updateStep       = `UPDATE order_saga_steps\s+SET status = \$1`
+	touchSaga        = `UPDATE order_sagas SET updated_at = CURRENT_TIMESTAMP WHERE id = \$1`
+	updateSaga       = `UPDATE order_sagas\s+SET status = \$1, error`
+	finishSaga       = `UPDATE order_sagas SET status = \$1, updated_at = CURRENT_TIMESTAMP`
+	transitionOrder  = `UPDATE orders o SET status = \$1`
+	insertHistory    = `INSERT INTO order_status_history`
+	insertOutbox     = `INSERT INTO outbox`
+	setOrderMetadata = `UPDATE orders\s+SET metadata`
+)
+
+// useMockDB replaces the database with a sqlmock one for the test.
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = saved
+		mockDB.Close()
+	})
+	return mock
+}
+
+type stubResponse struct {
+	status int
+	body   string
+}
+
+// productStub stands in for product-service: it answers each "METHOD URI"
+// with the configured response and records the calls it receives.
+type productStub struct {
+	mu        sync.Mutex
+	responses map[string]stubResponse
+	calls     []string
+}
+
+func newProductStub(t *testing.T, responses map[string]stubResponse) *productStub {
+	t.Helper()
+	stub := &productStub{responses: responses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := r.Method + " " + r.RequestURI
+		stub.mu.Lock()
+		stub.calls = append(stub.calls, call)
+		resp, ok := stub.responses[call]
+		stub.mu.Unlock()
+		if !ok {
+			t.Errorf("unexpected call to product-service: %s", call)
+			resp = stubResponse{status: http.StatusInternalServerError}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := productServiceURL
+	productServiceURL = srv.URL
+	t.Cleanup(func() { productServiceURL = saved })
+	return stub
+}
+
+func (s *productStub) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+const reservationsPath = "/api/v2/products/reservations"
+
+// testSaga returns saga 1 of order 10 as startOrderSaga records it.
+func testSaga() *orderSaga {
+	return &orderSaga{
+		ID: 1, OrderID: 10, Status: sagaRunning,
+		Items: []OrderItem{{ProductID: 3, Quantity: 2, Price: 5}},
+		Steps: []*sagaStep{
+			{ID: 11, Index: 0, Action: actionReserveStock, Status: stepPending},
+			{ID: 12, Index: 1, Action: actionConfirmReservation, Status: stepPending},
+		},
+	}
+}
+
+// expectStepStatus expects a step transition and the saga heartbeat that
+// goes with it.
+func expectStepStatus(mock sqlmock.Sqlmock, stepID int, status string, reservationID int) {
+	mock.ExpectExec(updateStep).WithArgs(status, sqlmock.AnyArg(), reservationID, stepID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(touchSaga).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectCancellation expects the compensation transaction that cancels
+// order 10 and aborts saga 1.
+func expectCancellation(mock sqlmock.Sqlmock, reason string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(transitionOrder).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(statusPending))
+	mock.ExpectExec(insertHistory).WithArgs(10, statusPending, statusCancelled, 0, reason).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertOutbox).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(setOrderMetadata).WithArgs(reason, 10).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(finishSaga).WithArgs(sagaAborted, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestSagaRunCompletes(t *testing.T) {
+	mock := useMockDB(t)
+	stub := newProductStub(t, map[string]stubResponse{
+		"POST " + reservationsPath:                {http.StatusCreated, `{"id": 5, "status": "held"}`},
+		"POST " + reservationsPath + "/5/confirm": {http.StatusOK, `{"id": 5, "status": "confirmed"}`},
+	})
+
+	expectStepStatus(mock, 11, stepStarted, 0)
+	expectStepStatus(mock, 11, stepDone, 5)
+	expectStepStatus(mock, 12, stepStarted, 0)
+	expectStepStatus(mock, 12, stepDone, 0)
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE order_sagas\s+SET status = \$1, updated_at = CURRENT_TIMESTAMP\s+WHERE id = \$2 AND status <> \$1`).
+		WithArgs(sagaCompleted, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT id, user_id, status, total_amount FROM orders`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "status", "total_amount"}).AddRow(10, 7, statusPending, 10.0))
+	mock.ExpectQuery(`SELECT id, product_id, quantity, price FROM order_items`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "quantity", "price"}).AddRow(20, 3, 2, 5.0))
+	mock.ExpectExec(insertOutbox).WithArgs("order", "10", "OrderPlaced", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	saga := testSaga()
+	if err := saga.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if saga.Status != sagaCompleted || saga.reservationID() != 5 {
+		t.Errorf("saga %s with reservation %d, want completed with 5", saga.Status, saga.reservationID())
+	}
+	want := []string{"POST " + reservationsPath, "POST " + reservationsPath + "/5/confirm"}
+	if calls := stub.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("product-service calls %v, want %v", calls, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSagaRunCompensatesFailedConfirm(t *testing.T) {
+	mock := useMockDB(t)
+	stub := newProductStub(t, map[string]stubResponse{
+		"POST " + reservationsPath:                {http.StatusCreated, `{"id": 5, "status": "held"}`},
+		"POST " + reservationsPath + "/5/confirm": {http.StatusConflict, "Reservation has expired"},
+		"POST " + reservationsPath + "/5/release": {http.StatusOK, `{"id": 5, "status": "released"}`},
+	})
+
+	expectStepStatus(mock, 11, stepStarted, 0)
+	expectStepStatus(mock, 11, stepDone, 5)
+	expectStepStatus(mock, 12, stepStarted, 0)
+	expectStepStatus(mock, 12, stepFailed, 0)
+	mock.ExpectExec(updateSaga).WithArgs(sagaCompensating, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectStepStatus(mock, 11, stepCompensated, 5)
+	expectCancellation(mock, "product-service returned 409: Reservation has expired")
+
+	saga := testSaga()
+	err := saga.run(context.Background())
+	var psErr *productServiceError
+	if !errors.As(err, &psErr) || psErr.StatusCode != http.StatusConflict {
+		t.Fatalf("run = %v, want the confirm failure", err)
+	}
+	if saga.Status != sagaAborted {
+		t.Errorf("saga %s, want aborted", saga.Status)
+	}
+	wantSteps := []string{stepCompensated, stepFailed}
+	for i, step := range saga.Steps {
+		if step.Status != wantSteps[i] {
+			t.Errorf("step %d %s, want %s", i, step.Status, wantSteps[i])
+		}
+	}
+	want := []string{
+		"POST " + reservationsPath,
+		"POST " + reservationsPath + "/5/confirm",
+		"POST " + reservationsPath + "/5/release",
+	}
+	if calls := stub.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("product-service calls %v, want %v", calls, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+const (
+	selectStaleSagas = `SELECT id FROM order_sagas\s+WHERE status IN \(\$1, \$2\) AND updated_at <`
+	claimSaga        = `UPDATE order_sagas\s+SET updated_at = CURRENT_TIMESTAMP\s+WHERE id = \$1 AND status IN`
+)
+
+func TestRecoverSagasCompensatesStaleSaga(t *testing.T) {
+	mock := useMockDB(t)
+	stub := newProductStub(t, map[string]stubResponse{
+		"GET " + reservationsPath + "?reference=order-saga-1": {http.StatusOK, `{"id": 5, "status": "held"}`},
+		"POST " + reservationsPath + "/5/release":             {http.StatusOK, `{"id": 5, "status": "released"}`},
+	})
+
+	mock.ExpectQuery(selectStaleSagas).WithArgs(sagaRunning, sagaCompensating, sagaStaleAfter.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+
+	// Saga 1: the process died while the reservation was being made
+	mock.ExpectExec(claimSaga).WithArgs(1, sagaRunning, sagaCompensating, sagaStaleAfter.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT order_id, status FROM order_sagas WHERE id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "status"}).AddRow(10, sagaRunning))
+	mock.ExpectQuery(`FROM order_saga_steps WHERE saga_id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "step_index", "action", "product_id", "quantity", "reservation_id", "status"}).
+			AddRow(11, 0, actionReserveStock, 0, 0, 0, stepStarted).
+			AddRow(12, 1, actionConfirmReservation, 0, 0, 0, stepPending))
+	expectStepStatus(mock, 11, stepDone, 5)
+	mock.ExpectExec(updateSaga).WithArgs(sagaCompensating, nil, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectStepStatus(mock, 11, stepCompensated, 5)
+	expectCancellation(mock, "order placement interrupted")
+
+	// Saga 2 was claimed by another instance in the meantime
+	mock.ExpectExec(claimSaga).WithArgs(2, sagaRunning, sagaCompensating, sagaStaleAfter.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	recoverSagas(context.Background())
+
+	want := []string{
+		"GET " + reservationsPath + "?reference=order-saga-1",
+		"POST " + reservationsPath + "/5/release",
+	}
+	if calls := stub.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("product-service calls %v, want %v", calls, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecoverSagasCompletesConfirmedSaga(t *testing.T) {
+	mock := useMockDB(t)
+	newProductStub(t, map[string]stubResponse{
+		"GET " + reservationsPath + "/5": {http.StatusOK, `{"id": 5, "status": "confirmed"}`},
+	})
+
+	mock.ExpectQuery(selectStaleSagas).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(claimSaga).WithArgs(1, sagaRunning, sagaCompensating, sagaStaleAfter.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT order_id, status FROM order_sagas WHERE id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "status"}).AddRow(10, sagaRunning))
+	mock.ExpectQuery(`FROM order_saga_steps WHERE saga_id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "step_index", "action", "product_id", "quantity", "reservation_id", "status"}).
+			AddRow(11, 0, actionReserveStock, 0, 0, 5, stepDone).
+			AddRow(12, 1, actionConfirmReservation, 0, 0, 0, stepStarted))
+	expectStepStatus(mock, 12, stepDone, 0)
+
+	// The confirmation went through before the crash: the order is placed
+	mock.ExpectBegin()
+	mock.ExpectExec(finishSaga).WithArgs(sagaCompleted, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT id, user_id, status, total_amount FROM orders`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "status", "total_amount"}).AddRow(10, 7, statusPending, 10.0))
+	mock.ExpectQuery(`SELECT id, product_id, quantity, price FROM order_items`).WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "quantity", "price"}).AddRow(20, 3, 2, 5.0))
+	mock.ExpectExec(insertOutbox).WithArgs("order", "10", "OrderPlaced", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	recoverSagas(context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lib/pq"
-	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/authz"
+	"shared/config"
+	"shared/discovery"
+	"shared/graceful"
+	"shared/health"
+	"shared/logging"
+	"shared/metrics"
+	"shared/outbox"
+	"shared/tracing"
+	"shared/versioning"
 )
 
 var db *sql.DB
@@ -35,17 +47,17 @@ type CreateProductRequest struct {
 	Tags          []string `json:"tags"`
 }
 
-func initDB() {
-	connStr := "host=postgres port=5432 user=postgres password=postgres dbname=products_db sslmode=disable"
+func initDB(conf config.Database) {
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	connector, err := pq.NewConnector(conf.DSN())
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Invalid database settings", "error", err)
 	}
+	db = tracing.OpenDB(connector)
 	if err = db.Ping(); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to connect to database", "database", conf.Name, "error", err)
 	}
-	log.Println("Connected to products database")
+	slog.Info("Connected to database", "database", conf.Name)
 }
 
 func createProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -55,8 +67,15 @@ func createProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	var productID int
-	err := db.QueryRow(`
+	err = tx.QueryRowContext(r.Context(), `
 		INSERT INTO products (name, description, price, stock_quantity, category, tags)
 		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
 	`, req.Name, req.Description, req.Price, req.StockQuantity, req.Category, pq.Array(req.Tags)).Scan(&productID)
@@ -66,6 +85,24 @@ func createProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = outbox.Write(r.Context(), tx, "product", productID, outbox.ProductCreated, map[string]interface{}{
+		"product_id":     productID,
+		"name":           req.Name,
+		"price":          req.Price,
+		"stock_quantity": req.StockQuantity,
+		"category":       req.Category,
+		"tags":           req.Tags,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -81,7 +118,7 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 	var product Product
 	var tags pq.StringArray
 
-	err := db.QueryRow(
+	err := db.QueryRowContext(r.Context(),
 		`SELECT id, name, description, price, stock_quantity, category, tags, created_at FROM products WHERE id = $1
 		`, productID).Scan(
 		&product.ID, &product.Name, &product.Description, &product.Price, &product.StockQuantity, &product.Category, &tags, &product.CreatedAt,
@@ -98,26 +135,31 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(product)
 }
 
-func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
-		return
-	}
+// productsWriter writes a list of products in the format of one API version.
+type productsWriter func(w http.ResponseWriter, products []Product)
 
-	// Using GIN index for full-text search
-	rows, err := db.Query(`
-		SELECT id, name, description, price, stock_quantity, category, tags, created_at 
-		FROM products 
-		WHERE to_tsvector('english', name || ' ' || COALESCE(description, '')) @@ plainto_tsquery('english', $1)
-		ORDER BY ts_rank(to_tsvector('english', name || ' ' || COALESCE(description, '')), plainto_tsquery('english', $1)) DESC
-		LIMIT 50
-	`, query)
+// writeProductsV1 writes the bare array of v1, null when it is empty.
+func writeProductsV1(w http.ResponseWriter, products []Product) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(products)
+}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// writeProductsV2 wraps the list in an object, so fields such as paging can
+// be added later without breaking clients.
+func writeProductsV2(w http.ResponseWriter, products []Product) {
+	if products == nil {
+		products = []Product{}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"products": products,
+		"count":    len(products),
+	})
+}
+
+// scanProducts reads the products returned by a query selecting all
+// Product columns.
+func scanProducts(rows *sql.Rows) ([]Product, error) {
 	defer rows.Close()
 
 	var products []Product
@@ -125,53 +167,73 @@ func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
 		var product Product
 		var tags pq.StringArray
 		if err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.StockQuantity, &product.Category, &tags, &product.CreatedAt); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 		product.Tags = tags
 		products = append(products, product)
 	}
+	return products, rows.Err()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+func searchProductsHandler(write productsWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		if query == "" {
+			http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
+			return
+		}
 
-}
+		// Using GIN index for full-text search
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT id, name, description, price, stock_quantity, category, tags, created_at 
+			FROM products 
+			WHERE to_tsvector('english', name || ' ' || COALESCE(description, '')) @@ plainto_tsquery('english', $1)
+			ORDER BY ts_rank(to_tsvector('english', name || ' ' || COALESCE(description, '')), plainto_tsquery('english', $1)) DESC
+			LIMIT 50
+		`, query)
 
-func searchByTagsHandler(w http.ResponseWriter, r *http.Request) {
-	tag := r.URL.Query().Get("tag")
-	if tag == "" {
-		http.Error(w, "Tags parameter required", http.StatusBadRequest)
-		return
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		products, err := scanProducts(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		write(w, products)
 	}
+}
 
-	// Using GIN index for array Search
-	rows, err := db.Query(`
-		SELECT id, name, description, price, stock_quantity, category, tags, created_at 
-		FROM products 
-		WHERE tags @> ARRAY[$1]::text[]
-		LIMIT 50
-	`, tag)
+func searchByTagsHandler(write productsWriter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag := r.URL.Query().Get("tag")
+		if tag == "" {
+			http.Error(w, "Tags parameter required", http.StatusBadRequest)
+			return
+		}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
+		// Using GIN index for array Search
+		rows, err := db.QueryContext(r.Context(), `
+			SELECT id, name, description, price, stock_quantity, category, tags, created_at 
+			FROM products 
+			WHERE tags @> ARRAY[$1]::text[]
+			LIMIT 50
+		`, tag)
 
-	var products []Product
-	for rows.Next() {
-		var product Product
-		var tags pq.StringArray
-		if err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.StockQuantity, &product.Category, &tags, &product.CreatedAt); err != nil {
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		product.Tags = tags
-		products = append(products, product)
-	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+		products, err := scanProducts(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		write(w, products)
+	}
 }
 
 func updateStockHandler(w http.ResponseWriter, r *http.Request) {
@@ -180,6 +242,9 @@ func updateStockHandler(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		Quantity int `json:"quantity"`
+		// Reference is an optional caller key; an adjustment repeated with the
+		// same reference is applied once.
+		Reference string `json:"reference"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -187,46 +252,223 @@ func updateStockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec(`
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Guarded update: a decrement larger than the current stock is rejected
+	var id, stockQuantity int
+	err = tx.QueryRowContext(r.Context(), `
 	UPDATE products 
 		SET stock_quantity = stock_quantity + $1, updated_at = CURRENT_TIMESTAMP 
-		WHERE id = $2
-	`, req.Quantity, productID)
-
+		WHERE id = $2 AND stock_quantity + $1 >= 0
+		RETURNING id, stock_quantity
+	`, req.Quantity, productID).Scan(&id, &stockQuantity)
+
+	if err == sql.ErrNoRows {
+		var exists bool
+		db.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)`, productID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Insufficient stock", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
+	if req.Reference != "" {
+		// A repeated request rolls back the update it just made
+		applied, err := recordStockAdjustment(r.Context(), tx, req.Reference, id, req.Quantity)
+		if err == errReferenceReused {
+			http.Error(w, "Reference already used for another adjustment", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if applied {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Stock already updated"})
+			return
+		}
+	}
+
+	if err := writeStockChanged(r.Context(), tx, id, req.Quantity, stockQuantity, "adjustment"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if rowsAffected == 0 {
-		http.Error(w, "Product not found", http.StatusNotFound)
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if req.Quantity < 0 {
+		recordStockDecrement("adjustment", -req.Quantity)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Stock updated successfully"})
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+var errReferenceReused = errors.New("reference already used for another adjustment")
+
+// recordStockAdjustment stores reference for an adjustment made in tx and
+// reports whether it was applied before. Requests with the same reference
+// wait on each other's product row lock, so the later one sees the first.
+func recordStockAdjustment(ctx context.Context, tx *sql.Tx, reference string, productID, quantity int) (bool, error) {
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO stock_adjustments (reference, product_id, quantity) VALUES ($1, $2, $3)
+		ON CONFLICT (reference) DO NOTHING
+	`, reference, productID, quantity)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return false, nil
+	}
+
+	var sameRequest bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT product_id = $2 AND quantity = $3 FROM stock_adjustments WHERE reference = $1
+	`, reference, productID, quantity).Scan(&sameRequest)
+	if err != nil {
+		return false, err
+	}
+	if !sameRequest {
+		return false, errReferenceReused
+	}
+	return true, nil
+}
+
+// writeStockChanged records a StockChanged event for a stock update made in tx.
+func writeStockChanged(ctx context.Context, tx *sql.Tx, productID, delta, stockQuantity int, reason string) error {
+	return outbox.Write(ctx, tx, "product", productID, outbox.StockChanged, map[string]interface{}{
+		"product_id":     productID,
+		"delta":          delta,
+		"stock_quantity": stockQuantity,
+		"reason":         reason,
+	})
+}
+
+var (
+	stockDecrements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "product_stock_decrements_total",
+		Help: "Committed stock decrements, by reason (adjustment, reserved).",
+	}, []string{"reason"})
+
+	stockDecrementedUnits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "product_stock_decremented_units_total",
+		Help: "Units taken out of stock, by reason (adjustment, reserved).",
+	}, []string{"reason"})
+)
+
+// recordStockDecrement counts a committed decrement of quantity units.
+func recordStockDecrement(reason string, quantity int) {
+	stockDecrements.WithLabelValues(reason).Inc()
+	stockDecrementedUnits.WithLabelValues(reason).Add(float64(quantity))
+}
+
+func startOutboxRelay(ctx context.Context, kind, channel string) *outbox.Relay {
+	sink, err := outbox.NewSink(kind, db, channel)
+	if err != nil {
+		logging.Fatal("Failed to create outbox sink", "sink", kind, "error", err)
+	}
+	relay := &outbox.Relay{DB: db, Sink: sink, Source: "product-service"}
+	go relay.Run(ctx)
+	return relay
+}
+
+// requiredMigrations are the dbmate versions whose schema this service uses.
+// Readiness fails until all of them are applied.
+var requiredMigrations = []string{
+	"20251005121034",
+	"20251021090000",
+	"20251025090000",
+	"20251029090000",
+}
+
+// productRoutes registers the product API with lists written by write.
+func productRoutes(write productsWriter) func(r *mux.Router) {
+	return func(r *mux.Router) {
+		r.Handle("", authz.Require(authz.ProductsWrite, createProductHandler)).Methods("POST")
+		r.Handle("/reservations", authz.Require(authz.StockWrite, createReservationHandler)).Methods("POST")
+		r.Handle("/reservations", authz.Require(authz.StockWrite, findReservationHandler)).Methods("GET").Queries("reference", "{reference}")
+		r.Handle("/reservations/{id}", authz.Require(authz.StockWrite, getReservationHandler)).Methods("GET")
+		r.Handle("/reservations/{id}/confirm", authz.Require(authz.StockWrite, confirmReservationHandler)).Methods("POST")
+		r.Handle("/reservations/{id}/release", authz.Require(authz.StockWrite, releaseReservationHandler)).Methods("POST")
+		r.HandleFunc("/search", searchProductsHandler(write)).Methods("GET")
+		r.HandleFunc("/tags", searchByTagsHandler(write)).Methods("GET")
+		r.HandleFunc("/{id:[0-9]+}", getProductHandler).Methods("GET")
+		r.Handle("/{id:[0-9]+}/stock", authz.Require(authz.StockWrite, updateStockHandler)).Methods("PATCH")
+	}
 }
 
 func main() {
-	initDB()
-	defer db.Close()
+	conf, err := config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+	logging.Setup(conf, "product-service")
+	dbConf := conf.Database("products_db")
+	server := conf.Server(8002)
+	initReservations(conf)
+	outboxSink := conf.OneOf("OUTBOX_SINK", "log", outbox.SinkKinds...)
+	outboxChannel := conf.String("OUTBOX_CHANNEL", "outbox_events")
+	authz.Setup(conf)
+	registration := discovery.FromConfig(conf, "product-service", server)
+	checker := health.FromConfig(conf, "product-service")
+	v1 := versioning.FromConfig(conf, "v1")
+	v1.Successor = "v2"
+	shutdownTracing := tracing.Setup(conf, "product-service")
+	if err := conf.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	ctx, stop := graceful.SignalContext()
+	defer stop()
+
+	initDB(dbConf)
+
+	checker.Add("database", health.Database(db))
+	checker.Add("migrations", health.Migrations(db, requiredMigrations...))
+	metrics.RegisterDB(db, dbConf.Name)
+
+	go runReservationSweeper(ctx)
+
+	relay := startOutboxRelay(ctx, outboxSink, outboxChannel)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/health", healthHandler).Methods("GET")
-	r.HandleFunc("/api/products", createProductHandler).Methods("POST")
-	r.HandleFunc("/api/products/{id}", getProductHandler).Methods("GET")
-	r.HandleFunc("/api/products/search", searchProductsHandler).Methods("GET")
-	r.HandleFunc("/api/products/tags", searchByTagsHandler).Methods("GET")
-	r.HandleFunc("/api/products/{id}/stock", updateStockHandler).Methods("PATCH")
-
-	fmt.Println("Product Service running on :8002")
-	log.Fatal(http.ListenAndServe(":8002", r))
+	r.Use(tracing.Middleware)
+	r.Use(metrics.Middleware)
+	r.Use(logging.Middleware)
+	r.HandleFunc("/livez", checker.Liveness).Methods("GET")
+	r.HandleFunc("/readyz", checker.Readiness).Methods("GET")
+	r.HandleFunc("/health", checker.Readiness).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	// v1 is also served unversioned; v2 differs only in how lists are written
+	api := versioning.New(r, "/api/products", "v1")
+	api.Version(v1, productRoutes(writeProductsV1))
+	api.Version(versioning.Version{Name: "v2"}, productRoutes(writeProductsV2))
+
+	deregistered := registration.Start(ctx)
+
+	slog.Info("Product Service running", "addr", server.Addr)
+	err = graceful.Run(ctx, server, r,
+		graceful.Cleanup{Name: "registry", Fn: deregistered},
+		graceful.Cleanup{Name: "outbox", Fn: relay.Flush},
+		graceful.Cleanup{Name: "tracing", Fn: shutdownTracing},
+		graceful.Cleanup{Name: "database", Fn: func(context.Context) error { return db.Close() }},
+	)
+	if err != nil {
+		logging.Fatal("Server failed to start", "error", err)
+	}
 }
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/config"
+)
+
+const (
+	reservationHeld      = "held"
+	reservationConfirmed = "confirmed"
+	reservationReleased  = "released"
+	reservationExpired   = "expired"
+)
+
+var (
+	reservationTTL = 15 * time.Minute
+	// reservationMaxTTL bounds the ttl_seconds a caller may ask for, so a
+	// reservation cannot hold stock indefinitely.
+	reservationMaxTTL        = time.Hour
+	reservationSweepInterval = time.Minute
+)
+
+type ReservationItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+type Reservation struct {
+	ID        int               `json:"id"`
+	Reference string            `json:"reference,omitempty"`
+	Status    string            `json:"status"`
+	Items     []ReservationItem `json:"items"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type CreateReservationRequest struct {
+	// Reference is an optional caller key; repeating a request with the same
+	// reference returns the existing reservation instead of holding stock twice.
+	Reference string            `json:"reference"`
+	Items     []ReservationItem `json:"items"`
+	// TTLSeconds overrides the default lifetime, up to reservationMaxTTL.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+var errReservationNotFound = errors.New("reservation not found")
+
+func initReservations(conf *config.Loader) {
+	reservationTTL = conf.Duration("RESERVATION_TTL", reservationTTL)
+	reservationMaxTTL = conf.Duration("RESERVATION_MAX_TTL", max(reservationMaxTTL, reservationTTL))
+	if reservationMaxTTL < reservationTTL {
+		conf.Invalid("RESERVATION_MAX_TTL", "%s is shorter than RESERVATION_TTL %s", reservationMaxTTL, reservationTTL)
+	}
+	reservationSweepInterval = conf.Duration("RESERVATION_SWEEP_INTERVAL", reservationSweepInterval)
+}
+
+// mergeReservationItems sums quantities per product and sorts by product ID,
+// so stock rows are always locked in the same order and each product appears
+// once per reservation.
+func mergeReservationItems(items []ReservationItem) ([]ReservationItem, error) {
+	totals := make(map[int]int)
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("quantity for product %d must be positive", item.ProductID)
+		}
+		totals[item.ProductID] += item.Quantity
+	}
+
+	merged := make([]ReservationItem, 0, len(totals))
+	for productID, quantity := range totals {
+		merged = append(merged, ReservationItem{ProductID: productID, Quantity: quantity})
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ProductID < merged[j].ProductID })
+	return merged, nil
+}
+
+func createReservationHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) == 0 {
+		http.Error(w, "At least one item is required", http.StatusBadRequest)
+		return
+	}
+
+	items, err := mergeReservationItems(req.Items)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := reservationTTL
+	if req.TTLSeconds > 0 {
+		// Compared in seconds so a huge value cannot overflow the duration
+		ttl = reservationMaxTTL
+		if req.TTLSeconds < int(reservationMaxTTL.Seconds()) {
+			ttl = time.Duration(req.TTLSeconds) * time.Second
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var reference sql.NullString
+	if req.Reference != "" {
+		reference = sql.NullString{String: req.Reference, Valid: true}
+	}
+
+	var reservationID int
+	err = tx.QueryRowContext(r.Context(), `
+		INSERT INTO stock_reservations (reference, status, expires_at)
+		VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		ON CONFLICT (reference) DO NOTHING
+		RETURNING id
+	`, reference, reservationHeld, ttl.Seconds()).Scan(&reservationID)
+
+	if err == sql.ErrNoRows {
+		// Replayed reference: answer with the reservation created earlier
+		tx.Rollback()
+		reservation, err := getReservationByReference(r.Context(), req.Reference)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reservation)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, item := range items {
+		// Guarded decrement: fails instead of letting stock go negative
+		var stockQuantity int
+		err := tx.QueryRowContext(r.Context(), `
+			UPDATE products
+			SET stock_quantity = stock_quantity - $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2 AND stock_quantity >= $1
+			RETURNING stock_quantity
+		`, item.Quantity, item.ProductID).Scan(&stockQuantity)
+
+		if err == sql.ErrNoRows {
+			var exists bool
+			tx.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)`, item.ProductID).Scan(&exists)
+			if !exists {
+				http.Error(w, fmt.Sprintf("Product %d not found", item.ProductID), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Insufficient stock for product %d", item.ProductID), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := writeStockChanged(r.Context(), tx, item.ProductID, -item.Quantity, stockQuantity, "reserved"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.ExecContext(r.Context(), `
+			INSERT INTO stock_reservation_items (reservation_id, product_id, quantity)
+			VALUES ($1, $2, $3)
+		`, reservationID, item.ProductID, item.Quantity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, item := range items {
+		recordStockDecrement("reserved", item.Quantity)
+	}
+
+	reservation, err := getReservation(r.Context(), reservationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func getReservation(ctx context.Context, reservationID int) (*Reservation, error) {
+	var reservation Reservation
+	var reference sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT id, reference, status, expires_at, created_at
+		FROM stock_reservations WHERE id = $1
+	`, reservationID).Scan(&reservation.ID, &reference, &reservation.Status, &reservation.ExpiresAt, &reservation.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	reservation.Reference = reference.String
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT product_id, quantity FROM stock_reservation_items
+		WHERE reservation_id = $1 ORDER BY product_id
+	`, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item ReservationItem
+		if err := rows.Scan(&item.ProductID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		reservation.Items = append(reservation.Items, item)
+	}
+
+	return &reservation, rows.Err()
+}
+
+func getReservationByReference(ctx context.Context, reference string) (*Reservation, error) {
+	var reservationID int
+	err := db.QueryRowContext(ctx, `SELECT id FROM stock_reservations WHERE reference = $1`, reference).Scan(&reservationID)
+	if err == sql.ErrNoRows {
+		return nil, errReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getReservation(ctx, reservationID)
+}
+
+func getReservationHandler(w http.ResponseWriter, r *http.Request) {
+	reservationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+	reservation, err := getReservation(r.Context(), reservationID)
+	writeReservation(w, reservation, err)
+}
+
+func findReservationHandler(w http.ResponseWriter, r *http.Request) {
+	reference := r.URL.Query().Get("reference")
+	if reference == "" {
+		http.Error(w, "Query parameter 'reference' is required", http.StatusBadRequest)
+		return
+	}
+	reservation, err := getReservationByReference(r.Context(), reference)
+	writeReservation(w, reservation, err)
+}
+
+func writeReservation(w http.ResponseWriter, reservation *Reservation, err error) {
+	if err == errReservationNotFound {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
+
+// lockReservation loads a reservation's status for update within tx.
+func lockReservation(ctx context.Context, tx *sql.Tx, reservationID int) (status string, err error) {
+	err = tx.QueryRowContext(ctx, `
+		SELECT status FROM stock_reservations WHERE id = $1 FOR UPDATE
+	`, reservationID).Scan(&status)
+	if err == sql.ErrNoRows {
+		err = errReservationNotFound
+	}
+	return status, err
+}
+
+// returnReservedStock gives the held quantities back to the products and
+// moves the reservation to status. Each product appears at most once per
+// reservation, so the UPDATE ... FROM join adds every quantity exactly once.
+func returnReservedStock(ctx context.Context, tx *sql.Tx, reservationID int, status string) error {
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE products p
+		SET stock_quantity = p.stock_quantity + i.quantity, updated_at = CURRENT_TIMESTAMP
+		FROM stock_reservation_items i
+		WHERE i.reservation_id = $1 AND p.id = i.product_id
+		RETURNING p.id, i.quantity, p.stock_quantity
+	`, reservationID)
+	if err != nil {
+		return err
+	}
+
+	type returned struct{ productID, quantity, stockQuantity int }
+	var changes []returned
+	for rows.Next() {
+		var c returned
+		if err := rows.Scan(&c.productID, &c.quantity, &c.stockQuantity); err != nil {
+			rows.Close()
+			return err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		if err := writeStockChanged(ctx, tx, c.productID, c.quantity, c.stockQuantity, status); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE stock_reservations SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2
+	`, status, reservationID)
+	return err
+}
+
+func confirmReservationHandler(w http.ResponseWriter, r *http.Request) {
+	reservationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Expiry is checked against the database clock, the one the sweeper uses,
+	// in the same statement that confirms
+	result, err := tx.ExecContext(r.Context(), `
+		UPDATE stock_reservations SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND status = $3 AND expires_at > NOW()
+	`, reservationConfirmed, reservationID, reservationHeld)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := reservationConfirmed
+	if n, _ := result.RowsAffected(); n == 0 {
+		status, err = lockReservation(r.Context(), tx, reservationID)
+	}
+	if err == errReservationNotFound {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case status == reservationConfirmed:
+		// Confirmed now, or already: confirming again is a no-op
+	case status == reservationHeld:
+		// Expired but not swept yet: return the stock now
+		if err = returnReservedStock(r.Context(), tx, reservationID, reservationExpired); err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Reservation expired", http.StatusConflict)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("Reservation is %s", status), http.StatusConflict)
+		return
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reservation, err := getReservation(r.Context(), reservationID)
+	writeReservation(w, reservation, err)
+}
+
+func releaseReservationHandler(w http.ResponseWriter, r *http.Request) {
+	reservationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	status, err := lockReservation(r.Context(), tx, reservationID)
+	if err == errReservationNotFound {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch status {
+	case reservationReleased, reservationExpired:
+		// Stock was already returned: releasing again is a no-op
+	case reservationHeld:
+		err = returnReservedStock(r.Context(), tx, reservationID, reservationReleased)
+	default:
+		http.Error(w, fmt.Sprintf("Reservation is %s", status), http.StatusConflict)
+		return
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reservation, err := getReservation(r.Context(), reservationID)
+	writeReservation(w, reservation, err)
+}
+
+// sweepExpiredReservations returns the stock of held reservations past their
+// expiry. Rows locked by a concurrent confirm or release are skipped and
+// picked up on the next sweep if still held.
+func sweepExpiredReservations(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM stock_reservations
+		WHERE status = $1 AND expires_at < NOW()
+		ORDER BY expires_at
+		LIMIT 100
+		FOR UPDATE SKIP LOCKED
+	`, reservationHeld)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := returnReservedStock(ctx, tx, id, reservationExpired); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), tx.Commit()
+}
+
+// runReservationSweeper sweeps expired reservations periodically until ctx
+// is cancelled.
+func runReservationSweeper(ctx context.Context) {
+	ticker := time.NewTicker(reservationSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := sweepExpiredReservations(ctx)
+		if err != nil {
+			slog.Error("Reservation sweep failed", "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Released expired reservations", "count", n)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+// Statements of the reservation handlers, matched as regular expressions
+const (
+	insertReservation  = `INSERT INTO stock_reservations \(reference, status, expires_at\)`
+	decrementStock     = `UPDATE products\s+SET stock_quantity = stock_quantity - \$1`
+	productExists      = `SELECT EXISTS \(SELECT 1 FROM products WHERE id = \$1\)`
+	selectReservation  = `SELECT id, reference, status, expires_at, created_at\s+FROM stock_reservations WHERE id = \$1`
+	selectItems        = `SELECT product_id, quantity FROM stock_reservation_items`
+	confirmHeld        = `UPDATE stock_reservations SET status = \$1, updated_at = CURRENT_TIMESTAMP\s+WHERE id = \$2 AND status = \$3 AND expires_at > NOW\(\)`
+	lockReservationRow = `SELECT status FROM stock_reservations WHERE id = \$1 FOR UPDATE`
+	returnStock        = `UPDATE products p\s+SET stock_quantity = p.stock_quantity \+ i.quantity`
+	insertOutbox       = `INSERT INTO outbox`
+	setReservation     = `UPDATE stock_reservations SET status = \$1, updated_at = CURRENT_TIMESTAMP WHERE id = \$2`
+)
+
+// useMockDB replaces the database with a sqlmock one for the test.
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = saved
+		mockDB.Close()
+	})
+	return mock
+}
+
+// serveReservation calls handler with body and the reservation ID route variable.
+func serveReservation(handler http.HandlerFunc, id, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/products/reservations", strings.NewReader(body))
+	if id != "" {
+		r = mux.SetURLVars(r, map[string]string{"id": id})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// expectReservation expects reservation 5 to be read back with status.
+func expectReservation(mock sqlmock.Sqlmock, status string) {
+	now := time.Now()
+	mock.ExpectQuery(selectReservation).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "reference", "status", "expires_at", "created_at"}).
+			AddRow(5, "checkout-42", status, now.Add(reservationTTL), now))
+	mock.ExpectQuery(selectItems).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"product_id", "quantity"}).AddRow(3, 2))
+}
+
+// expectStockReturned expects the held stock of reservation id to be
+// returned and the reservation moved to status.
+func expectStockReturned(mock sqlmock.Sqlmock, id int, status string) {
+	mock.ExpectQuery(returnStock).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quantity", "stock_quantity"}).AddRow(3, 2, 12))
+	mock.ExpectExec(insertOutbox).WithArgs("product", "3", "StockChanged", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(setReservation).WithArgs(status, id).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestCreateReservationReplaysReference(t *testing.T) {
+	mock := useMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertReservation).WithArgs("checkout-42", reservationHeld, reservationTTL.Seconds()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+	mock.ExpectQuery(`SELECT id FROM stock_reservations WHERE reference = \$1`).WithArgs("checkout-42").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	expectReservation(mock, reservationHeld)
+
+	w := serveReservation(createReservationHandler, "",
+		`{"reference": "checkout-42", "items": [{"product_id": 3, "quantity": 2}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var reservation Reservation
+	if err := json.NewDecoder(w.Body).Decode(&reservation); err != nil {
+		t.Fatal(err)
+	}
+	if reservation.ID != 5 || reservation.Status != reservationHeld {
+		t.Errorf("replay returned %+v, want held reservation 5", reservation)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateReservationGuardedDecrement(t *testing.T) {
+	tests := []struct {
+		name       string
+		exists     bool
+		wantStatus int
+	}{
+		{name: "insufficient stock", exists: true, wantStatus: http.StatusConflict},
+		{name: "unknown product", exists: false, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(insertReservation).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+			// Product 1 is decremented, product 3 has too little stock
+			mock.ExpectQuery(decrementStock).WithArgs(1, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"stock_quantity"}).AddRow(4))
+			mock.ExpectExec(insertOutbox).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO stock_reservation_items`).WithArgs(5, 1, 1).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(decrementStock).WithArgs(7, 3).WillReturnRows(sqlmock.NewRows([]string{"stock_quantity"}))
+			mock.ExpectQuery(productExists).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+			// Nothing is committed: the decrement of product 1 is rolled back
+			mock.ExpectRollback()
+
+			w := serveReservation(createReservationHandler, "",
+				`{"items": [{"product_id": 3, "quantity": 5}, {"product_id": 1, "quantity": 1}, {"product_id": 3, "quantity": 2}]}`)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCreateReservationCapsTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttlSeconds int
+		want       time.Duration
+	}{
+		{name: "default", want: reservationTTL},
+		{name: "shorter", ttlSeconds: 60, want: time.Minute},
+		{name: "at the maximum", ttlSeconds: int(reservationMaxTTL.Seconds()), want: reservationMaxTTL},
+		{name: "beyond the maximum", ttlSeconds: 30 * 24 * 3600, want: reservationMaxTTL},
+		{name: "overflowing", ttlSeconds: 1 << 62, want: reservationMaxTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(insertReservation).WithArgs(nil, reservationHeld, tt.want.Seconds()).
+				WillReturnError(errors.New("stop here"))
+			mock.ExpectRollback()
+
+			body, _ := json.Marshal(map[string]interface{}{
+				"items":       []ReservationItem{{ProductID: 3, Quantity: 1}},
+				"ttl_seconds": tt.ttlSeconds,
+			})
+			serveReservation(createReservationHandler, "", string(body))
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestConfirmExpiredReservation(t *testing.T) {
+	mock := useMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(confirmHeld).WithArgs(reservationConfirmed, 5, reservationHeld).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lockReservationRow).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(reservationHeld))
+	expectStockReturned(mock, 5, reservationExpired)
+	mock.ExpectCommit()
+
+	w := serveReservation(confirmReservationHandler, "5", "")
+	if w.Code != http.StatusConflict {
+		t.Errorf("status %d, want 409: %s", w.Code, w.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfirmReservation(t *testing.T) {
+	tests := []struct {
+		name       string
+		confirmed  bool   // the guarded UPDATE confirms the reservation
+		status     string // status found when it does not
+		wantStatus int
+	}{
+		{name: "held", confirmed: true, wantStatus: http.StatusOK},
+		{name: "already confirmed", status: reservationConfirmed, wantStatus: http.StatusOK},
+		{name: "released", status: reservationReleased, wantStatus: http.StatusConflict},
+		{name: "swept", status: reservationExpired, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			mock.ExpectBegin()
+			if tt.confirmed {
+				mock.ExpectExec(confirmHeld).WillReturnResult(sqlmock.NewResult(0, 1))
+			} else {
+				mock.ExpectExec(confirmHeld).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery(lockReservationRow).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(tt.status))
+			}
+			if tt.wantStatus == http.StatusOK {
+				mock.ExpectCommit()
+				expectReservation(mock, reservationConfirmed)
+			} else {
+				mock.ExpectRollback()
+			}
+
+			w := serveReservation(confirmReservationHandler, "5", "")
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestReleaseReservation(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		wantStatus int
+	}{
+		{name: "held", status: reservationHeld, wantStatus: http.StatusOK},
+		{name: "already released", status: reservationReleased, wantStatus: http.StatusOK},
+		{name: "expired", status: reservationExpired, wantStatus: http.StatusOK},
+		{name: "confirmed", status: reservationConfirmed, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockReservationRow).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(tt.status))
+			switch {
+			case tt.status == reservationHeld:
+				expectStockReturned(mock, 5, reservationReleased)
+				mock.ExpectCommit()
+				expectReservation(mock, reservationReleased)
+			case tt.wantStatus == http.StatusOK:
+				// Nothing to return a second time
+				mock.ExpectCommit()
+				expectReservation(mock, tt.status)
+			default:
+				mock.ExpectRollback()
+			}
+
+			w := serveReservation(releaseReservationHandler, "5", "")
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSweepExpiredReservations(t *testing.T) {
+	mock := useMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id FROM stock_reservations\s+WHERE status = \$1 AND expires_at < NOW\(\)[\s\S]+FOR UPDATE SKIP LOCKED`).
+		WithArgs(reservationHeld).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5).AddRow(6))
+	expectStockReturned(mock, 5, reservationExpired)
+	expectStockReturned(mock, 6, reservationExpired)
+	mock.ExpectCommit()
+
+	n, err := sweepExpiredReservations(context.Background())
+	if err != nil || n != 2 {
+		t.Errorf("sweep = %d, %v, want 2 reservations", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,189 @@
+// Package authz carries the caller identity the API gateway verified to the
+// services, and checks it against roles and permissions.
+//
+// The gateway validates the JWT, strips any identity headers the client sent
+// and forwards the user, roles and permissions from the token in the headers
+// below. Services calling each other on their own behalf send their name and
+// the permissions they need instead (see SetService). Either way the request
+// also carries the service token, a secret shared by the gateway and the
+// services; identity headers on requests without it are ignored, so a client
+// reaching a service directly cannot claim an identity.
+package authz
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"shared/config"
+)
+
+// Identity headers set by the gateway. Roles and permissions are comma
+// separated.
+const (
+	HeaderUserID      = "X-User-ID"
+	HeaderUserEmail   = "X-User-Email"
+	HeaderRoles       = "X-User-Roles"
+	HeaderPermissions = "X-User-Permissions"
+	HeaderService     = "X-Service-Name"
+	HeaderToken       = "X-Service-Token"
+)
+
+// serviceToken vouches for the identity headers of a request, see Setup.
+var serviceToken string
+
+// Setup reads SERVICE_TOKEN, the secret the gateway and the services send
+// with identity headers. It is required; without it no identity is trusted.
+func Setup(conf *config.Loader) {
+	serviceToken = conf.Secret("SERVICE_TOKEN", 32)
+}
+
+// SetToken adds the service token to h, vouching for the identity headers
+// the caller set on it.
+func SetToken(h http.Header) {
+	h.Set(HeaderToken, serviceToken)
+}
+
+// trusted reports whether r carries the service token.
+func trusted(r *http.Request) bool {
+	token := r.Header.Get(HeaderToken)
+	return serviceToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(serviceToken)) == 1
+}
+
+// RoleAdmin is granted every permission, and may act on any user's resources.
+const RoleAdmin = "admin"
+
+// Permissions granted through roles
+const (
+	ProductsWrite = "products:write"
+	StockWrite    = "products:stock"
+	OrdersStatus  = "orders:status"
+	RolesManage   = "roles:manage"
+)
+
+// Identity is the verified caller of a request: a user, or a service acting
+// on its own behalf, in which case only Service and Permissions are set.
+type Identity struct {
+	UserID      int
+	Email       string
+	Roles       []string
+	Permissions []string
+	Service     string
+}
+
+// IsService reports whether the caller is a service rather than a user.
+func (id *Identity) IsService() bool {
+	return id.Service != ""
+}
+
+// HasRole reports whether the caller was granted role.
+func (id *Identity) HasRole(role string) bool {
+	return slices.Contains(id.Roles, role)
+}
+
+// Can reports whether one of the caller's roles grants permission.
+func (id *Identity) Can(permission string) bool {
+	return slices.Contains(id.Permissions, permission)
+}
+
+// IsAdmin reports whether the caller has the admin role.
+func (id *Identity) IsAdmin() bool {
+	return id.HasRole(RoleAdmin)
+}
+
+// CanAccess reports whether the caller may act on resources owned by userID.
+func (id *Identity) CanAccess(userID int) bool {
+	return id.UserID == userID || id.IsAdmin()
+}
+
+// FromHeaders reads the identity the gateway or a calling service forwarded
+// with r. It returns nil for anonymous requests, including requests whose
+// identity headers come without the service token.
+func FromHeaders(r *http.Request) *Identity {
+	if !trusted(r) {
+		return nil
+	}
+	userID, err := strconv.Atoi(r.Header.Get(HeaderUserID))
+	if err != nil || userID <= 0 {
+		if service := r.Header.Get(HeaderService); service != "" {
+			return &Identity{Service: service, Permissions: SplitList(r.Header.Get(HeaderPermissions))}
+		}
+		return nil
+	}
+	return &Identity{
+		UserID:      userID,
+		Email:       r.Header.Get(HeaderUserEmail),
+		Roles:       SplitList(r.Header.Get(HeaderRoles)),
+		Permissions: SplitList(r.Header.Get(HeaderPermissions)),
+	}
+}
+
+// SetService marks a request to another service as made by service on its
+// own behalf, with permissions. Any user identity on h is removed.
+func SetService(h http.Header, service string, permissions ...string) {
+	for _, name := range []string{HeaderUserID, HeaderUserEmail, HeaderRoles} {
+		h.Del(name)
+	}
+	h.Set(HeaderService, service)
+	h.Set(HeaderPermissions, JoinList(permissions))
+	SetToken(h)
+}
+
+// JoinList formats roles or permissions for a header.
+func JoinList(values []string) string {
+	return strings.Join(values, ",")
+}
+
+// SplitList parses a header written with JoinList.
+func SplitList(header string) []string {
+	var values []string
+	for _, v := range strings.Split(header, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+type identityKey struct{}
+
+// FromContext returns the Identity stored by RequireIdentity, or nil.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// RequireIdentity rejects requests that did not come through the gateway
+// with a verified user and stores the caller's Identity in the request
+// context.
+func RequireIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := FromHeaders(r)
+		if id == nil || id.IsService() {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// Require wraps next so that it only serves callers granted permission,
+// users or services, and stores the caller's Identity in the request
+// context.
+func Require(permission string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := FromHeaders(r)
+		if id == nil {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !id.Can(permission) {
+			http.Error(w, "Permission "+permission+" required", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
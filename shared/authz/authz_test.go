@@ -0,0 +1,143 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shared/config"
+)
+
+const testToken = "0123456789abcdef0123456789abcdef"
+
+func useToken(t *testing.T) {
+	t.Helper()
+	saved := serviceToken
+	serviceToken = testToken
+	t.Cleanup(func() { serviceToken = saved })
+}
+
+func TestRequire(t *testing.T) {
+	useToken(t)
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"anonymous", map[string]string{HeaderToken: testToken}, http.StatusUnauthorized},
+		{"user without permission", map[string]string{HeaderToken: testToken, HeaderUserID: "1"}, http.StatusForbidden},
+		{"user with permission", map[string]string{HeaderToken: testToken, HeaderUserID: "1", HeaderPermissions: "products:write,products:stock"}, http.StatusNoContent},
+		{"service with permission", map[string]string{HeaderToken: testToken, HeaderService: "order-service", HeaderPermissions: StockWrite}, http.StatusNoContent},
+		{"service without permission", map[string]string{HeaderToken: testToken, HeaderService: "order-service"}, http.StatusForbidden},
+
+		// Identity headers sent straight to the service, bypassing the gateway
+		{"user without token", map[string]string{HeaderUserID: "1", HeaderPermissions: StockWrite}, http.StatusUnauthorized},
+		{"user with wrong token", map[string]string{HeaderToken: "guess", HeaderUserID: "1", HeaderPermissions: StockWrite}, http.StatusUnauthorized},
+		{"service without token", map[string]string{HeaderService: "order-service", HeaderPermissions: StockWrite}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Require(StockWrite, func(w http.ResponseWriter, r *http.Request) {
+				if FromContext(r.Context()) == nil {
+					t.Error("identity not stored in the request context")
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+			r := httptest.NewRequest(http.MethodPatch, "/api/products/1/stock", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireIdentityRejectsServices(t *testing.T) {
+	useToken(t)
+	handler := RequireIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+	SetService(r.Header, "order-service", StockWrite)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("service caller: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSetService(t *testing.T) {
+	useToken(t)
+	h := http.Header{}
+	h.Set(HeaderUserID, "7")
+	h.Set(HeaderRoles, RoleAdmin)
+	SetService(h, "order-service", StockWrite)
+
+	id := FromHeaders(&http.Request{Header: h})
+	if id == nil || !id.IsService() || id.Service != "order-service" || id.UserID != 0 {
+		t.Fatalf("FromHeaders = %+v, want the order-service identity", id)
+	}
+	if !id.Can(StockWrite) || id.IsAdmin() {
+		t.Errorf("service identity permissions %v roles %v", id.Permissions, id.Roles)
+	}
+}
+
+func TestFromHeadersWithoutToken(t *testing.T) {
+	saved := serviceToken
+	t.Cleanup(func() { serviceToken = saved })
+
+	// Not even an empty token matches while none is configured
+	serviceToken = ""
+	r := httptest.NewRequest(http.MethodGet, "/api/orders", nil)
+	r.Header.Set(HeaderUserID, "1")
+	r.Header.Set(HeaderRoles, RoleAdmin)
+	r.Header.Set(HeaderToken, "")
+	if id := FromHeaders(r); id != nil {
+		t.Errorf("FromHeaders = %+v without a configured token", id)
+	}
+
+	serviceToken = testToken
+	if id := FromHeaders(r); id != nil {
+		t.Errorf("FromHeaders = %+v without the token on the request", id)
+	}
+	SetToken(r.Header)
+	if id := FromHeaders(r); id == nil || id.UserID != 1 || !id.IsAdmin() {
+		t.Errorf("FromHeaders = %+v with the token", id)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	saved := serviceToken
+	t.Cleanup(func() { serviceToken = saved })
+
+	tests := []struct {
+		token   string
+		wantErr bool
+	}{
+		{token: "", wantErr: true},
+		{token: "too-short", wantErr: true},
+		{token: testToken},
+	}
+	for _, tt := range tests {
+		t.Setenv(config.FileEnv, "")
+		t.Setenv("SERVICE_TOKEN", tt.token)
+		conf, err := config.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		Setup(conf)
+		err = conf.Err()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SERVICE_TOKEN=%q: error %v, want error %v", tt.token, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "SERVICE_TOKEN") {
+			t.Errorf("error does not name SERVICE_TOKEN: %v", err)
+		}
+	}
+}
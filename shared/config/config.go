@@ -0,0 +1,274 @@
+// Package config loads service settings from environment variables, falling
+// back to an optional config file, so one image can be configured for local
+// runs, docker-compose and staging alike.
+//
+// Values are read through a Loader, which records every missing or malformed
+// setting instead of failing on the first one; services call Err once after
+// reading everything and refuse to start with the full list of problems.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileEnv names the environment variable pointing at the optional config file.
+const FileEnv = "CONFIG_FILE"
+
+// Loader looks settings up in the environment first and the config file second.
+type Loader struct {
+	file map[string]string
+	errs []string
+}
+
+// Load creates a Loader, reading the file named by CONFIG_FILE if it is set.
+// The file holds KEY=VALUE lines using the same keys as the environment;
+// blank lines and lines starting with # are ignored.
+func Load() (*Loader, error) {
+	l := &Loader{file: make(map[string]string)}
+
+	path := os.Getenv(FileEnv)
+	if path == "" {
+		return l, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("config: %s:%d: expected KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		l.file[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Lookup returns the value of key and whether it is set to a non-empty value.
+func (l *Loader) Lookup(key string) (string, bool) {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v, true
+	}
+	if v, ok := l.file[key]; ok && v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+// Expand replaces $KEY, ${KEY} and ${KEY:-default} references in s with
+// settings; a default may hold references itself. Keys set to an empty value
+// count as unset. $$ stands for a literal $, and positional references such
+// as $1 are kept, so values can hold regular expression replacements.
+// Malformed references, such as an unclosed ${KEY, are left as written.
+func (l *Loader) Expand(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch c := s[i+1]; {
+		case c == '$':
+			b.WriteByte('$')
+			i++
+		case c == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				b.WriteString(s[i:])
+				return b.String()
+			}
+			b.WriteString(l.expandRef(s[i+2:end], s[i:end+1]))
+			i = end
+		case isName(s[i+1 : i+2]):
+			end := i + 1
+			for end < len(s) && isNameChar(s[end]) {
+				end++
+			}
+			v, _ := l.Lookup(s[i+1 : end])
+			b.WriteString(v)
+			i = end - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
+
+// expandRef expands the reference ref found as raw, ${ref}.
+func (l *Loader) expandRef(ref, raw string) string {
+	if ref != "" && strings.Trim(ref, "0123456789") == "" {
+		return "$" + ref
+	}
+	key, def, hasDefault := strings.Cut(ref, ":-")
+	if !isName(key) {
+		return raw
+	}
+	if v, ok := l.Lookup(key); ok {
+		return v
+	}
+	if hasDefault {
+		return l.Expand(def)
+	}
+	return ""
+}
+
+// closingBrace returns the index of the } closing a reference whose body
+// starts at start, skipping nested braces and $$, or -1.
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			i++
+		case s[i] == '{':
+			depth++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// isName reports whether s can name a setting: letters, digits and
+// underscores, not starting with a digit.
+func isName(s string) bool {
+	if s == "" || isDigit(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || isDigit(c) || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// Invalid records a problem with key, for settings that need validation
+// beyond what the typed getters do.
+func (l *Loader) Invalid(key, format string, args ...interface{}) {
+	l.errs = append(l.errs, key+": "+fmt.Sprintf(format, args...))
+}
+
+// String returns key, or def if it is not set.
+func (l *Loader) String(key, def string) string {
+	if v, ok := l.Lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// Required returns key and records an error if it is not set.
+func (l *Loader) Required(key string) string {
+	v, ok := l.Lookup(key)
+	if !ok {
+		l.Invalid(key, "required but not set")
+	}
+	return v
+}
+
+// Secret returns key, which must be set and at least minLen bytes long.
+func (l *Loader) Secret(key string, minLen int) string {
+	v, ok := l.Lookup(key)
+	switch {
+	case !ok:
+		l.Invalid(key, "required but not set")
+	case len(v) < minLen:
+		l.Invalid(key, "must be at least %d characters", minLen)
+	}
+	return v
+}
+
+// OneOf returns key, or def if it is not set, and records an error if the
+// value is not one of allowed.
+func (l *Loader) OneOf(key, def string, allowed ...string) string {
+	v := l.String(key, def)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	l.Invalid(key, "%q is not one of %s", v, strings.Join(allowed, ", "))
+	return def
+}
+
+// Int returns key as an integer, or def if it is not set.
+func (l *Loader) Int(key string, def int) int {
+	v, ok := l.Lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.Invalid(key, "%q is not an integer", v)
+		return def
+	}
+	return n
+}
+
+// Duration returns key as a positive duration such as "30s", or def if it is
+// not set.
+func (l *Loader) Duration(key string, def time.Duration) time.Duration {
+	v, ok := l.Lookup(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		l.Invalid(key, "%q is not a positive duration", v)
+		return def
+	}
+	return d
+}
+
+// URL returns key, or def if it is not set, and records an error unless the
+// value is an absolute http or https URL.
+func (l *Loader) URL(key, def string) string {
+	v := l.String(key, def)
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.Invalid(key, "%q is not an absolute http(s) URL", v)
+		return def
+	}
+	return strings.TrimRight(v, "/")
+}
+
+// Err reports every problem recorded so far, or nil if there were none.
+func (l *Loader) Err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(l.errs, "\n\t"))
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLoader returns a Loader over env, with file as its config file.
+func testLoader(t *testing.T, env map[string]string, file string) *Loader {
+	t.Helper()
+	t.Setenv(FileEnv, "")
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "service.env")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(FileEnv, path)
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	l, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestExpand(t *testing.T) {
+	l := testLoader(t, map[string]string{
+		"HOST":     "product-service",
+		"PORT":     "8002",
+		"EMPTY":    "",
+		"FALLBACK": "http://fallback:8000",
+	}, "FROM_FILE=file-value\n")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "braced", in: "http://${HOST}:${PORT}", want: "http://product-service:8002"},
+		{name: "bare", in: "http://$HOST:$PORT/", want: "http://product-service:8002/"},
+		{name: "from config file", in: "${FROM_FILE}", want: "file-value"},
+		{name: "no references", in: "plain text { }", want: "plain text { }"},
+
+		// Unset and empty settings
+		{name: "unset", in: "[${MISSING}]", want: "[]"},
+		{name: "unset with default", in: "${MISSING:-http://localhost:8002}", want: "http://localhost:8002"},
+		{name: "empty counts as unset", in: "${EMPTY:-default}", want: "default"},
+		{name: "empty without default", in: "[${EMPTY}]", want: "[]"},
+		{name: "set ignores default", in: "${HOST:-other}", want: "product-service"},
+		{name: "empty default", in: "[${MISSING:-}]", want: "[]"},
+		{name: "default with colon", in: "${MISSING:-http://x:1}", want: "http://x:1"},
+
+		// Nested defaults
+		{name: "nested default used", in: "${MISSING:-${FALLBACK}}", want: "http://fallback:8000"},
+		{name: "nested default unused", in: "${HOST:-${FALLBACK}}", want: "product-service"},
+		{name: "nested twice", in: "${MISSING:-${ALSO_MISSING:-${PORT}}}", want: "8002"},
+		{name: "nested with text", in: "${MISSING:-http://${HOST}:${PORT:-80}/api}", want: "http://product-service:8002/api"},
+
+		// Literal dollars and regular expression replacements
+		{name: "escaped dollar", in: "price $$5", want: "price $5"},
+		{name: "escaped reference", in: "$${HOST}", want: "${HOST}"},
+		{name: "escaped in default", in: "${MISSING:-/api/$${id}}", want: "/api/${id}"},
+		{name: "positional", in: "/api/products/$1", want: "/api/products/$1"},
+		{name: "braced positional", in: "/api/${2}/x", want: "/api/$2/x"},
+		{name: "trailing dollar", in: "cost$", want: "cost$"},
+		{name: "dollar before symbol", in: "a$-b", want: "a$-b"},
+
+		// Malformed references are kept
+		{name: "unclosed", in: "http://${HOST", want: "http://${HOST"},
+		{name: "unclosed nested", in: "${MISSING:-${HOST}", want: "${MISSING:-${HOST}"},
+		{name: "empty name", in: "x${}y", want: "x${}y"},
+		{name: "invalid name", in: "${HOST NAME}", want: "${HOST NAME}"},
+		{name: "unsupported operator", in: "${HOST:=x}", want: "${HOST:=x}"},
+		{name: "malformed then valid", in: "${1a} ${HOST}", want: "${1a} product-service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Expand(tt.in); got != tt.want {
+				t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupPrecedence(t *testing.T) {
+	l := testLoader(t, map[string]string{"BOTH": "env", "EMPTY_ENV": ""}, `
+# comment
+BOTH=file
+EMPTY_ENV=from-file
+export QUOTED="quoted value"
+SINGLE='single'
+`)
+	tests := []struct {
+		key    string
+		want   string
+		wantOK bool
+	}{
+		{"BOTH", "env", true},
+		{"EMPTY_ENV", "from-file", true},
+		{"QUOTED", "quoted value", true},
+		{"SINGLE", "single", true},
+		{"NOWHERE", "", false},
+	}
+	for _, tt := range tests {
+		if v, ok := l.Lookup(tt.key); v != tt.want || ok != tt.wantOK {
+			t.Errorf("Lookup(%q) = %q, %v, want %q, %v", tt.key, v, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestLoadMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.env")
+	if err := os.WriteFile(path, []byte("GOOD=1\nnot a setting\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(FileEnv, path)
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("Load = %v, want an error for line 2", err)
+	}
+
+	t.Setenv(FileEnv, filepath.Join(t.TempDir(), "missing.env"))
+	if _, err := Load(); err == nil {
+		t.Error("Load succeeded with a missing config file")
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	l := testLoader(t, map[string]string{
+		"WORKERS":  "8",
+		"BAD_INT":  "eight",
+		"TIMEOUT":  "250ms",
+		"BAD_TIME": "soon",
+		"STORE":    "redis",
+		"BAD_ONE":  "disk",
+		"SITE":     "http://example.com/",
+		"BAD_URL":  "example.com",
+	}, "")
+
+	if got := l.Int("WORKERS", 1); got != 8 {
+		t.Errorf("Int = %d, want 8", got)
+	}
+	if got := l.Int("UNSET_INT", 3); got != 3 {
+		t.Errorf("Int default = %d, want 3", got)
+	}
+	if got := l.Duration("TIMEOUT", time.Second); got != 250*time.Millisecond {
+		t.Errorf("Duration = %v, want 250ms", got)
+	}
+	if got := l.OneOf("STORE", "memory", "memory", "redis"); got != "redis" {
+		t.Errorf("OneOf = %q, want redis", got)
+	}
+	if got := l.URL("SITE", ""); got != "http://example.com" {
+		t.Errorf("URL = %q, want the trailing slash trimmed", got)
+	}
+	if err := l.Err(); err != nil {
+		t.Fatalf("Err = %v for valid settings", err)
+	}
+
+	l.Int("BAD_INT", 1)
+	l.Duration("BAD_TIME", time.Second)
+	l.OneOf("BAD_ONE", "memory", "memory", "redis")
+	l.URL("BAD_URL", "")
+	l.Required("REQUIRED_BUT_UNSET")
+	err := l.Err()
+	if err == nil {
+		t.Fatal("Err = nil after invalid settings")
+	}
+	for _, key := range []string{"BAD_INT", "BAD_TIME", "BAD_ONE", "BAD_URL", "REQUIRED_BUT_UNSET"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Err does not report %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Database holds PostgreSQL connection settings.
+type Database struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+}
+
+// Database reads DB_HOST, DB_PORT, DB_USER, DB_PASSWORD, DB_NAME and
+// DB_SSLMODE. The defaults match the docker-compose setup.
+func (l *Loader) Database(defaultName string) Database {
+	db := Database{
+		Host:     l.String("DB_HOST", "postgres"),
+		Port:     l.Int("DB_PORT", 5432),
+		User:     l.String("DB_USER", "postgres"),
+		Password: l.String("DB_PASSWORD", "postgres"),
+		Name:     l.String("DB_NAME", defaultName),
+		SSLMode:  l.OneOf("DB_SSLMODE", "disable", "disable", "allow", "prefer", "require", "verify-ca", "verify-full"),
+	}
+	if db.Port <= 0 || db.Port > 65535 {
+		l.Invalid("DB_PORT", "%d is not a valid port", db.Port)
+	}
+	return db
+}
+
+// DSN returns the connection string for lib/pq.
+func (d Database) DSN() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quote(d.Host), d.Port, quote(d.User), quote(d.Password), quote(d.Name), d.SSLMode)
+}
+
+// quote escapes a value for a key=value connection string.
+func quote(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return "'" + strings.ReplaceAll(v, `'`, `\'`) + "'"
+}
+
+// Server holds the listen address and timeouts of a service's HTTP server.
+type Server struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout bounds the draining of in-flight requests on shutdown.
+	ShutdownTimeout time.Duration
+}
+
+// Server reads LISTEN_ADDR (or PORT), the HTTP_*_TIMEOUT settings and
+// SHUTDOWN_TIMEOUT.
+func (l *Loader) Server(defaultPort int) Server {
+	addr := fmt.Sprintf(":%d", l.Int("PORT", defaultPort))
+	return Server{
+		Addr:              l.String("LISTEN_ADDR", addr),
+		ReadHeaderTimeout: l.Duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       l.Duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:      l.Duration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       l.Duration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		ShutdownTimeout:   l.Duration("SHUTDOWN_TIMEOUT", 20*time.Second),
+	}
+}
+
+// HTTPServer returns an http.Server serving h with these settings.
+func (s Server) HTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              s.Addr,
+		Handler:           h,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+	}
+}
@@ -0,0 +1,230 @@
+// Package discovery registers a service instance with the API gateway's
+// registry and keeps its lease alive with heartbeats.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"shared/config"
+)
+
+const (
+	headerRegistryToken      = "X-Registry-Token"
+	defaultHeartbeatInterval = 10 * time.Second
+	maxRetryDelay            = 30 * time.Second
+)
+
+// Registration describes the instance announced to the registry.
+type Registration struct {
+	ID       string            `json:"id,omitempty"`
+	Service  string            `json:"service"`
+	URL      string            `json:"url"`
+	Version  string            `json:"version,omitempty"`
+	Weight   int               `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Client keeps one instance registered with the gateway.
+type Client struct {
+	RegistryURL  string
+	Token        string
+	Registration Registration
+	HTTPClient   *http.Client
+}
+
+// lease is the registry's answer to a registration or heartbeat.
+type lease struct {
+	ID                       string `json:"id"`
+	HeartbeatIntervalSeconds int    `json:"heartbeat_interval_seconds"`
+}
+
+type statusError struct {
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("registry returned %d", e.StatusCode)
+}
+
+// FromConfig builds a Client for service from REGISTRY_URL, REGISTRY_TOKEN,
+// SERVICE_URL, SERVICE_ID, SERVICE_VERSION, SERVICE_WEIGHT and
+// SERVICE_METADATA ("key=value,key=value"). It returns nil when REGISTRY_URL is not set.
+// SERVICE_URL defaults to the host name and the port of server.
+func FromConfig(conf *config.Loader, service string, server config.Server) *Client {
+	if _, ok := conf.Lookup("REGISTRY_URL"); !ok {
+		return nil
+	}
+
+	_, port, _ := net.SplitHostPort(server.Addr)
+	hostname, _ := os.Hostname()
+	defaultURL := fmt.Sprintf("http://%s", net.JoinHostPort(hostname, port))
+
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(conf.String("SERVICE_METADATA", ""), ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			metadata[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return &Client{
+		RegistryURL: conf.URL("REGISTRY_URL", ""),
+		Token:       conf.String("REGISTRY_TOKEN", ""),
+		Registration: Registration{
+			ID:       conf.String("SERVICE_ID", ""),
+			Service:  service,
+			URL:      conf.URL("SERVICE_URL", defaultURL),
+			Version:  conf.String("SERVICE_VERSION", "dev"),
+			Weight:   conf.Int("SERVICE_WEIGHT", 1),
+			Metadata: metadata,
+		},
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Start runs Run in the background. The returned function waits until the
+// instance has been deregistered after ctx is cancelled, as a shutdown step.
+// A nil Client (registration disabled) does nothing.
+func (c *Client) Start(ctx context.Context) func(context.Context) error {
+	done := make(chan struct{})
+	if c == nil {
+		close(done)
+	} else {
+		go func() {
+			defer close(done)
+			c.Run(ctx)
+		}()
+	}
+	return func(wait context.Context) error {
+		select {
+		case <-done:
+			return nil
+		case <-wait.Done():
+			return wait.Err()
+		}
+	}
+}
+
+// Run registers the instance, sends heartbeats until ctx is cancelled and
+// then deregisters. Registration is retried with backoff while the gateway
+// is unreachable, and repeated whenever the gateway no longer knows the
+// instance (e.g. after a restart or an eviction).
+func (c *Client) Run(ctx context.Context) {
+	interval := c.register(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.deregister()
+			return
+		case <-timer.C:
+		}
+
+		l, err := c.call(ctx, http.MethodPut, c.instancePath()+"/heartbeat", nil)
+		if se, ok := err.(*statusError); ok && se.StatusCode == http.StatusNotFound {
+			slog.Warn("Discovery: registry lost instance, registering again", "instance_id", c.Registration.ID)
+			interval = c.register(ctx)
+		} else if err != nil {
+			slog.Warn("Discovery: heartbeat failed", "error", err)
+		} else {
+			interval = heartbeatInterval(l)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// register retries until the registry accepts the instance or ctx ends and
+// returns the heartbeat interval to use.
+func (c *Client) register(ctx context.Context) time.Duration {
+	delay := time.Second
+	for {
+		l, err := c.call(ctx, http.MethodPost, "/registry/instances", c.Registration)
+		if err == nil {
+			c.Registration.ID = l.ID
+			slog.Info("Discovery: registered", "service", c.Registration.Service, "instance_id", l.ID, "url", c.Registration.URL)
+			return heartbeatInterval(l)
+		}
+		slog.Warn("Discovery: registration failed", "retry_in", delay.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (c *Client) deregister() {
+	// The run context is already cancelled, so use a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.call(ctx, http.MethodDelete, c.instancePath(), nil); err != nil {
+		slog.Warn("Discovery: deregistration failed", "error", err)
+	}
+}
+
+func (c *Client) instancePath() string {
+	return "/registry/instances/" + url.PathEscape(c.Registration.Service) + "/" + url.PathEscape(c.Registration.ID)
+}
+
+func (c *Client) call(ctx context.Context, method, path string, body interface{}) (*lease, error) {
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.RegistryURL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set(headerRegistryToken, c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return nil, &statusError{StatusCode: resp.StatusCode}
+	}
+	l := &lease{}
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(l); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func heartbeatInterval(l *lease) time.Duration {
+	if l.HeartbeatIntervalSeconds <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return time.Duration(l.HeartbeatIntervalSeconds) * time.Second
+}
@@ -0,0 +1,67 @@
+// Package graceful runs the HTTP server of a binary and shuts it down
+// cleanly: on SIGINT or SIGTERM it stops accepting connections, lets
+// in-flight requests finish within the shutdown timeout, then runs the
+// cleanup steps (flushing the outbox and traces, closing the database).
+package graceful
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
+
+	"shared/config"
+)
+
+// Cleanup is a named shutdown step, run once the server has drained.
+type Cleanup struct {
+	Name string
+	Fn   func(ctx context.Context) error
+}
+
+// SignalContext returns a context cancelled on SIGINT or SIGTERM. Background
+// workers started with it stop when the process is asked to exit.
+func SignalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// Run serves h with the settings of conf until ctx ends, then shuts down:
+// the listener is closed, in-flight requests get conf.ShutdownTimeout to
+// complete, and the cleanup steps run in order within a fresh timeout of the
+// same length. It returns an error only if the server could not start.
+func Run(ctx context.Context, conf config.Server, h http.Handler, cleanups ...Cleanup) error {
+	srv := conf.HTTPServer(h)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, draining in-flight requests", "timeout", conf.ShutdownTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("Requests still running at the shutdown deadline, closing connections", "error", err)
+		srv.Close()
+	}
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server failed", "error", err)
+	}
+
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	for _, c := range cleanups {
+		if err := c.Fn(cleanupCtx); err != nil {
+			slog.Warn("Shutdown step failed", "step", c.Name, "error", err)
+		}
+	}
+	slog.Info("Shutdown complete")
+	return nil
+}
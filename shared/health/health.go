@@ -0,0 +1,194 @@
+// Package health serves the liveness and readiness endpoints of a service.
+// Liveness only says the process is up; readiness runs every registered
+// check (database, schema, dependencies) and fails if any of them does, so
+// orchestrators and the gateway stop routing traffic to a broken instance.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"shared/config"
+)
+
+const defaultTimeout = 2 * time.Second
+
+// CheckFunc reports why a dependency is not usable, or nil if it is.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker holds the readiness checks of one service.
+type Checker struct {
+	Service string
+	// Timeout bounds every readiness check.
+	Timeout time.Duration
+
+	started time.Time
+	checks  []check
+}
+
+// FromConfig returns a Checker for service with the timeout read from
+// READINESS_TIMEOUT.
+func FromConfig(conf *config.Loader, service string) *Checker {
+	return &Checker{
+		Service: service,
+		Timeout: conf.Duration("READINESS_TIMEOUT", defaultTimeout),
+		started: time.Now(),
+	}
+}
+
+// Add registers a readiness check under name.
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Liveness reports that the process is running. It never touches
+// dependencies, so a database outage does not get the instance restarted.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "ok",
+		"service":        c.Service,
+		"uptime_seconds": int(time.Since(c.started).Seconds()),
+	})
+}
+
+// Readiness runs all checks concurrently and answers 503 unless every one
+// of them passed.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	results := c.Run(r.Context())
+
+	status, code := "ready", http.StatusOK
+	for _, res := range results {
+		if res.Status != "ok" {
+			status, code = "not_ready", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status":  status,
+		"service": c.Service,
+		"checks":  results,
+	})
+}
+
+// Run executes every check with the configured timeout.
+func (c *Checker) Run(ctx context.Context) map[string]CheckResult {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]CheckResult, len(c.checks))
+	for _, chk := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := chk.fn(ctx)
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("no answer within %v: %w", timeout, err)
+			}
+			res := CheckResult{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				res.Status, res.Error = "failed", err.Error()
+			}
+
+			mu.Lock()
+			results[chk.name] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Database checks that db accepts connections.
+func Database(db *sql.DB) CheckFunc {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// Migrations checks that dbmate has applied every listed migration version
+// to db.
+func Migrations(db *sql.DB, versions ...string) CheckFunc {
+	return func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+		if err != nil {
+			return fmt.Errorf("read schema_migrations: %w", err)
+		}
+		defer rows.Close()
+
+		applied := make(map[string]bool)
+		for rows.Next() {
+			var version string
+			if err := rows.Scan(&version); err != nil {
+				return err
+			}
+			applied[version] = true
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var pending []string
+		for _, v := range versions {
+			if !applied[v] {
+				pending = append(pending, v)
+			}
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+		}
+		return nil
+	}
+}
+
+// HTTP checks that GET url answers with a 2xx status.
+func HTTP(client *http.Client, url string) CheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
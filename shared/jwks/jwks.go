@@ -0,0 +1,95 @@
+// Package jwks converts the public keys tokens are signed with to and from
+// JSON Web Key Sets (RFC 7517), as served by user-service on
+// /.well-known/jwks.json. Ed25519 keys (alg EdDSA) and RSA keys (alg RS256)
+// are supported.
+package jwks
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Algorithms of the supported keys, as used in JWT headers
+const (
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+// Key is one JSON Web Key.
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// OKP (Ed25519) keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// Set is a JSON Web Key Set.
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// New returns the signature verification key kid for pub.
+func New(kid string, pub crypto.PublicKey) (Key, error) {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return Key{Kty: "OKP", Kid: kid, Use: "sig", Alg: EdDSA, Crv: "Ed25519", X: b64.EncodeToString(pub)}, nil
+	case *rsa.PublicKey:
+		return Key{
+			Kty: "RSA", Kid: kid, Use: "sig", Alg: RS256,
+			N: b64.EncodeToString(pub.N.Bytes()),
+			E: b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	}
+	return Key{}, fmt.Errorf("jwks: unsupported key type %T", pub)
+}
+
+// PublicKey returns the key k describes.
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("jwks: unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("jwks: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, errors.New("jwks: invalid RSA modulus")
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("jwks: invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("jwks: unsupported key type %q", k.Kty)
+}
+
+// Algorithm is the signing algorithm of k. Keys that do not name one get
+// the only algorithm supported for their type.
+func (k Key) Algorithm() string {
+	if k.Alg != "" {
+		return k.Alg
+	}
+	if k.Kty == "RSA" {
+		return RS256
+	}
+	return EdDSA
+}
@@ -0,0 +1,114 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pub     interface{}
+		wantKty string
+		wantAlg string
+	}{
+		{name: "Ed25519", pub: edPub, wantKty: "OKP", wantAlg: EdDSA},
+		{name: "RSA", pub: &rsaKey.PublicKey, wantKty: "RSA", wantAlg: RS256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := New("k1", tt.pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.Kty != tt.wantKty || k.Alg != tt.wantAlg || k.Kid != "k1" || k.Use != "sig" {
+				t.Errorf("key %+v", k)
+			}
+			// e is encoded without leading zero bytes
+			if k.Kty == "RSA" && k.E != "AQAB" {
+				t.Errorf("e = %q, want AQAB for 65537", k.E)
+			}
+
+			// Through JSON, as the gateway receives it
+			data, err := json.Marshal(Set{Keys: []Key{k}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var set Set
+			if err := json.Unmarshal(data, &set); err != nil {
+				t.Fatal(err)
+			}
+			pub, err := set.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pub, tt.pub) {
+				t.Errorf("PublicKey() = %v, want %v", pub, tt.pub)
+			}
+		})
+	}
+}
+
+func TestNewUnsupported(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New("k1", &ecKey.PublicKey); err == nil {
+		t.Error("New accepted an ECDSA key")
+	}
+}
+
+func TestPublicKeyInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  Key
+	}{
+		{name: "unknown type", key: Key{Kty: "EC", Crv: "P-256", X: "AA"}},
+		{name: "unsupported curve", key: Key{Kty: "OKP", Crv: "X25519", X: "AAAA"}},
+		{name: "short Ed25519 key", key: Key{Kty: "OKP", Crv: "Ed25519", X: "AAAA"}},
+		{name: "Ed25519 key not base64url", key: Key{Kty: "OKP", Crv: "Ed25519", X: "+/+/"}},
+		{name: "no RSA modulus", key: Key{Kty: "RSA", E: "AQAB"}},
+		{name: "no RSA exponent", key: Key{Kty: "RSA", N: "AQAB"}},
+		{name: "RSA exponent too long", key: Key{Kty: "RSA", N: "AQAB", E: "AQABAQAB"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pub, err := tt.key.PublicKey(); err == nil {
+				t.Errorf("PublicKey() = %v, want an error", pub)
+			}
+		})
+	}
+}
+
+func TestAlgorithm(t *testing.T) {
+	tests := []struct {
+		key  Key
+		want string
+	}{
+		{key: Key{Kty: "OKP", Alg: EdDSA}, want: EdDSA},
+		{key: Key{Kty: "RSA", Alg: RS256}, want: RS256},
+		{key: Key{Kty: "OKP"}, want: EdDSA},
+		{key: Key{Kty: "RSA"}, want: RS256},
+	}
+	for _, tt := range tests {
+		if got := tt.key.Algorithm(); got != tt.want {
+			t.Errorf("Algorithm() of %+v = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
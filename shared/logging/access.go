@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// headerUserID is set by the gateway to the verified caller.
+const headerUserID = "X-User-ID"
+
+type accessKey struct{}
+
+// accessEntry collects what handlers know about the request being logged.
+type accessEntry struct {
+	route string
+}
+
+// Middleware writes one access log line per request with the method, route
+// template, status, response size, duration, request ID and user ID. Server
+// errors are logged at error level. Used as a gorilla/mux middleware the
+// route is the route template; handlers can set a better one with SetRoute.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				entry.route = tpl
+			}
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessKey{}, entry)))
+
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", entry.route),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		// The gateway sets the header once the caller is authenticated
+		if userID := r.Header.Get(headerUserID); userID != "" {
+			attrs = append(attrs, slog.String("user_id", userID))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// SetRoute sets the route logged for the request being handled.
+func SetRoute(ctx context.Context, route string) {
+	if entry, ok := ctx.Value(accessKey{}).(*accessEntry); ok {
+		entry.route = route
+	}
+}
+
+// responseRecorder remembers the status code and counts the bytes written
+// through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,115 @@
+// Package logging configures log/slog for the gateway and the services.
+// Records are written as JSON (or text) lines with the service name, the
+// request and trace IDs of the context they were logged with, and sensitive
+// fields such as passwords, tokens and Authorization headers redacted.
+//
+// Setup also routes the standard log package through the same handler, so
+// nothing is written in another format.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"shared/config"
+	"shared/tracing"
+)
+
+// Redacted replaces the value of sensitive fields.
+const Redacted = "[REDACTED]"
+
+// Formats and levels selectable with LOG_FORMAT and LOG_LEVEL.
+var (
+	Formats = []string{"json", "text"}
+	Levels  = []string{"debug", "info", "warn", "error"}
+)
+
+// Setup installs the default logger for service, configured from LOG_LEVEL
+// (default info) and LOG_FORMAT (default json). Problems are recorded on
+// conf.
+func Setup(conf *config.Loader, service string) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(conf.OneOf("LOG_LEVEL", "info", Levels...)))
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+
+	var h slog.Handler
+	if conf.OneOf("LOG_FORMAT", "json", Formats...) == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	logger := slog.New(contextHandler{h}).With("service", service)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request and trace IDs carried by the context to
+// every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := tracing.RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// sensitive reports whether a field or header named key must not be logged.
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	switch key {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key", "api_key", "token", "dsn":
+		return true
+	}
+	return strings.Contains(key, "password") || strings.Contains(key, "secret") ||
+		strings.HasSuffix(key, "_token") || strings.HasSuffix(key, "-token")
+}
+
+// redact blanks sensitive attributes and the sensitive entries of logged
+// http.Header values.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	if a.Value.Kind() == slog.KindAny {
+		if h, ok := a.Value.Any().(http.Header); ok {
+			return slog.Any(a.Key, redactHeader(h))
+		}
+	}
+	return a
+}
+
+func redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if sensitive(name) {
+			values = []string{Redacted}
+		}
+		out[name] = values
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+// Package metrics exposes Prometheus metrics on /metrics: HTTP request
+// counts, latencies and in-flight requests by route, database pool
+// statistics and the Go runtime collectors. Services register their own
+// business counters with promauto next to the code that updates them.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute labels requests that did not match any route, so that
+// arbitrary paths do not each create a new series.
+const unmatchedRoute = "unmatched"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time to handle HTTP requests, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests currently being handled.",
+	})
+)
+
+type routeKey struct{}
+
+// routeLabel is filled in while the request is handled.
+type routeLabel struct {
+	name string
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterDB exports the connection pool statistics of db (db.Stats()),
+// labelled with the database name.
+func RegisterDB(db *sql.DB, name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// Middleware counts and times requests. Used as a gorilla/mux middleware the
+// route label is the route template; handlers can set a better one with
+// SetRoute.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		label := &routeLabel{}
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				label.name = tpl
+			}
+		}
+
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey{}, label)))
+
+		if label.name == "" {
+			label.name = unmatchedRoute
+		}
+		requestsTotal.WithLabelValues(r.Method, label.name, strconv.Itoa(rec.status)).Inc()
+		requestDuration.WithLabelValues(r.Method, label.name).Observe(time.Since(start).Seconds())
+	})
+}
+
+// SetRoute sets the route label of the request being handled. route must
+// come from a bounded set, such as route templates or names.
+func SetRoute(ctx context.Context, route string) {
+	if label, ok := ctx.Value(routeKey{}).(*routeLabel); ok {
+		label.name = route
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,59 @@
+// Package outbox implements the transactional outbox pattern: services write
+// domain events to an outbox table in the same transaction as the state change
+// they describe, and a Relay delivers them to a Sink afterwards. Delivery is
+// at-least-once, so consumers must tolerate duplicates (the event ID is stable
+// across redeliveries).
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Domain event types published by the services.
+const (
+	UserRegistered     = "UserRegistered"
+	UserRoleGranted    = "UserRoleGranted"
+	UserRoleRevoked    = "UserRoleRevoked"
+	ProductCreated     = "ProductCreated"
+	StockChanged       = "StockChanged"
+	OrderPlaced        = "OrderPlaced"
+	OrderStatusChanged = "OrderStatusChanged"
+)
+
+// Event is a domain event as stored in the outbox table.
+type Event struct {
+	ID            int64           `json:"id"`
+	Source        string          `json:"source"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateID   string          `json:"aggregate_id"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+}
+
+// Execer is the part of *sql.Tx used to write events. Passing the
+// transaction that performs the state change makes both commit together.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Write appends an event to the outbox. payload is encoded as JSON.
+func Write(ctx context.Context, tx Execer, aggregateType string, aggregateID interface{}, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("outbox: encode %s payload: %w", eventType, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox (aggregate_type, aggregate_id, event_type, payload)
+		VALUES ($1, $2, $3, $4)
+	`, aggregateType, fmt.Sprint(aggregateID), eventType, string(data))
+	if err != nil {
+		return fmt.Errorf("outbox: write %s: %w", eventType, err)
+	}
+	return nil
+}
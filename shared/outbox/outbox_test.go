@@ -0,0 +1,82 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWrite(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO outbox \(aggregate_type, aggregate_id, event_type, payload\)`).
+		WithArgs("order", "42", OrderPlaced, `{"total":10}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(context.Background(), tx, "order", 42, OrderPlaced, map[string]int{"total": 10}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO outbox`).WillReturnError(errors.New("connection reset"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Write(context.Background(), tx, "order", 1, OrderPlaced, map[string]int{})
+	if err == nil || !strings.Contains(err.Error(), "write OrderPlaced") {
+		t.Errorf("Write with failing exec = %v, want write error", err)
+	}
+
+	err = Write(context.Background(), tx, "order", 1, OrderPlaced, func() {})
+	if err == nil || !strings.Contains(err.Error(), "encode OrderPlaced payload") {
+		t.Errorf("Write with unencodable payload = %v, want encode error", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteHonoursContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Write(ctx, tx, "order", 1, OrderPlaced, map[string]int{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write with cancelled context = %v, want context.Canceled", err)
+	}
+}
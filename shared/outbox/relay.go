@@ -0,0 +1,137 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultBatchSize = 100
+	defaultInterval  = time.Second
+)
+
+// Relay polls the outbox table and hands unpublished events to a Sink in ID
+// order. An event is marked published only after the sink accepted it, so a
+// crash in between leads to redelivery, never to loss.
+type Relay struct {
+	DB   *sql.DB
+	Sink Sink
+	// Source names the publishing service and is copied into every event.
+	Source    string
+	BatchSize int
+	Interval  time.Duration
+}
+
+// Run relays events until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Drain everything that is ready before waiting again
+		for {
+			n, err := r.RelayBatch(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "Outbox relay failed", "error", err)
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush publishes the events still pending until none are left or ctx ends.
+// Services call it on shutdown, after Run has stopped, so events committed
+// by the last requests are not left waiting for the next start.
+func (r *Relay) Flush(ctx context.Context) error {
+	for {
+		n, err := r.RelayBatch(ctx)
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// RelayBatch publishes up to BatchSize pending events and returns how many
+// were published. Rows are locked with SKIP LOCKED so several instances of a
+// service can run relays against the same table.
+func (r *Relay) RelayBatch(ctx context.Context) (int, error) {
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, aggregate_type, aggregate_id, event_type, payload, occurred_at
+		FROM outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []Event
+	for rows.Next() {
+		e := Event{Source: r.Source}
+		var payload string
+		if err := rows.Scan(&e.ID, &e.AggregateType, &e.AggregateID, &e.Type, &payload, &e.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.Payload = []byte(payload)
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, e := range events {
+		if err := r.Sink.Publish(ctx, e); err != nil {
+			// Stop at the first failure to keep per-table ordering
+			tx.ExecContext(ctx, `
+				UPDATE outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2
+			`, err.Error(), e.ID)
+			slog.WarnContext(ctx, "Outbox relay: publish failed", "event_type", e.Type, "event_id", e.ID, "error", err)
+			break
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE outbox SET published_at = CURRENT_TIMESTAMP, attempts = attempts + 1, last_error = NULL
+			WHERE id = $1
+		`, e.ID); err != nil {
+			return 0, err
+		}
+		published++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return published, nil
+}
@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	selectPending = `SELECT id, aggregate_type, aggregate_id, event_type, payload, occurred_at\s+FROM outbox\s+WHERE published_at IS NULL\s+ORDER BY id\s+LIMIT \$1\s+FOR UPDATE SKIP LOCKED`
+	markPublished = `UPDATE outbox SET published_at = CURRENT_TIMESTAMP, attempts = attempts \+ 1, last_error = NULL`
+	markFailed    = `UPDATE outbox SET attempts = attempts \+ 1, last_error = \$1 WHERE id = \$2`
+)
+
+// recordingSink records published event IDs and fails on the IDs in fail.
+type recordingSink struct {
+	published []int64
+	fail      map[int64]error
+}
+
+func (s *recordingSink) Publish(ctx context.Context, e Event) error {
+	if err := s.fail[e.ID]; err != nil {
+		return err
+	}
+	s.published = append(s.published, e.ID)
+	return nil
+}
+
+func pendingRows(ids ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "aggregate_type", "aggregate_id", "event_type", "payload", "occurred_at"})
+	for _, id := range ids {
+		rows.AddRow(id, "order", "1", OrderPlaced, `{}`, time.Unix(0, 0))
+	}
+	return rows
+}
+
+func TestRelayBatch(t *testing.T) {
+	failure := errors.New("sink down")
+	tests := []struct {
+		name          string
+		batchSize     int
+		wantLimit     int
+		pending       []int64
+		fail          map[int64]error
+		wantPublished []int64
+	}{
+		{
+			name:      "empty",
+			wantLimit: defaultBatchSize,
+		},
+		{
+			name:          "all published",
+			batchSize:     3,
+			wantLimit:     3,
+			pending:       []int64{1, 2, 3},
+			wantPublished: []int64{1, 2, 3},
+		},
+		{
+			name:          "stops at first failure",
+			batchSize:     10,
+			wantLimit:     10,
+			pending:       []int64{4, 5, 6},
+			fail:          map[int64]error{5: failure},
+			wantPublished: []int64{4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(selectPending).WithArgs(tt.wantLimit).WillReturnRows(pendingRows(tt.pending...))
+			for _, id := range tt.pending {
+				if err := tt.fail[id]; err != nil {
+					mock.ExpectExec(markFailed).WithArgs(err.Error(), id).WillReturnResult(sqlmock.NewResult(0, 1))
+					break
+				}
+				mock.ExpectExec(markPublished).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+
+			sink := &recordingSink{fail: tt.fail}
+			relay := &Relay{DB: db, Sink: sink, Source: "order-service", BatchSize: tt.batchSize}
+			n, err := relay.RelayBatch(context.Background())
+			if err != nil {
+				t.Fatalf("RelayBatch: %v", err)
+			}
+			if n != len(tt.wantPublished) {
+				t.Errorf("RelayBatch = %d, want %d", n, len(tt.wantPublished))
+			}
+			if len(sink.published) != len(tt.wantPublished) {
+				t.Fatalf("published %v, want %v", sink.published, tt.wantPublished)
+			}
+			for i, id := range tt.wantPublished {
+				if sink.published[i] != id {
+					t.Errorf("published %v, want %v", sink.published, tt.wantPublished)
+					break
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRelayBatchMarkFailureRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectPending).WillReturnRows(pendingRows(1))
+	mock.ExpectExec(markPublished).WithArgs(int64(1)).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	relay := &Relay{DB: db, Sink: &recordingSink{}}
+	if _, err := relay.RelayBatch(context.Background()); err == nil {
+		t.Error("RelayBatch succeeded although marking the event failed")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, batch := range [][]int64{{1, 2}, {3}, nil} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectPending).WithArgs(2).WillReturnRows(pendingRows(batch...))
+		for _, id := range batch {
+			mock.ExpectExec(markPublished).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		mock.ExpectCommit()
+	}
+
+	sink := &recordingSink{}
+	relay := &Relay{DB: db, Sink: sink, BatchSize: 2}
+	if err := relay.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(sink.published) != 3 {
+		t.Errorf("published %v, want [1 2 3]", sink.published)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,109 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Sink receives relayed events. Publish must return an error unless the
+// event was durably handed over, otherwise it is lost.
+type Sink interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Handler consumes events delivered by a Bus.
+type Handler func(ctx context.Context, e Event) error
+
+// Bus is an in-process sink that dispatches events to subscribed handlers.
+// It is wired up in code, after subscribing: NewSink does not offer it, since
+// events published to a Bus nobody subscribed to are marked published and
+// lost.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe registers h for eventType, or for every event if eventType is "*".
+func (b *Bus) Subscribe(eventType string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], h)
+}
+
+// Publish calls every matching handler and fails if any of them fails; the
+// relay then redelivers the event to all handlers.
+func (b *Bus) Publish(ctx context.Context, e Event) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler{}, b.handlers[e.Type]...), b.handlers["*"]...)
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		if err := h(ctx, e); err != nil {
+			return fmt.Errorf("handler for %s: %w", e.Type, err)
+		}
+	}
+	return nil
+}
+
+// maxNotifyPayload is PostgreSQL's NOTIFY payload limit minus some headroom.
+const maxNotifyPayload = 7900
+
+// PgNotifySink publishes events with NOTIFY on a PostgreSQL channel, so any
+// client can LISTEN for them. Events that do not fit a NOTIFY payload are sent
+// without their payload; listeners can read it from the outbox by ID.
+type PgNotifySink struct {
+	DB      *sql.DB
+	Channel string
+}
+
+func (s *PgNotifySink) Publish(ctx context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxNotifyPayload {
+		e.Payload = nil
+		if data, err = json.Marshal(e); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, s.Channel, string(data))
+	return err
+}
+
+// LogSink writes every event to the default logger.
+type LogSink struct{}
+
+func (LogSink) Publish(ctx context.Context, e Event) error {
+	slog.InfoContext(ctx, "Event", "event_type", e.Type, "event_id", e.ID,
+		"aggregate_type", e.AggregateType, "aggregate_id", e.AggregateID, "payload", e.Payload)
+	return nil
+}
+
+// SinkKinds lists the kinds accepted by NewSink.
+var SinkKinds = []string{"log", "pgnotify"}
+
+// NewSink builds the sink named by kind: "log" (default), or "pgnotify" to
+// NOTIFY on channel using db.
+func NewSink(kind string, db *sql.DB, channel string) (Sink, error) {
+	switch kind {
+	case "", "log":
+		return LogSink{}, nil
+	case "pgnotify":
+		if channel == "" {
+			channel = "outbox_events"
+		}
+		return &PgNotifySink{DB: db, Channel: channel}, nil
+	default:
+		return nil, fmt.Errorf("unknown outbox sink %q", kind)
+	}
+}
@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNewSink(t *testing.T) {
+	tests := []struct {
+		kind    string
+		want    string
+		wantErr bool
+	}{
+		{kind: "", want: "outbox.LogSink"},
+		{kind: "log", want: "outbox.LogSink"},
+		{kind: "pgnotify", want: "*outbox.PgNotifySink"},
+		// The bus has no subscribers when built from configuration
+		{kind: "bus", wantErr: true},
+		{kind: "kafka", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			sink, err := NewSink(tt.kind, nil, "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewSink(%q) = %T, want error", tt.kind, sink)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSink(%q): %v", tt.kind, err)
+			}
+			if got := fmt.Sprintf("%T", sink); got != tt.want {
+				t.Errorf("NewSink(%q) = %s, want %s", tt.kind, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSinkDefaultChannel(t *testing.T) {
+	sink, err := NewSink("pgnotify", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch := sink.(*PgNotifySink).Channel; ch != "outbox_events" {
+		t.Errorf("channel = %q, want outbox_events", ch)
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	if err := (LogSink{}).Publish(context.Background(), Event{ID: 1, Type: OrderPlaced}); err != nil {
+		t.Errorf("Publish: %v", err)
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	var got []string
+	record := func(name string) Handler {
+		return func(ctx context.Context, e Event) error {
+			got = append(got, name+":"+e.Type)
+			return nil
+		}
+	}
+	bus.Subscribe(OrderPlaced, record("orders"))
+	bus.Subscribe("*", record("all"))
+
+	for _, typ := range []string{OrderPlaced, StockChanged} {
+		if err := bus.Publish(context.Background(), Event{Type: typ}); err != nil {
+			t.Fatalf("Publish(%s): %v", typ, err)
+		}
+	}
+
+	want := []string{"orders:OrderPlaced", "all:OrderPlaced", "all:StockChanged"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("handlers called %v, want %v", got, want)
+	}
+}
+
+func TestBusHandlerFailure(t *testing.T) {
+	bus := NewBus()
+	failure := errors.New("consumer down")
+	called := false
+	bus.Subscribe(OrderPlaced, func(ctx context.Context, e Event) error { return failure })
+	bus.Subscribe(OrderPlaced, func(ctx context.Context, e Event) error {
+		called = true
+		return nil
+	})
+
+	err := bus.Publish(context.Background(), Event{Type: OrderPlaced})
+	if !errors.Is(err, failure) {
+		t.Errorf("Publish = %v, want %v", err, failure)
+	}
+	if called {
+		t.Error("handlers after a failing one were called")
+	}
+}
+
+// notifyArg matches the pg_notify payload and records it.
+type notifyArg struct {
+	payload *string
+}
+
+func (a notifyArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*a.payload = s
+	return ok
+}
+
+func TestPgNotifySink(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     string
+		wantPayload bool
+	}{
+		{name: "small", payload: `{"quantity":1}`, wantPayload: true},
+		{name: "too large", payload: `"` + strings.Repeat("x", maxNotifyPayload) + `"`, wantPayload: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			var sent string
+			mock.ExpectExec(`SELECT pg_notify\(\$1, \$2\)`).
+				WithArgs("events", notifyArg{&sent}).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			sink := &PgNotifySink{DB: db, Channel: "events"}
+			e := Event{ID: 7, Type: StockChanged, Payload: json.RawMessage(tt.payload)}
+			if err := sink.Publish(context.Background(), e); err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(sent) > maxNotifyPayload {
+				t.Errorf("notify payload is %d bytes, limit %d", len(sent), maxNotifyPayload)
+			}
+			var got Event
+			if err := json.Unmarshal([]byte(sent), &got); err != nil {
+				t.Fatalf("notify payload %q: %v", sent, err)
+			}
+			if got.ID != e.ID || got.Type != e.Type {
+				t.Errorf("notified %d %s, want %d %s", got.ID, got.Type, e.ID, e.Type)
+			}
+			if hasPayload := len(got.Payload) > 0 && string(got.Payload) != "null"; hasPayload != tt.wantPayload {
+				t.Errorf("payload sent = %v, want %v", hasPayload, tt.wantPayload)
+			}
+		})
+	}
+}
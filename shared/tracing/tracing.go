@@ -0,0 +1,230 @@
+// Package tracing propagates request IDs and W3C trace context between the
+// gateway and the services and records OpenTelemetry spans for incoming
+// requests, outgoing HTTP calls and SQL statements.
+//
+// Every request carries an X-Request-ID, taken from the caller (nginx sets
+// one) or generated, which is echoed in the response and forwarded on
+// outgoing calls. Spans are exported according to OTEL_TRACES_EXPORTER:
+// none (default), stdout for local testing, or otlp.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"shared/config"
+)
+
+// HeaderRequestID carries the request ID between clients, nginx, the
+// gateway and the services.
+const HeaderRequestID = "X-Request-ID"
+
+const instrumentationName = "shared/tracing"
+
+// Exporters selectable with OTEL_TRACES_EXPORTER.
+var Exporters = []string{"none", "stdout", "otlp"}
+
+var tracer = otel.Tracer(instrumentationName)
+
+type requestIDKey struct{}
+
+// Setup installs the global tracer provider and propagator for service,
+// configured from OTEL_TRACES_EXPORTER, OTEL_EXPORTER_OTLP_ENDPOINT and
+// TRACE_SAMPLE_RATIO. Problems are recorded on conf. The returned function
+// flushes pending spans and should run before the process exits.
+func Setup(conf *config.Loader, service string) func(context.Context) error {
+	exporterKind := conf.OneOf("OTEL_TRACES_EXPORTER", "none", Exporters...)
+	endpoint := conf.URL("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+	ratio := 1.0
+	if v, ok := conf.Lookup("TRACE_SAMPLE_RATIO"); ok {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			conf.Invalid("TRACE_SAMPLE_RATIO", "%q is not a number between 0 and 1", v)
+		} else {
+			ratio = r
+		}
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterKind {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint+"/v1/traces"))
+	}
+	if err != nil {
+		conf.Invalid("OTEL_TRACES_EXPORTER", "%v", err)
+	}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	// The provider is installed even without an exporter so that trace IDs
+	// are still generated and propagated to the services downstream.
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Tracing error", "error", err)
+	}))
+	return provider.Shutdown
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithRequestID returns a copy of ctx carrying id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts caller supplied IDs that are safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware gives every request a request ID and a server span, continuing
+// the trace from the caller's traceparent header. Used as a gorilla/mux
+// middleware the span is named after the route template.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(HeaderRequestID)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(HeaderRequestID, requestID)
+		}
+		w.Header().Set(HeaderRequestID, requestID)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx = WithRequestID(ctx, requestID)
+
+		name := r.Method
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				name += " " + tpl
+			}
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", requestID),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// SetSpanName renames the current server span, for handlers that know a
+// better name than the route template.
+func SetSpanName(ctx context.Context, name string) {
+	trace.SpanFromContext(ctx).SetName(name)
+}
+
+// transport adds a client span, traceparent and X-Request-ID to outgoing
+// requests.
+type transport struct {
+	base http.RoundTripper
+}
+
+// Transport wraps base (http.DefaultTransport if nil) so that requests made
+// with a traced context continue the trace and carry the request ID.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), fmt.Sprintf("%s %s", req.Method, req.URL.Host),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.Redacted()),
+			attribute.String("server.address", req.URL.Host),
+		))
+	defer span.End()
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(HeaderRequestID, id)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
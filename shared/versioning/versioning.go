@@ -0,0 +1,180 @@
+// Package versioning serves several versions of an HTTP API side by side.
+// Versioned paths carry the version after /api (/api/v2/products/1); the
+// unversioned paths (/api/products/1) keep serving the default version so
+// existing clients are not broken. Clients can also ask for a version with
+// the Accept header, which the gateway turns into a versioned path.
+//
+// Responses report the version that served them in API-Version, and
+// deprecated versions add Deprecation, Sunset and Link headers (RFC 9745,
+// RFC 8594).
+package versioning
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/config"
+)
+
+// Header reports the API version a response was served with.
+const Header = "API-Version"
+
+// mediaTypePrefix starts the vendor media types clients can request a
+// version with, as in Accept: application/vnd.microservice.v2+json.
+const mediaTypePrefix = "application/vnd.microservice."
+
+var namePattern = regexp.MustCompile(`^v[1-9][0-9]*$`)
+
+// Valid reports whether v names a version: v1, v2, ...
+func Valid(v string) bool {
+	return namePattern.MatchString(v)
+}
+
+// Split separates the version from a versioned path: /api/v2/products/1 is
+// v2 and /api/products/1. Other paths are returned unchanged with no version.
+func Split(path string) (version, rest string) {
+	after, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return "", path
+	}
+	version, tail, _ := strings.Cut(after, "/")
+	if !Valid(version) {
+		return "", path
+	}
+	return version, "/api/" + tail
+}
+
+// Join puts version into path after /api, or in front of paths not under
+// /api. It is the inverse of Split.
+func Join(version, path string) string {
+	if rest, ok := strings.CutPrefix(path, "/api/"); ok {
+		return "/api/" + version + "/" + rest
+	}
+	if path == "/api" {
+		return "/api/" + version
+	}
+	return "/" + version + path
+}
+
+// FromAccept returns the version requested by an Accept header, either as
+// a vendor media type (application/vnd.microservice.v2+json) or as a version
+// parameter (application/json; version=2), or "" if none is.
+func FromAccept(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if v, ok := params["version"]; ok {
+			if !strings.HasPrefix(v, "v") {
+				v = "v" + v
+			}
+			if Valid(v) {
+				return v
+			}
+		}
+		if rest, ok := strings.CutPrefix(mediaType, mediaTypePrefix); ok {
+			if v, _, _ := strings.Cut(rest, "+"); Valid(v) {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// Version describes one version of an API.
+type Version struct {
+	Name string
+	// Deprecated is when the version was deprecated; zero if it is not.
+	Deprecated time.Time
+	// Sunset is when the version stops being served, if that is decided.
+	Sunset time.Time
+	// Successor names the version clients should move to.
+	Successor string
+}
+
+// FromConfig returns version name with its deprecation read from
+// API_<NAME>_DEPRECATED and API_<NAME>_SUNSET (dates such as 2026-01-31 or
+// RFC 3339 times). Problems are recorded on conf.
+func FromConfig(conf *config.Loader, name string) Version {
+	v := Version{Name: name}
+	prefix := "API_" + strings.ToUpper(name) + "_"
+	v.Deprecated = configTime(conf, prefix+"DEPRECATED")
+	v.Sunset = configTime(conf, prefix+"SUNSET")
+	if !v.Sunset.IsZero() && v.Deprecated.IsZero() {
+		conf.Invalid(prefix+"SUNSET", "requires %sDEPRECATED", prefix)
+	}
+	return v
+}
+
+func configTime(conf *config.Loader, key string) time.Time {
+	s := conf.String(key, "")
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	conf.Invalid(key, "%q is not a date (2006-01-02) or RFC 3339 time", s)
+	return time.Time{}
+}
+
+// API mounts the versions of one resource, such as /api/products, on a
+// router.
+type API struct {
+	router *mux.Router
+	prefix string
+	// def is the version also served under the unversioned prefix.
+	def string
+}
+
+// New returns the API of the resource under prefix. Unversioned requests
+// are served by version def.
+func New(r *mux.Router, prefix, def string) *API {
+	return &API{router: r, prefix: prefix, def: def}
+}
+
+// Version registers the routes of v with register, relative to the
+// resource prefix. They are served under the versioned prefix and, for the
+// default version, under the unversioned one as well.
+func (a *API) Version(v Version, register func(r *mux.Router)) {
+	if !Valid(v.Name) {
+		panic(fmt.Sprintf("versioning: invalid version %q", v.Name))
+	}
+	prefixes := []string{Join(v.Name, a.prefix)}
+	if v.Name == a.def {
+		prefixes = append(prefixes, a.prefix)
+	}
+	for _, prefix := range prefixes {
+		sub := a.router.PathPrefix(prefix).Subrouter()
+		sub.Use(v.headers(a.prefix))
+		register(sub)
+	}
+}
+
+// headers returns a middleware setting the version headers of v.
+func (v Version) headers(prefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set(Header, v.Name)
+			if !v.Deprecated.IsZero() {
+				h.Set("Deprecation", fmt.Sprintf("@%d", v.Deprecated.Unix()))
+				if !v.Sunset.IsZero() {
+					h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+				}
+				if v.Successor != "" {
+					h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, Join(v.Successor, prefix)))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package versioning
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"shared/config"
+)
+
+func TestSplitJoin(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantVersion string
+		wantRest    string
+	}{
+		{"/api/v2/products/1", "v2", "/api/products/1"},
+		{"/api/v1/users", "v1", "/api/users"},
+		{"/api/v10/orders", "v10", "/api/orders"},
+		{"/api/v2", "v2", "/api/"},
+		{"/api/products/1", "", "/api/products/1"},
+		{"/api/v0/products", "", "/api/v0/products"},
+		{"/api/v01/products", "", "/api/v01/products"},
+		{"/api/V2/products", "", "/api/V2/products"},
+		{"/api/version/products", "", "/api/version/products"},
+		{"/v2/products", "", "/v2/products"},
+		{"/health", "", "/health"},
+	}
+	for _, tt := range tests {
+		version, rest := Split(tt.path)
+		if version != tt.wantVersion || rest != tt.wantRest {
+			t.Errorf("Split(%q) = %q, %q, want %q, %q", tt.path, version, rest, tt.wantVersion, tt.wantRest)
+		}
+		if version != "" && rest != "/api/" {
+			if joined := Join(version, rest); joined != tt.path {
+				t.Errorf("Join(%q, %q) = %q, want %q", version, rest, joined, tt.path)
+			}
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		version, path, want string
+	}{
+		{"v2", "/api/products", "/api/v2/products"},
+		{"v2", "/api/products/1/stock", "/api/v2/products/1/stock"},
+		{"v1", "/api", "/api/v1"},
+		{"v3", "/products", "/v3/products"},
+	}
+	for _, tt := range tests {
+		if got := Join(tt.version, tt.path); got != tt.want {
+			t.Errorf("Join(%q, %q) = %q, want %q", tt.version, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFromAccept(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"application/vnd.microservice.v2+json", "v2"},
+		{"application/vnd.microservice.v1", "v1"},
+		{"application/json; version=2", "v2"},
+		{"application/json; version=v3", "v3"},
+		{"application/json;version=\"2\"", "v2"},
+		{"text/html, application/vnd.microservice.v2+json;q=0.9", "v2"},
+		{"application/json; version=2, application/vnd.microservice.v3+json", "v2"},
+		// Missing or unusable versions
+		{"", ""},
+		{"application/json", ""},
+		{"*/*", ""},
+		{"application/json; version=0", ""},
+		{"application/json; version=two", ""},
+		{"application/vnd.microservice.v0+json", ""},
+		{"application/vnd.microservice.latest+json", ""},
+		{"application/vnd.other.v2+json", ""},
+		{"not a media type;;", ""},
+		{"garbage;;, application/vnd.microservice.v2+json", "v2"},
+	}
+	for _, tt := range tests {
+		if got := FromAccept(tt.accept); got != tt.want {
+			t.Errorf("FromAccept(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	deprecated := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	r := mux.NewRouter()
+	api := New(r, "/api/products", "v1")
+	api.Version(Version{Name: "v1", Deprecated: deprecated, Sunset: sunset, Successor: "v2"}, func(r *mux.Router) {
+		r.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("v1")) }).Methods("GET")
+	})
+	api.Version(Version{Name: "v2"}, func(r *mux.Router) {
+		r.HandleFunc("/{id}", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("v2")) }).Methods("GET")
+	})
+
+	tests := []struct {
+		path           string
+		wantNotFound   bool
+		wantBody       string
+		wantDeprecated bool
+	}{
+		// Unversioned paths are served by the default version
+		{path: "/api/products/1", wantBody: "v1", wantDeprecated: true},
+		{path: "/api/v1/products/1", wantBody: "v1", wantDeprecated: true},
+		{path: "/api/v2/products/1", wantBody: "v2"},
+		{path: "/api/v3/products/1", wantNotFound: true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if tt.wantNotFound {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s: status %d, want 404", tt.path, w.Code)
+			}
+			continue
+		}
+		if body := w.Body.String(); body != tt.wantBody {
+			t.Errorf("%s: served by %q, want %q", tt.path, body, tt.wantBody)
+		}
+		h := w.Header()
+		if got := h.Get(Header); got != tt.wantBody {
+			t.Errorf("%s: %s = %q, want %q", tt.path, Header, got, tt.wantBody)
+		}
+		if !tt.wantDeprecated {
+			for _, name := range []string{"Deprecation", "Sunset", "Link"} {
+				if v := h.Get(name); v != "" {
+					t.Errorf("%s: unexpected %s: %q", tt.path, name, v)
+				}
+			}
+			continue
+		}
+		if got := h.Get("Deprecation"); got != "@1790812800" {
+			t.Errorf("%s: Deprecation = %q, want @1790812800", tt.path, got)
+		}
+		if got := h.Get("Sunset"); got != "Thu, 01 Apr 2027 00:00:00 GMT" {
+			t.Errorf("%s: Sunset = %q", tt.path, got)
+		}
+		if got := h.Get("Link"); got != `</api/v2/products>; rel="successor-version"` {
+			t.Errorf("%s: Link = %q", tt.path, got)
+		}
+	}
+}
+
+func TestAPIDeprecatedWithoutSunset(t *testing.T) {
+	r := mux.NewRouter()
+	New(r, "/api/users", "v1").Version(Version{Name: "v1", Deprecated: time.Unix(1700000000, 0)}, func(r *mux.Router) {
+		r.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users/me", nil))
+	if got := w.Header().Get("Deprecation"); got != "@1700000000" {
+		t.Errorf("Deprecation = %q, want @1700000000", got)
+	}
+	if got := w.Header().Get("Sunset"); got != "" {
+		t.Errorf("Sunset = %q, want none", got)
+	}
+	if got := w.Header().Get("Link"); got != "" {
+		t.Errorf("Link = %q without a successor", got)
+	}
+}
+
+func TestAPIInvalidVersion(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Version accepted an invalid name")
+		}
+	}()
+	New(mux.NewRouter(), "/api/orders", "v1").Version(Version{Name: "2"}, func(r *mux.Router) {})
+}
+
+func TestFromConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		deprecated     string
+		sunset         string
+		wantDeprecated time.Time
+		wantSunset     time.Time
+		wantErr        string
+	}{
+		{name: "not deprecated"},
+		{
+			name: "dates", deprecated: "2026-10-01", sunset: "2027-04-01",
+			wantDeprecated: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			wantSunset:     time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "RFC 3339", deprecated: "2026-10-01T12:00:00Z",
+			wantDeprecated: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{name: "malformed", deprecated: "October 2026", wantErr: "API_V1_DEPRECATED"},
+		{
+			name: "sunset without deprecation", sunset: "2027-04-01",
+			wantSunset: time.Date(2027, 4, 1, 0, 0, 0, 0, time.UTC), wantErr: "requires API_V1_DEPRECATED",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(config.FileEnv, "")
+			t.Setenv("API_V1_DEPRECATED", tt.deprecated)
+			t.Setenv("API_V1_SUNSET", tt.sunset)
+			conf, err := config.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v := FromConfig(conf, "v1")
+			if v.Name != "v1" || !v.Deprecated.Equal(tt.wantDeprecated) || !v.Sunset.Equal(tt.wantSunset) {
+				t.Errorf("FromConfig = %+v, want deprecated %v, sunset %v", v, tt.wantDeprecated, tt.wantSunset)
+			}
+			err = conf.Err()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want it to mention %s", err, tt.wantErr)
+			}
+		})
+	}
+}
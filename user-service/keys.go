@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"shared/config"
+	"shared/jwks"
+)
+
+const (
+	// keyRefreshInterval is how often every instance rotates keys if due and
+	// reloads them from signing_keys.
+	keyRefreshInterval = time.Minute
+	// New keys are published this long before they sign, so that every
+	// instance and the gateway know them by the time tokens use them.
+	keyActivationDelay = 2 * keyRefreshInterval
+	// keyRotationLock is the advisory lock instances rotate keys under.
+	keyRotationLock = 0x6a776b73
+)
+
+// PEM block types of stored private keys. Keys are sealed with the key
+// encryption key; plain PKCS #8 keys stored by earlier versions are still
+// read, and rotated out on the next refresh.
+const (
+	sealedKeyType = "SEALED PRIVATE KEY"
+	plainKeyType  = "PRIVATE KEY"
+)
+
+// Signing algorithm and key lifetimes
+var (
+	signingAlgorithm    = jwks.EdDSA
+	keyRotationInterval = 30 * 24 * time.Hour
+	keyGracePeriod      = time.Hour
+)
+
+var errNoSigningKey = errors.New("no signing key loaded")
+
+// keyCipher seals the private keys stored in signing_keys, so that a copy
+// of users_db alone cannot sign tokens.
+var keyCipher cipher.AEAD
+
+func initKeys(conf *config.Loader) {
+	if kek := conf.Secret("JWT_KEY_ENCRYPTION_KEY", 32); kek != "" {
+		setKeyEncryptionKey(kek)
+	}
+	signingAlgorithm = conf.OneOf("JWT_ALGORITHM", signingAlgorithm, jwks.EdDSA, jwks.RS256)
+	keyRotationInterval = conf.Duration("JWT_KEY_ROTATION_INTERVAL", keyRotationInterval)
+	keyGracePeriod = conf.Duration("JWT_KEY_GRACE_PERIOD", keyGracePeriod)
+	if keyGracePeriod < tokenTTL {
+		conf.Invalid("JWT_KEY_GRACE_PERIOD", "must be at least JWT_TTL (%s), or tokens outlive their key", tokenTTL)
+	}
+}
+
+// setKeyEncryptionKey derives the AES-256-GCM key private keys are sealed
+// with from secret.
+func setKeyEncryptionKey(secret string) {
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		panic(err)
+	}
+	keyCipher, err = cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// sealKey encrypts the PKCS #8 key der of kid. The kid is authenticated
+// too, so a sealed key cannot be moved to another row.
+func sealKey(kid string, der []byte) (string, error) {
+	nonce := make([]byte, keyCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := keyCipher.Seal(nonce, nonce, der, []byte(kid))
+	return string(pem.EncodeToMemory(&pem.Block{Type: sealedKeyType, Bytes: sealed})), nil
+}
+
+// openKey returns the PKCS #8 key of kid stored as stored.
+func openKey(kid, stored string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(stored))
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	switch block.Type {
+	case plainKeyType:
+		return block.Bytes, nil
+	case sealedKeyType:
+		n := keyCipher.NonceSize()
+		if len(block.Bytes) < n {
+			return nil, errors.New("sealed key too short")
+		}
+		der, err := keyCipher.Open(nil, block.Bytes[:n], block.Bytes[n:], []byte(kid))
+		if err != nil {
+			return nil, errors.New("cannot decrypt, wrong JWT_KEY_ENCRYPTION_KEY or corrupted key")
+		}
+		return der, nil
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// keyring holds the published keys and the one tokens are signed with.
+type keyring struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+	set     jwks.Set
+}
+
+var keys atomic.Pointer[keyring]
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == jwks.RS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	if alg == jwks.RS256 {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// signToken signs claims with the current key, naming it in the kid header.
+func signToken(claims jwt.Claims) (string, error) {
+	kr := keys.Load()
+	if kr == nil {
+		return "", errNoSigningKey
+	}
+	token := jwt.NewWithClaims(kr.signing.method, claims)
+	token.Header["kid"] = kr.signing.kid
+	return token.SignedString(kr.signing.private)
+}
+
+// parseToken verifies a token signed with one of the published keys.
+func parseToken(tokenString string, claims *Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		kr := keys.Load()
+		if kr == nil {
+			return nil, errNoSigningKey
+		}
+		kid, _ := t.Header["kid"].(string)
+		key, ok := kr.keys[kid]
+		if !ok || key.method != t.Method {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key.private.Public(), nil
+	}, jwt.WithValidMethods([]string{jwks.EdDSA, jwks.RS256}), jwt.WithExpirationRequired())
+	return err
+}
+
+// rotateKeys creates a signing key when there is none, or when the newest
+// one is older than keyRotationInterval, uses another algorithm or is stored
+// unsealed, and deletes keys past their grace period.
+func rotateKeys(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Instances starting or rotating together must not create a key each
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, keyRotationLock); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM signing_keys WHERE retires_at < NOW() - make_interval(secs => $1)
+	`, keyGracePeriod.Seconds())
+	if err != nil {
+		return err
+	}
+
+	var alg string
+	var age float64
+	var sealed bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT algorithm, EXTRACT(EPOCH FROM NOW() - activates_at), private_key LIKE $1
+		FROM signing_keys
+		WHERE retires_at IS NULL
+		ORDER BY activates_at DESC
+		LIMIT 1
+	`, "-----BEGIN "+sealedKeyType+"-----%").Scan(&alg, &age, &sealed)
+	delay := keyActivationDelay
+	switch {
+	case err == sql.ErrNoRows:
+		// The first key has no tokens to keep valid, it signs right away
+		delay = 0
+	case err != nil:
+		return err
+	case alg == signingAlgorithm && age < keyRotationInterval.Seconds() && sealed:
+		return tx.Commit()
+	}
+
+	key, err := generateKey(signingAlgorithm)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	kid, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	privateKey, err := sealKey(kid, der)
+	if err != nil {
+		return err
+	}
+
+	// The current key signs until the new one activates
+	_, err = tx.ExecContext(ctx, `
+		UPDATE signing_keys SET retires_at = NOW() + make_interval(secs => $1) WHERE retires_at IS NULL
+	`, delay.Seconds())
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO signing_keys (kid, algorithm, private_key, activates_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+	`, kid, signingAlgorithm, privateKey, delay.Seconds())
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Info("Created signing key", "kid", kid, "algorithm", signingAlgorithm, "activates_in", delay)
+	return nil
+}
+
+// loadKeys reads the published keys from signing_keys.
+func loadKeys(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT kid, algorithm, private_key, activates_at <= NOW()
+		FROM signing_keys
+		WHERE retires_at IS NULL OR retires_at > NOW() - make_interval(secs => $1)
+		ORDER BY activates_at DESC
+	`, keyGracePeriod.Seconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	kr := &keyring{keys: make(map[string]*signingKey), set: jwks.Set{Keys: []jwks.Key{}}}
+	for rows.Next() {
+		var kid, alg, stored string
+		var active bool
+		if err := rows.Scan(&kid, &alg, &stored, &active); err != nil {
+			return err
+		}
+		der, err := openKey(kid, stored)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kid, err)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kid, err)
+		}
+		private, ok := parsed.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("key %s: unsupported key type %T", kid, parsed)
+		}
+		public, err := jwks.New(kid, private.Public())
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kid, err)
+		}
+
+		key := &signingKey{kid: kid, method: signingMethod(alg), private: private}
+		kr.keys[kid] = key
+		kr.set.Keys = append(kr.set.Keys, public)
+		if active && kr.signing == nil {
+			kr.signing = key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if kr.signing == nil {
+		return errNoSigningKey
+	}
+
+	if prev := keys.Load(); prev == nil || prev.signing.kid != kr.signing.kid {
+		slog.Info("Signing with key", "kid", kr.signing.kid, "published", len(kr.keys))
+	}
+	keys.Store(kr)
+	return nil
+}
+
+// runKeyRotation rotates and reloads the signing keys right away and then
+// on every keyRefreshInterval until ctx is cancelled.
+func runKeyRotation(ctx context.Context) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := rotateKeys(ctx); err != nil {
+			slog.Error("Signing key rotation failed", "error", err)
+		}
+		if err := loadKeys(ctx); err != nil {
+			slog.Error("Loading signing keys failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keysReady is a readiness check: tokens cannot be issued before the keys
+// are loaded.
+func keysReady(ctx context.Context) error {
+	if keys.Load() == nil {
+		return errNoSigningKey
+	}
+	return nil
+}
+
+// jwksHandler serves the public keys tokens may be signed with.
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	kr := keys.Load()
+	if kr == nil {
+		http.Error(w, "Signing keys not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(keyRefreshInterval.Seconds())))
+	json.NewEncoder(w).Encode(kr.set)
+}
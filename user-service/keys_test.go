@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"shared/jwks"
+)
+
+// useKeyEncryptionKey seals and opens keys with secret for the test.
+func useKeyEncryptionKey(t *testing.T, secret string) {
+	saved := keyCipher
+	setKeyEncryptionKey(secret)
+	t.Cleanup(func() { keyCipher = saved })
+}
+
+const testKEK = "test-key-encryption-key-0123456789abcdef"
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// storedKey returns key as rotateKeys stores it, sealed unless plain is set.
+func storedKey(t *testing.T, kid string, key crypto.Signer, plain bool) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain {
+		return string(pem.EncodeToMemory(&pem.Block{Type: plainKeyType, Bytes: der}))
+	}
+	sealed, err := sealKey(kid, der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestSealKey(t *testing.T) {
+	useKeyEncryptionKey(t, testKEK)
+	der := []byte("pkcs8 key")
+
+	sealed, err := sealKey("k1", der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "pkcs8") || !strings.HasPrefix(sealed, "-----BEGIN "+sealedKeyType) {
+		t.Fatalf("sealed key %q", sealed)
+	}
+	if again, _ := sealKey("k1", der); again == sealed {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+	if got, err := openKey("k1", sealed); err != nil || string(got) != string(der) {
+		t.Errorf("openKey = %q, %v", got, err)
+	}
+
+	// The ciphertext is bound to its kid
+	if _, err := openKey("k2", sealed); err == nil {
+		t.Error("key opened under another kid")
+	}
+	block, _ := pem.Decode([]byte(sealed))
+	block.Bytes[len(block.Bytes)-1] ^= 1
+	if _, err := openKey("k1", string(pem.EncodeToMemory(block))); err == nil {
+		t.Error("tampered key opened")
+	}
+	if _, err := openKey("k1", "not pem"); err == nil {
+		t.Error("openKey accepted a value that is not PEM")
+	}
+
+	useKeyEncryptionKey(t, "another-key-encryption-key-0123456789")
+	if _, err := openKey("k1", sealed); err == nil {
+		t.Error("key opened with another key encryption key")
+	}
+}
+
+const (
+	rotationLock   = `SELECT pg_advisory_xact_lock\(\$1\)`
+	deleteRetired  = `DELETE FROM signing_keys WHERE retires_at < NOW\(\) - make_interval\(secs => \$1\)`
+	newestKey      = `SELECT algorithm, EXTRACT\(EPOCH FROM NOW\(\) - activates_at\), private_key LIKE \$1\s+FROM signing_keys`
+	retireKeys     = `UPDATE signing_keys SET retires_at = NOW\(\) \+ make_interval\(secs => \$1\) WHERE retires_at IS NULL`
+	insertKey      = `INSERT INTO signing_keys \(kid, algorithm, private_key, activates_at\)`
+	selectKeys     = `SELECT kid, algorithm, private_key, activates_at <= NOW\(\)\s+FROM signing_keys`
+	sealedKeyMatch = "-----BEGIN " + sealedKeyType + "-----%"
+)
+
+func TestRotateKeys(t *testing.T) {
+	useKeyEncryptionKey(t, testKEK)
+	fresh, old := time.Hour.Seconds(), (keyRotationInterval + time.Hour).Seconds()
+
+	tests := []struct {
+		name      string
+		newest    *sqlmock.Rows
+		wantDelay time.Duration // activation delay of the new key
+		wantNew   bool
+	}{
+		{
+			name:    "first key signs right away",
+			newest:  sqlmock.NewRows([]string{"algorithm", "age", "sealed"}),
+			wantNew: true,
+		},
+		{
+			name:   "current key",
+			newest: sqlmock.NewRows([]string{"algorithm", "age", "sealed"}).AddRow(jwks.EdDSA, fresh, true),
+		},
+		{
+			name:      "key due for rotation",
+			newest:    sqlmock.NewRows([]string{"algorithm", "age", "sealed"}).AddRow(jwks.EdDSA, old, true),
+			wantDelay: keyActivationDelay,
+			wantNew:   true,
+		},
+		{
+			name:      "algorithm changed",
+			newest:    sqlmock.NewRows([]string{"algorithm", "age", "sealed"}).AddRow(jwks.RS256, fresh, true),
+			wantDelay: keyActivationDelay,
+			wantNew:   true,
+		},
+		{
+			name:      "key stored unsealed",
+			newest:    sqlmock.NewRows([]string{"algorithm", "age", "sealed"}).AddRow(jwks.EdDSA, fresh, false),
+			wantDelay: keyActivationDelay,
+			wantNew:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			var kid, stored string
+			mock.ExpectBegin()
+			mock.ExpectExec(rotationLock).WithArgs(keyRotationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(deleteRetired).WithArgs(keyGracePeriod.Seconds()).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(newestKey).WithArgs(sealedKeyMatch).WillReturnRows(tt.newest)
+			if tt.wantNew {
+				mock.ExpectExec(retireKeys).WithArgs(tt.wantDelay.Seconds()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(insertKey).WithArgs(captured{&kid}, jwks.EdDSA, captured{&stored}, tt.wantDelay.Seconds()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+
+			if err := rotateKeys(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantNew {
+				return
+			}
+
+			der, err := openKey(kid, stored)
+			if err != nil {
+				t.Fatalf("stored key: %v", err)
+			}
+			if key, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+				t.Errorf("stored key: %v", err)
+			} else if _, ok := key.(ed25519.PrivateKey); !ok {
+				t.Errorf("stored a %T, want an Ed25519 key", key)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	useKeyEncryptionKey(t, testKEK)
+	saved := keys.Load()
+	t.Cleanup(func() { keys.Store(saved) })
+
+	next, current := newEd25519Key(t), newEd25519Key(t)
+	legacy, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := useMockDB(t)
+	mock.ExpectQuery(selectKeys).WithArgs(keyGracePeriod.Seconds()).WillReturnRows(
+		sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "active"}).
+			// Published, not signing yet
+			AddRow("next", jwks.EdDSA, storedKey(t, "next", next, false), false).
+			AddRow("current", jwks.EdDSA, storedKey(t, "current", current, false), true).
+			// Retired, stored before keys were sealed
+			AddRow("legacy", jwks.RS256, storedKey(t, "legacy", legacy, true), true))
+
+	if err := loadKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	kr := keys.Load()
+	if kr.signing.kid != "current" {
+		t.Errorf("signing with %s, want current", kr.signing.kid)
+	}
+	var published []string
+	for _, k := range kr.set.Keys {
+		published = append(published, k.Kid+"/"+k.Alg)
+	}
+	if got := strings.Join(published, ","); got != "next/EdDSA,current/EdDSA,legacy/RS256" {
+		t.Errorf("published %s", got)
+	}
+	if kr.keys["legacy"].method != jwt.SigningMethodRS256 {
+		t.Errorf("legacy key method %v, want RS256", kr.keys["legacy"].method.Alg())
+	}
+}
+
+func TestLoadKeysErrors(t *testing.T) {
+	useKeyEncryptionKey(t, testKEK)
+	saved := keys.Load()
+	t.Cleanup(func() { keys.Store(saved) })
+	pending := storedKey(t, "next", newEd25519Key(t), false)
+
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+	}{
+		{
+			name: "no active key",
+			rows: sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "active"}).AddRow("next", jwks.EdDSA, pending, false),
+		},
+		{
+			name: "sealed under another kid",
+			rows: sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "active"}).AddRow("current", jwks.EdDSA, pending, true),
+		},
+		{
+			name: "not PEM",
+			rows: sqlmock.NewRows([]string{"kid", "algorithm", "private_key", "active"}).AddRow("current", jwks.EdDSA, "garbage", true),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys.Store(nil)
+			mock := useMockDB(t)
+			mock.ExpectQuery(selectKeys).WillReturnRows(tt.rows)
+			if err := loadKeys(context.Background()); err == nil {
+				t.Fatal("loadKeys succeeded")
+			}
+			if keys.Load() != nil {
+				t.Error("failed load replaced the keys")
+			}
+		})
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	saved := keys.Load()
+	t.Cleanup(func() { keys.Store(saved) })
+
+	edKey, otherKey := newEd25519Key(t), newEd25519Key(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := &signingKey{kid: "ed", method: jwt.SigningMethodEdDSA, private: edKey}
+	keys.Store(&keyring{signing: ed, keys: map[string]*signingKey{
+		"ed":  ed,
+		"rsa": {kid: "rsa", method: jwt.SigningMethodRS256, private: rsaKey},
+	}})
+
+	now := time.Now()
+	valid := func() *Claims {
+		return &Claims{UserID: 7, RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "jti-1",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		}}
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims *Claims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	expired := valid()
+	expired.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+	noExpiry := valid()
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error // nil for any error when wantOK is false
+		wantOK  bool
+	}{
+		{name: "EdDSA", token: sign(jwt.SigningMethodEdDSA, "ed", edKey, valid()), wantOK: true},
+		{name: "RS256", token: sign(jwt.SigningMethodRS256, "rsa", rsaKey, valid()), wantOK: true},
+		{name: "expired", token: sign(jwt.SigningMethodEdDSA, "ed", edKey, expired), wantErr: jwt.ErrTokenExpired},
+		{name: "no expiry", token: sign(jwt.SigningMethodEdDSA, "ed", edKey, noExpiry)},
+		{name: "unknown kid", token: sign(jwt.SigningMethodEdDSA, "gone", edKey, valid())},
+		{name: "kid of a key with another algorithm", token: sign(jwt.SigningMethodEdDSA, "rsa", edKey, valid())},
+		{name: "signed with another key", token: sign(jwt.SigningMethodEdDSA, "ed", otherKey, valid()), wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "HMAC", token: sign(jwt.SigningMethodHS256, "ed", []byte(edKey.Public().(ed25519.PublicKey)), valid())},
+		{name: "none", token: sign(jwt.SigningMethodNone, "ed", jwt.UnsafeAllowNoneSignatureType, valid())},
+		{name: "malformed", token: "not.a.token", wantErr: jwt.ErrTokenMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims Claims
+			err := parseToken(tt.token, &claims)
+			switch {
+			case tt.wantOK:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if claims.UserID != 7 || claims.ID != "jti-1" {
+					t.Errorf("claims %+v", claims)
+				}
+			case err == nil:
+				t.Error("token accepted")
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	keys.Store(nil)
+	if err := parseToken(sign(jwt.SigningMethodEdDSA, "ed", edKey, valid()), &Claims{}); !errors.Is(err, errNoSigningKey) {
+		t.Errorf("without keys: %v, want %v", err, errNoSigningKey)
+	}
+}
@@ -1,20 +1,37 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/crypto/bcrypt"
+	"shared/authz"
+	"shared/config"
+	"shared/discovery"
+	"shared/graceful"
+	"shared/health"
+	"shared/logging"
+	"shared/metrics"
+	"shared/outbox"
+	"shared/tracing"
+	"shared/versioning"
 )
 
 var db *sql.DB
-var jwtSecret = []byte("your-secret-key-change-in-production")
+
+var loginFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "user_login_failures_total",
+	Help: "Rejected logins, by reason (unknown_email, wrong_password, error).",
+}, []string{"reason"})
 
 type User struct {
 	ID        int       `json:"id"`
@@ -38,22 +55,34 @@ type LoginRequest struct {
 }
 
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
+	UserID      int      `json:"user_id"`
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func initDB() {
-	connStr := "host=postgres port=5432 user=postgres password=postgres dbname=users_db sslmode=disable"
+func initDB(conf config.Database) {
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	connector, err := pq.NewConnector(conf.DSN())
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Invalid database settings", "error", err)
 	}
+	db = tracing.OpenDB(connector)
 	if err = db.Ping(); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to connect to database", "database", conf.Name, "error", err)
+	}
+	slog.Info("Connected to database", "database", conf.Name)
+}
+
+func startOutboxRelay(ctx context.Context, kind, channel string) *outbox.Relay {
+	sink, err := outbox.NewSink(kind, db, channel)
+	if err != nil {
+		logging.Fatal("Failed to create outbox sink", "sink", kind, "error", err)
 	}
-	log.Println("Connected to users database")
+	relay := &outbox.Relay{DB: db, Sink: sink, Source: "user-service"}
+	go relay.Run(ctx)
+	return relay
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -69,8 +98,15 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	var userID int
-	err = db.QueryRow(
+	err = tx.QueryRowContext(r.Context(),
 		`INSERT INTO users (email, username, password_hash, full_name, created_at, updated_at)
 		 VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING id`,
 		req.Email, req.Username, string(hashedPassword), req.FullName,
@@ -81,6 +117,22 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = outbox.Write(r.Context(), tx, "user", userID, outbox.UserRegistered, map[string]interface{}{
+		"user_id":   userID,
+		"email":     req.Email,
+		"username":  req.Username,
+		"full_name": req.FullName,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "User registered successfully",
@@ -97,42 +149,53 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	var user User
 	var passwordHash string
-	err := db.QueryRow(
+	err := db.QueryRowContext(r.Context(),
 		"SELECT id, email, username, full_name, password_hash FROM users WHERE email = $1",
 		req.Email,
 	).Scan(&user.ID, &user.Email, &user.Username, &user.FullName, &passwordHash)
 
 	if err != nil {
+		if err == sql.ErrNoRows {
+			loginFailures.WithLabelValues("unknown_email").Inc()
+		} else {
+			loginFailures.WithLabelValues("error").Inc()
+		}
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+		loginFailures.WithLabelValues("wrong_password").Inc()
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	defer tx.Rollback()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	// Every login starts a new refresh token family
+	family, err := randomHex(16)
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
+	resp, err := issueTokens(r.Context(), tx, user, family)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.User = &user
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token": tokenString,
-		"user":  user,
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func getUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -140,7 +203,7 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	userID := vars["id"]
 
 	var user User
-	err := db.QueryRow(
+	err := db.QueryRowContext(r.Context(),
 		"SELECT id, email, username, full_name, created_at, updated_at FROM users WHERE id = $1",
 		userID,
 	).Scan(&user.ID, &user.Email, &user.Username, &user.FullName, &user.CreatedAt, &user.UpdatedAt)
@@ -162,7 +225,7 @@ func searchUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Using GIN index for full-text search
-	rows, err := db.Query(
+	rows, err := db.QueryContext(r.Context(),
 		`SELECT id, email, username, full_name, created_at, updated_at
 		 FROM users
 		 WHERE to_tsvector('english', email || ' ' || username || ' ' || full_name) @@ plainto_tsquery('english', $1)`,
@@ -189,23 +252,91 @@ func searchUsersHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+// requiredMigrations are the dbmate versions whose schema this service uses.
+// Readiness fails until all of them are applied.
+var requiredMigrations = []string{
+	"20251005121034",
+	"20251025090000",
+	"20251026090000",
+	"20251027090000",
+	"20251028090000",
 }
 
 func main() {
-	initDB()
-	defer db.Close()
+	conf, err := config.Load()
+	if err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+	logging.Setup(conf, "user-service")
+	dbConf := conf.Database("users_db")
+	server := conf.Server(8001)
+	initTokens(conf)
+	initKeys(conf)
+	outboxSink := conf.OneOf("OUTBOX_SINK", "log", outbox.SinkKinds...)
+	outboxChannel := conf.String("OUTBOX_CHANNEL", "outbox_events")
+	authz.Setup(conf)
+	registration := discovery.FromConfig(conf, "user-service", server)
+	checker := health.FromConfig(conf, "user-service")
+	shutdownTracing := tracing.Setup(conf, "user-service")
+	if err := conf.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	ctx, stop := graceful.SignalContext()
+	defer stop()
+
+	initDB(dbConf)
+
+	checker.Add("database", health.Database(db))
+	checker.Add("migrations", health.Migrations(db, requiredMigrations...))
+	checker.Add("signing-keys", keysReady)
+	metrics.RegisterDB(db, dbConf.Name)
+
+	go runTokenCleanup(ctx)
+	go runKeyRotation(ctx)
+
+	relay := startOutboxRelay(ctx, outboxSink, outboxChannel)
 
 	r := mux.NewRouter()
-	r.HandleFunc("/register", registerHandler).Methods("POST")
-	r.HandleFunc("/login", loginHandler).Methods("POST")
-	r.HandleFunc("/users/{id}", getUserHandler).Methods("GET")
-	r.HandleFunc("/users/search", searchUsersHandler).Methods("GET")
-	r.HandleFunc("/health", healthHandler).Methods("GET")
-
-	log.Println("User service starting on port 8001...")
-	log.Fatal(http.ListenAndServe(":8001", r))
+	r.Use(tracing.Middleware)
+	r.Use(metrics.Middleware)
+	r.Use(logging.Middleware)
+	r.HandleFunc("/livez", checker.Liveness).Methods("GET")
+	r.HandleFunc("/readyz", checker.Readiness).Methods("GET")
+	r.HandleFunc("/health", checker.Readiness).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	// Polled by the gateway, not routed through it
+	r.HandleFunc("/revocations", revocationsHandler).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", jwksHandler).Methods("GET")
+
+	// The API lives under the same prefix as the gateway route, so requests
+	// are forwarded without rewriting
+	api := versioning.New(r, "/api/users", "v1")
+	api.Version(versioning.Version{Name: "v1"}, func(r *mux.Router) {
+		r.HandleFunc("/register", registerHandler).Methods("POST")
+		r.HandleFunc("/login", loginHandler).Methods("POST")
+		r.HandleFunc("/refresh", refreshHandler).Methods("POST")
+		r.HandleFunc("/logout", logoutHandler).Methods("POST")
+		r.HandleFunc("/search", searchUsersHandler).Methods("GET")
+		r.HandleFunc("/{id:[0-9]+}", getUserHandler).Methods("GET")
+
+		// Role management; the gateway forwards the caller's permissions
+		r.Handle("/roles", authz.Require(authz.RolesManage, listRolesHandler)).Methods("GET")
+		r.Handle("/{id:[0-9]+}/roles", authz.RequireIdentity(http.HandlerFunc(getUserRolesHandler))).Methods("GET")
+		r.Handle("/{id:[0-9]+}/roles/{role}", authz.Require(authz.RolesManage, grantRoleHandler)).Methods("PUT")
+		r.Handle("/{id:[0-9]+}/roles/{role}", authz.Require(authz.RolesManage, revokeRoleHandler)).Methods("DELETE")
+	})
+
+	deregistered := registration.Start(ctx)
+
+	slog.Info("User service starting", "addr", server.Addr)
+	err = graceful.Run(ctx, server, r,
+		graceful.Cleanup{Name: "registry", Fn: deregistered},
+		graceful.Cleanup{Name: "outbox", Fn: relay.Flush},
+		graceful.Cleanup{Name: "tracing", Fn: shutdownTracing},
+		graceful.Cleanup{Name: "database", Fn: func(context.Context) error { return db.Close() }},
+	)
+	if err != nil {
+		logging.Fatal("Server failed to start", "error", err)
+	}
 }
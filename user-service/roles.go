@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"shared/authz"
+	"shared/outbox"
+)
+
+// Role is a named set of permissions.
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// queryStrings returns the single string column of query's rows.
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// loadAuthorization returns the roles granted to userID and the permissions
+// they add up to, as put into access tokens.
+func loadAuthorization(ctx context.Context, tx *sql.Tx, userID int) (roles, permissions []string, err error) {
+	roles, err = queryStrings(ctx, tx, `
+		SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role
+	`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	permissions, err = queryStrings(ctx, tx, `
+		SELECT DISTINCT p.permission
+		FROM user_roles r
+		JOIN role_permissions p ON p.role = r.role
+		WHERE r.user_id = $1
+		ORDER BY p.permission
+	`, userID)
+	return roles, permissions, err
+}
+
+func listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT r.name, r.description, COALESCE(array_agg(p.permission ORDER BY p.permission) FILTER (WHERE p.permission IS NOT NULL), '{}')
+		FROM roles r
+		LEFT JOIN role_permissions p ON p.role = r.name
+		GROUP BY r.name, r.description
+		ORDER BY r.name
+	`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description, (*pq.StringArray)(&role.Permissions)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+// getUserRolesHandler lists the roles of a user. Users may see their own,
+// role managers anyone's.
+func getUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	caller := authz.FromContext(r.Context())
+	if caller.UserID != userID && !caller.Can(authz.RolesManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkUserExists(r.Context(), tx, userID); err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	roles, permissions, err := loadAuthorization(r.Context(), tx, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"roles":       roles,
+		"permissions": permissions,
+	})
+}
+
+type roleError struct {
+	status  int
+	message string
+}
+
+func (e *roleError) Error() string {
+	return e.message
+}
+
+var (
+	errUserNotFound = &roleError{http.StatusNotFound, "User not found"}
+	errUnknownRole  = &roleError{http.StatusNotFound, "Unknown role"}
+	errLastAdmin    = &roleError{http.StatusConflict, "Cannot revoke the last admin"}
+)
+
+func writeRoleError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*roleError); ok {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func checkUserExists(ctx context.Context, tx *sql.Tx, userID int) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+	if err == nil && !exists {
+		return errUserNotFound
+	}
+	return err
+}
+
+// roleTarget parses the user and role of a grant or revoke request and
+// checks that both exist.
+func roleTarget(ctx context.Context, tx *sql.Tx, r *http.Request) (int, string, error) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, "", &roleError{http.StatusBadRequest, "Invalid user ID"}
+	}
+	role := mux.Vars(r)["role"]
+	if err := checkUserExists(ctx, tx, userID); err != nil {
+		return 0, "", err
+	}
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists)
+	if err == nil && !exists {
+		err = errUnknownRole
+	}
+	return userID, role, err
+}
+
+// grantRoleHandler grants a role to a user. Granting it again is a no-op.
+// The user's permissions change with the next access token, on login or
+// refresh.
+func grantRoleHandler(w http.ResponseWriter, r *http.Request) {
+	caller := authz.FromContext(r.Context())
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, role, err := roleTarget(r.Context(), tx, r)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+
+	result, err := tx.ExecContext(r.Context(), `
+		INSERT INTO user_roles (user_id, role, granted_by) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, role) DO NOTHING
+	`, userID, role, caller.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		err = outbox.Write(r.Context(), tx, "user", userID, outbox.UserRoleGranted, map[string]interface{}{
+			"user_id":    userID,
+			"role":       role,
+			"granted_by": caller.UserID,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeRoleHandler takes a role away from a user. The user's unexpired
+// access tokens are revoked too, so the permissions the role granted stop
+// working at once; refreshing issues tokens without them. The last admin
+// cannot be revoked.
+func revokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	caller := authz.FromContext(r.Context())
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, role, err := roleTarget(r.Context(), tx, r)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+
+	if role == authz.RoleAdmin {
+		// Locking the admin rows keeps two admins from revoking each other
+		admins, err := queryStrings(r.Context(), tx, `
+			SELECT user_id::text FROM user_roles WHERE role = $1 FOR UPDATE
+		`, authz.RoleAdmin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(admins) == 1 && admins[0] == strconv.Itoa(userID) {
+			writeRoleError(w, errLastAdmin)
+			return
+		}
+	}
+
+	result, err := tx.ExecContext(r.Context(), `
+		DELETE FROM user_roles WHERE user_id = $1 AND role = $2
+	`, userID, role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		_, err = tx.ExecContext(r.Context(), `
+			INSERT INTO revoked_tokens (jti, user_id, reason, expires_at)
+			SELECT access_jti, user_id, $2::varchar, access_expires_at
+			FROM refresh_tokens
+			WHERE user_id = $1 AND access_expires_at > NOW()
+			ON CONFLICT (jti) DO NOTHING
+		`, userID, revokedRoleChange)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = outbox.Write(r.Context(), tx, "user", userID, outbox.UserRoleRevoked, map[string]interface{}{
+			"user_id":    userID,
+			"role":       role,
+			"revoked_by": caller.UserID,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/config"
+)
+
+const tokenCleanupInterval = time.Hour
+
+// Lifetimes of access tokens (JWTs) and of refresh tokens
+var (
+	tokenTTL        = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var refreshTokenReuse = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "user_refresh_token_reuse_total",
+	Help: "Refresh tokens presented again after being rotated; each revokes its token family.",
+})
+
+// Reasons recorded for revoked access tokens
+const (
+	revokedLogout     = "logout"
+	revokedReuse      = "refresh_token_reuse"
+	revokedRoleChange = "role_revoked"
+)
+
+func initTokens(conf *config.Loader) {
+	tokenTTL = conf.Duration("JWT_TTL", tokenTTL)
+	refreshTokenTTL = conf.Duration("REFRESH_TOKEN_TTL", refreshTokenTTL)
+}
+
+// TokenResponse is returned by login and refresh.
+type TokenResponse struct {
+	// Token repeats AccessToken for clients written before refresh tokens
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	User         *User  `json:"user,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken is how refresh tokens are stored, so a leaked table cannot be
+// used to refresh.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens signs an access token for user, carrying the user's current
+// roles and permissions, and stores a new refresh token of family with tx.
+func issueTokens(ctx context.Context, tx *sql.Tx, user User, family string) (*TokenResponse, error) {
+	roles, permissions, err := loadAuthorization(ctx, tx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	jti, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	claims := &Claims{
+		UserID:      user.ID,
+		Email:       user.Email,
+		Roles:       roles,
+		Permissions: permissions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+		},
+	}
+	accessToken, err := signToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, access_jti, access_expires_at, expires_at)
+		VALUES ($1, $2, $3, $4, to_timestamp($5), NOW() + make_interval(secs => $6))
+	`, user.ID, family, hashToken(refreshToken), jti, claims.ExpiresAt.Unix(), refreshTokenTTL.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		Token:        accessToken,
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(tokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// revokeFamily revokes every refresh token of family, and the access tokens
+// issued with them that have not expired yet.
+func revokeFamily(ctx context.Context, tx *sql.Tx, family, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (jti, user_id, reason, expires_at)
+		SELECT access_jti, user_id, $2::varchar, access_expires_at
+		FROM refresh_tokens
+		WHERE family_id = $1 AND access_expires_at > NOW()
+		ON CONFLICT (jti) DO NOTHING
+	`, family, reason)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`, family)
+	return err
+}
+
+// refreshHandler exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token is accepted once: presenting it again
+// means it was copied, so its whole family is revoked.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID                int64
+		family                 string
+		expired, used, revoked bool
+		user                   User
+	)
+	err = tx.QueryRowContext(r.Context(), `
+		SELECT t.id, t.family_id, t.expires_at < NOW(), t.used_at IS NOT NULL, t.revoked_at IS NOT NULL,
+		       u.id, u.email, u.username, u.full_name
+		FROM refresh_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t
+	`, hashToken(req.RefreshToken)).Scan(&tokenID, &family, &expired, &used, &revoked,
+		&user.ID, &user.Email, &user.Username, &user.FullName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case revoked:
+		http.Error(w, "Refresh token revoked", http.StatusUnauthorized)
+		return
+	case used:
+		refreshTokenReuse.Inc()
+		slog.WarnContext(r.Context(), "Refresh token reused, revoking its family", "user_id", user.ID, "family_id", family)
+		if err := revokeFamily(r.Context(), tx, family, revokedReuse); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Refresh token reused", http.StatusUnauthorized)
+		return
+	case expired:
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := tx.ExecContext(r.Context(), `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := issueTokens(r.Context(), tx, user, family)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// logoutHandler revokes the access token the request is authorized with
+// and the family of the refresh token in the body. Either may be missing,
+// e.g. once the access token has expired.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	// The body is optional
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var claims *Claims
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, tokenString, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		claims = &Claims{}
+		switch err := parseToken(tokenString, claims); {
+		case errors.Is(err, jwt.ErrTokenExpired):
+			// Nothing left to revoke
+			claims = nil
+		case err != nil:
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+	if claims == nil && req.RefreshToken == "" {
+		http.Error(w, "An access token or refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if claims != nil && claims.ID != "" {
+		_, err := tx.ExecContext(r.Context(), `
+			INSERT INTO revoked_tokens (jti, user_id, reason, expires_at)
+			VALUES ($1, $2, $3, to_timestamp($4))
+			ON CONFLICT (jti) DO NOTHING
+		`, claims.ID, claims.UserID, revokedLogout, claims.ExpiresAt.Unix())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.RefreshToken != "" {
+		var family string
+		err := tx.QueryRowContext(r.Context(), `
+			SELECT family_id FROM refresh_tokens WHERE token_hash = $1
+		`, hashToken(req.RefreshToken)).Scan(&family)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Unknown tokens are ignored, logging out twice is not an error
+		if err == nil {
+			if err := revokeFamily(r.Context(), tx, family, revokedLogout); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokedToken is an entry of the revocation list.
+type RevokedToken struct {
+	JTI       string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// revocationsHandler lists the revoked access tokens that have not expired
+// yet. The gateway fetches the whole list periodically and rejects tokens
+// with these jti. The list
+// stays short because access tokens are short-lived.
+func revocationsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > NOW() ORDER BY id
+	`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revoked := []RevokedToken{}
+	for rows.Next() {
+		var t RevokedToken
+		if err := rows.Scan(&t.JTI, &t.ExpiresAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		revoked = append(revoked, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked": revoked,
+	})
+}
+
+// runTokenCleanup periodically deletes expired refresh tokens and
+// revocations until ctx is cancelled.
+func runTokenCleanup(ctx context.Context) {
+	ticker := time.NewTicker(tokenCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, table := range []string{"refresh_tokens", "revoked_tokens"} {
+			result, err := db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at < NOW()`)
+			if err != nil {
+				slog.Error("Token cleanup failed", "table", table, "error", err)
+				continue
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				slog.Info("Deleted expired tokens", "table", table, "count", n)
+			}
+		}
+	}
+}
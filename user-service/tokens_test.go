@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"shared/jwks"
+)
+
+// useMockDB replaces the database with a sqlmock one for the test.
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = saved
+		mockDB.Close()
+	})
+	return mock
+}
+
+// useTestKey signs tokens with a new Ed25519 key for the test.
+func useTestKey(t *testing.T) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &signingKey{kid: "test", method: jwt.SigningMethodEdDSA, private: private}
+	public, err := jwks.New(key.kid, private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := keys.Load()
+	keys.Store(&keyring{signing: key, keys: map[string]*signingKey{key.kid: key}, set: jwks.Set{Keys: []jwks.Key{public}}})
+	t.Cleanup(func() { keys.Store(saved) })
+}
+
+// captured matches any string argument and keeps it.
+type captured struct{ value *string }
+
+func (c captured) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.value = s
+	return ok
+}
+
+const (
+	selectRefreshToken  = `SELECT t.id, t.family_id, .+\s+FROM refresh_tokens t\s+JOIN users u ON u.id = t.user_id\s+WHERE t.token_hash = \$1`
+	markUsed            = `UPDATE refresh_tokens SET used_at = NOW\(\) WHERE id = \$1`
+	insertRefreshToken  = `INSERT INTO refresh_tokens \(user_id, family_id, token_hash, access_jti, access_expires_at, expires_at\)`
+	revokeAccessTokens  = `INSERT INTO revoked_tokens \(jti, user_id, reason, expires_at\)\s+SELECT access_jti`
+	revokeRefreshTokens = `UPDATE refresh_tokens SET revoked_at = NOW\(\)\s+WHERE family_id = \$1`
+)
+
+// refreshTokenRow is refresh token 5 of family "family-1", issued to user 7.
+func refreshTokenRow(expired, used, revoked bool) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "family_id", "expired", "used", "revoked", "user_id", "email", "username", "full_name"}).
+		AddRow(5, "family-1", expired, used, revoked, 7, "ada@example.com", "ada", "Ada Lovelace")
+}
+
+func postRefresh(body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	refreshHandler(w, httptest.NewRequest("POST", "/refresh", strings.NewReader(body)))
+	return w
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	useTestKey(t)
+	mock := useMockDB(t)
+
+	var storedHash, storedJTI string
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectRefreshToken).WithArgs(hashToken("old-token")).WillReturnRows(refreshTokenRow(false, false, false))
+	mock.ExpectExec(markUsed).WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT role FROM user_roles`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("customer"))
+	mock.ExpectQuery(`SELECT DISTINCT p.permission`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"permission"}).AddRow("orders:read"))
+	mock.ExpectExec(insertRefreshToken).
+		WithArgs(7, "family-1", captured{&storedHash}, captured{&storedJTI}, sqlmock.AnyArg(), refreshTokenTTL.Seconds()).
+		WillReturnResult(sqlmock.NewResult(6, 1))
+	mock.ExpectCommit()
+
+	w := postRefresh(`{"refresh_token": "old-token"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp TokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.RefreshToken == "" || resp.RefreshToken == "old-token" {
+		t.Errorf("refresh token %q not rotated", resp.RefreshToken)
+	}
+	if hashToken(resp.RefreshToken) != storedHash {
+		t.Error("stored hash does not match the returned refresh token")
+	}
+	var claims Claims
+	if err := parseToken(resp.AccessToken, &claims); err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	if claims.UserID != 7 || claims.ID != storedJTI || len(claims.Permissions) != 1 || claims.Permissions[0] != "orders:read" {
+		t.Errorf("claims %+v, want user 7 with jti %s", claims, storedJTI)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshHandlerRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		expect     func(mock sqlmock.Sqlmock)
+		wantStatus int
+		wantBody   string
+		wantReuse  float64
+	}{
+		{
+			name:       "no token",
+			body:       `{}`,
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "unknown token",
+			body: `{"refresh_token": "forged"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectRefreshToken).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Invalid refresh token",
+		},
+		{
+			name: "expired token",
+			body: `{"refresh_token": "old-token"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectRefreshToken).WillReturnRows(refreshTokenRow(true, false, false))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Refresh token expired",
+		},
+		{
+			name: "revoked family",
+			body: `{"refresh_token": "old-token"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				// Reusing a token of a revoked family revokes nothing more
+				mock.ExpectQuery(selectRefreshToken).WillReturnRows(refreshTokenRow(false, true, true))
+				mock.ExpectRollback()
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Refresh token revoked",
+		},
+		{
+			name: "reused token revokes its family",
+			body: `{"refresh_token": "old-token"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectRefreshToken).WithArgs(hashToken("old-token")).WillReturnRows(refreshTokenRow(false, true, false))
+				mock.ExpectExec(revokeAccessTokens).WithArgs("family-1", revokedReuse).WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(revokeRefreshTokens).WithArgs("family-1").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Refresh token reused",
+			wantReuse:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useMockDB(t)
+			tt.expect(mock)
+			reuse := testutil.ToFloat64(refreshTokenReuse)
+
+			w := postRefresh(tt.body)
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("%d %q, want %d %q", w.Code, w.Body, tt.wantStatus, tt.wantBody)
+			}
+			if got := testutil.ToFloat64(refreshTokenReuse) - reuse; got != tt.wantReuse {
+				t.Errorf("reuse counter increased by %v, want %v", got, tt.wantReuse)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRandomHex(t *testing.T) {
+	a, err := randomHex(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := randomHex(16)
+	if len(a) != 32 || a == b {
+		t.Errorf("randomHex(16) = %q, %q, want two different 32 character strings", a, b)
+	}
+}